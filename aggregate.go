@@ -0,0 +1,176 @@
+/*
+@author: sk
+@date: 2024/9/22
+*/
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// 聚合函数使用累加器逐行计算，每个分组每个聚合函数一个累加器，不需要缓存分组内的所有数据
+// NULL 不参与计算(COUNT(*) 除外，每行都会传入非 NULL 值)，没有数据时除 COUNT 外结果都为 NULL
+
+type IAccumulator interface {
+	Add(val *Value)
+	Result() any
+}
+
+//=====================ExtremeAccumulator======================
+
+type ExtremeAccumulator struct { // MAX MIN
+	Res  *Value
+	Sign int // 1 取最大值 -1 取最小值
+}
+
+func (e *ExtremeAccumulator) Add(val *Value) {
+	if !val.IsNull() && (e.Res == nil || CompareValue(val, e.Res)*e.Sign > 0) {
+		e.Res = val
+	}
+}
+
+func (e *ExtremeAccumulator) Result() any {
+	if e.Res == nil {
+		return nil
+	}
+	return e.Res.Data
+}
+
+func NewExtremeAccumulator(sign int) IAccumulator {
+	return &ExtremeAccumulator{Sign: sign}
+}
+
+//=====================CountAccumulator======================
+
+type CountAccumulator struct {
+	Count int64
+}
+
+func (c *CountAccumulator) Add(val *Value) {
+	if !val.IsNull() {
+		c.Count++
+	}
+}
+
+func (c *CountAccumulator) Result() any {
+	return c.Count
+}
+
+func NewCountAccumulator() IAccumulator {
+	return &CountAccumulator{}
+}
+
+//=====================SumAccumulator======================
+
+type SumAccumulator struct { // 整数列结果为整数，浮点数列结果为浮点数
+	Type     int8
+	IntSum   int64
+	FloatSum float64
+	Has      bool // 是否有非 NULL 值
+}
+
+func (s *SumAccumulator) Add(val *Value) {
+	if val.IsNull() {
+		return
+	}
+	s.Has = true
+	if s.Type == TypInt {
+		s.IntSum += val.ToInt()
+	} else {
+		s.FloatSum += val.ToFloat()
+	}
+}
+
+func (s *SumAccumulator) Result() any {
+	if !s.Has {
+		return nil
+	}
+	if s.Type == TypInt {
+		return s.IntSum
+	}
+	return s.FloatSum
+}
+
+func NewSumAccumulator(typ int8) IAccumulator {
+	return &SumAccumulator{Type: typ}
+}
+
+//=====================AvgAccumulator======================
+
+type AvgAccumulator struct {
+	Sum   float64
+	Count int64
+}
+
+func (a *AvgAccumulator) Add(val *Value) {
+	if !val.IsNull() {
+		a.Sum += val.ToFloat()
+		a.Count++
+	}
+}
+
+func (a *AvgAccumulator) Result() any {
+	if a.Count == 0 {
+		return nil
+	}
+	return a.Sum / float64(a.Count)
+}
+
+func NewAvgAccumulator() IAccumulator {
+	return &AvgAccumulator{}
+}
+
+//=====================GroupConcatAccumulator======================
+
+type GroupConcatAccumulator struct { // 使用 , 拼接 超出 GroupConcatMaxLen 的部分截断
+	Items []string
+}
+
+func (g *GroupConcatAccumulator) Add(val *Value) {
+	if !val.IsNull() {
+		g.Items = append(g.Items, FormatValue(val))
+	}
+}
+
+func (g *GroupConcatAccumulator) Result() any {
+	if len(g.Items) == 0 {
+		return nil
+	}
+	res := strings.Join(g.Items, ",")
+	if len(res) > GroupConcatMaxLen {
+		res = res[:GroupConcatMaxLen]
+	}
+	return res
+}
+
+func NewGroupConcatAccumulator() IAccumulator {
+	return &GroupConcatAccumulator{}
+}
+
+//=====================DistinctAccumulator======================
+
+type DistinctAccumulator struct { // 聚合函数带 DISTINCT 时 相同的值只交给内部累加器一次
+	Accumulator IAccumulator
+	Seen        map[string]struct{}
+}
+
+func (d *DistinctAccumulator) Add(val *Value) {
+	if val.IsNull() {
+		return
+	}
+	key := fmt.Sprintf("%v", val.Data)
+	if _, has := d.Seen[key]; has {
+		return
+	}
+	d.Seen[key] = struct{}{}
+	d.Accumulator.Add(val)
+}
+
+func (d *DistinctAccumulator) Result() any {
+	return d.Accumulator.Result()
+}
+
+func NewDistinctAccumulator(accumulator IAccumulator) IAccumulator {
+	return &DistinctAccumulator{Accumulator: accumulator, Seen: make(map[string]struct{})}
+}
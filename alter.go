@@ -0,0 +1,92 @@
+/*
+@author: sk
+@date: 2024/10/21
+*/
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+)
+
+// ALTER TABLE 需要同时替换 数据文件 不定长文本文件 元数据，不能回滚也不记录 REDO LOG
+// 先把新的数据文件与元数据都写入 .tmp 文件，再写入 alter.log 作为提交点
+// alter.log 存在就一定要完成替换：重命名所有 .tmp 文件，删除不再需要的索引，重建索引，最后删除 alter.log
+// 这些步骤都可以重复执行，中途崩溃后启动时按 alter.log 继续完成；没有 alter.log 时残留的 .tmp 文件直接删除
+
+type AlterRecord struct {
+	Table       string
+	Rewrite     bool     // 是否重写了数据 重写后记录偏移都变了，需要重建索引
+	DropIndexes []string // 删除列后没有列的索引
+}
+
+func ReadAlterLog() *AlterRecord {
+	bs, err := os.ReadFile(path.Join(BasePath, AlterLog))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	HandleErr(err)
+	record := &AlterRecord{}
+	HandleErr(json.Unmarshal(bs, record))
+	return record
+}
+
+// 数据文件与元数据的临时文件替换正式文件
+func RenameAlterFiles(record *AlterRecord) {
+	if record.Rewrite {
+		datPath := path.Join(BasePath, fmt.Sprintf("%s.%s", record.Table, ExtDat))
+		strPath := path.Join(BasePath, fmt.Sprintf("%s.%s", record.Table, ExtStr))
+		RenameIfExist(datPath+".tmp", datPath)
+		RenameIfExist(strPath+".tmp", strPath)
+	}
+	CommitCatalog()
+}
+
+// 数据临时文件由 RewriteTable 写好(不需要重写数据时没有) meta idxes 为修改后的表与其所有索引
+func (s *Storage) SwitchTable(record *AlterRecord, meta *Table, idxes []*Index) {
+	func() {
+		defer func() { // 还没有提交 出错时丢弃临时文件 原来的数据与元数据都没有变化
+			if err := recover(); err != nil {
+				s.RemoveRewriteFiles(record.Table)
+				panic(err)
+			}
+		}()
+		SaveCatalogTemp(meta, idxes)
+		bs, err := json.Marshal(record)
+		HandleErr(err)
+		WriteFileAtomic(path.Join(BasePath, AlterLog), bs) // 提交点
+	}()
+	ReplaceCatalog(meta, idxes)
+	s.FinishAlter(record)
+}
+
+// alter.log 写入后完成剩下的步骤 启动时也会调用
+func (s *Storage) FinishAlter(record *AlterRecord) {
+	if record.Rewrite { // 关闭原文件后直接替换
+		s.OpenTable(record.Table).Close()
+		delete(s.TableFiles, record.Table)
+		s.OpenString(record.Table).Close()
+		delete(s.StringFiles, record.Table)
+	}
+	RenameAlterFiles(record)
+	for _, index := range record.DropIndexes {
+		s.DropIndex(index)
+	}
+	for _, index := range ListIndexes(record.Table) {
+		if record.Rewrite { // 数据偏移都变了，需要重建索引
+			s.BuildIndex(index)
+		} else { // 只是改名，重新打开就行了
+			s.CloseIndex(index.Name)
+		}
+	}
+	HandleErr(os.Remove(path.Join(BasePath, AlterLog)))
+}
+
+// 启动时 alter.log 存在说明 ALTER TABLE 已经提交但没有完成
+func RecoverAlterLog(storage *Storage) {
+	if record := ReadAlterLog(); record != nil {
+		storage.FinishAlter(record)
+	}
+}
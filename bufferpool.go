@@ -0,0 +1,198 @@
+/*
+@author: sk
+@date: 2024/9/21
+*/
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"io"
+	"os"
+)
+
+// 缓存池 所有表数据，不定长文本，索引文件都按页缓存在这里，按 (文件, 页偏移) 定位
+// 读写都只操作内存中的页，修改后标记为脏页，淘汰或落盘时才真正写入文件
+// 使用 LRU 淘汰，被 Pin 住的页不会被淘汰  脏页可能包含未提交的修改，依靠 UNDO LOG 回滚，已提交未落盘的修改依靠 REDO LOG 重做
+
+const (
+	BufferPoolSize = 4 * 1024 * 1024 // 缓存池默认内存上限 可以通过 Config 修改
+)
+
+type PageKey struct {
+	File   *PagedFile
+	Offset int64 // 页偏移 PageSize 对齐
+}
+
+type Page struct {
+	Key   PageKey
+	Data  []byte
+	Dirty bool
+	Pin   int           // 被 Pin 的次数 大于 0 不能被淘汰
+	Elem  *list.Element // 在 LRU 中的位置
+}
+
+type BufferPool struct {
+	MaxPages    int
+	Pages       map[PageKey]*Page
+	Lru         *list.List // 头部是最近使用的
+	BeforeFlush func()     // 脏页写入文件前调用 用于先把 UNDO LOG 落盘
+}
+
+func NewBufferPool(maxPages int) *BufferPool {
+	return &BufferPool{MaxPages: maxPages, Pages: make(map[PageKey]*Page), Lru: list.New()}
+}
+
+func (p *BufferPool) Pin(file *PagedFile, offset int64) *Page {
+	key := PageKey{File: file, Offset: offset}
+	if page, ok := p.Pages[key]; ok {
+		page.Pin++
+		p.Lru.MoveToFront(page.Elem)
+		return page
+	}
+	if len(p.Pages) >= p.MaxPages {
+		p.Evict()
+	}
+	page := &Page{Key: key, Data: make([]byte, PageSize), Pin: 1}
+	_, err := file.File.ReadAt(page.Data, offset) // 文件末尾的页可能不满一页，超出文件的页直接为空页
+	if err != io.EOF {
+		HandleErr(err)
+	}
+	page.Elem = p.Lru.PushFront(page)
+	p.Pages[key] = page
+	return page
+}
+
+func (p *BufferPool) Unpin(page *Page, dirty bool) {
+	if page.Pin <= 0 {
+		panic(fmt.Sprintf("page %v not pinned", page.Key))
+	}
+	page.Pin--
+	page.Dirty = page.Dirty || dirty
+}
+
+// 淘汰最久没有使用且没有被 Pin 的页，全部被 Pin 住时允许暂时超出上限
+func (p *BufferPool) Evict() {
+	for elem := p.Lru.Back(); elem != nil; elem = elem.Prev() {
+		page := elem.Value.(*Page)
+		if page.Pin > 0 {
+			continue
+		}
+		p.FlushPage(page)
+		p.Remove(page)
+		return
+	}
+}
+
+func (p *BufferPool) FlushPage(page *Page) {
+	if !page.Dirty {
+		return
+	}
+	if p.BeforeFlush != nil {
+		p.BeforeFlush()
+	}
+	file := page.Key.File // 只写入文件有效长度内的部分，防止文件被补齐到整页
+	l := min(int64(PageSize), file.Size-page.Key.Offset)
+	if l > 0 {
+		_, err := file.File.WriteAt(page.Data[:l], page.Key.Offset)
+		HandleErr(err)
+	}
+	page.Dirty = false
+}
+
+func (p *BufferPool) Remove(page *Page) {
+	p.Lru.Remove(page.Elem)
+	delete(p.Pages, page.Key)
+}
+
+func (p *BufferPool) FlushFile(file *PagedFile) {
+	for key, page := range p.Pages {
+		if key.File == file {
+			p.FlushPage(page)
+		}
+	}
+}
+
+// 丢弃文件在 offset 之后的所有页 不会写入
+func (p *BufferPool) DropFile(file *PagedFile, offset int64) {
+	for key, page := range p.Pages {
+		if key.File == file && key.Offset >= offset {
+			p.Remove(page)
+		}
+	}
+}
+
+// PagedFile 通过缓存池读写的文件
+type PagedFile struct {
+	File *os.File
+	Size int64 // 包含还在缓存中没有写入的部分
+	Pool *BufferPool
+}
+
+func OpenPagedFile(path string, pool *BufferPool) *PagedFile {
+	file := OpenOrCreate(path)
+	size, err := file.Seek(0, 2)
+	HandleErr(err)
+	return &PagedFile{File: file, Size: size, Pool: pool}
+}
+
+func (f *PagedFile) ReadAt(bs []byte, offset int64) {
+	if offset+int64(len(bs)) > f.Size {
+		panic(fmt.Sprintf("read %s out of range %d > %d", f.File.Name(), offset+int64(len(bs)), f.Size))
+	}
+	for len(bs) > 0 { // 可能跨页
+		pageOffset := offset / PageSize * PageSize
+		page := f.Pool.Pin(f, pageOffset)
+		n := copy(bs, page.Data[offset-pageOffset:])
+		f.Pool.Unpin(page, false)
+		bs = bs[n:]
+		offset += int64(n)
+	}
+}
+
+func (f *PagedFile) WriteAt(bs []byte, offset int64) {
+	f.Size = max(f.Size, offset+int64(len(bs)))
+	for len(bs) > 0 {
+		pageOffset := offset / PageSize * PageSize
+		page := f.Pool.Pin(f, pageOffset)
+		n := copy(page.Data[offset-pageOffset:], bs)
+		f.Pool.Unpin(page, true)
+		bs = bs[n:]
+		offset += int64(n)
+	}
+}
+
+// 追加到末尾 返回写入的偏移
+func (f *PagedFile) Append(bs []byte) int64 {
+	offset := f.Size
+	f.WriteAt(bs, offset)
+	return offset
+}
+
+func (f *PagedFile) Truncate(size int64) {
+	if size >= f.Size {
+		return
+	}
+	f.Sync() // 先把前面的脏页写入，再丢弃后面的页
+	f.Pool.DropFile(f, size/PageSize*PageSize)
+	f.Size = size
+	HandleErr(f.File.Truncate(size))
+}
+
+func (f *PagedFile) Sync() {
+	f.Pool.FlushFile(f)
+	HandleErr(f.File.Sync())
+}
+
+// 直接删除文件 缓存中的页不再写入
+func (f *PagedFile) Remove() {
+	f.Pool.DropFile(f, 0)
+	HandleErr(f.File.Close())
+	HandleErr(os.Remove(f.File.Name()))
+}
+
+func (f *PagedFile) Close() {
+	f.Sync()
+	f.Pool.DropFile(f, 0)
+	HandleErr(f.File.Close())
+}
@@ -15,9 +15,10 @@ import (
 // 元数据依旧是一张表，不过其元数据是写死的，且其数据会在系统启动时加载进内存 先直接使用 json 实现
 
 type Column struct {
-	Name string
-	Type int8
-	Len  int64
+	Name     string
+	Type     int8
+	Len      int64
+	Nullable bool // 是否允许为 NULL 旧表没有该字段，都是不允许为 NULL 的
 }
 
 func (c *Column) String() string {
@@ -33,6 +34,7 @@ type Index struct {
 	Name      string
 	TableName string
 	Columns   []string // 这里可以直接使用名称引用表中的列
+	NonUnique bool     // 唯一索引不允许重复的 key  包含 NULL 的 key 不算重复 之前的索引都是唯一索引，缺省为唯一索引
 }
 
 // 函数元数据还需要定义输入与输出
@@ -40,27 +42,29 @@ type Func struct { // 函数定义
 	Name             string
 	IsAggregate      bool                               // 是否为聚合函数
 	RetType          func() (int8, int64)               // 非聚合函数，返回值类型与长度是固定的
-	AggregateRetType func(column *Column) (int8, int64) // 聚合函数需要根据对应列决定返回类型与长度
-	Call             func(params []*Value) any          // 计算最终值
+	AggregateRetType func(column *Column) (int8, int64) // 聚合函数需要根据对应列决定返回类型与长度 COUNT(*) 的列为 nil
+	Call             func(params []*Value) any          // 非聚合函数计算结果
+	Accumulator      func(column *Column) IAccumulator  // 聚合函数创建累加器，逐行累加计算
 }
 
 var (
 	tables  = make([]*Table, 0)
 	indexes = make([]*Index, 0)
-	// 待实现的聚合函数 count sum avg max min
+	// 只有执行过 ANALYZE TABLE 的表才有统计信息
+	stats = make([]*TableStat, 0)
 	funcs = []*Func{{ // 函数是内置的不需要序列化
-		Name:        "MAX",
-		IsAggregate: true,
-		AggregateRetType: func(column *Column) (int8, int64) {
-			return column.Type, column.Len
+		Name:             "MAX",
+		IsAggregate:      true,
+		AggregateRetType: ColumnRetType,
+		Accumulator: func(column *Column) IAccumulator {
+			return NewExtremeAccumulator(1)
 		},
-		Call: func(params []*Value) any { // 不会为 0 个
-			for i := 1; i < len(params); i++ {
-				if CompareValue(params[i], params[0]) > 0 {
-					params[0] = params[i]
-				}
-			}
-			return params[0].Data
+	}, {
+		Name:             "MIN",
+		IsAggregate:      true,
+		AggregateRetType: ColumnRetType,
+		Accumulator: func(column *Column) IAccumulator {
+			return NewExtremeAccumulator(-1)
 		},
 	}, {
 		Name:        "COUNT",
@@ -68,8 +72,37 @@ var (
 		AggregateRetType: func(column *Column) (int8, int64) {
 			return TypInt, 8
 		},
-		Call: func(params []*Value) any {
-			return int64(len(params))
+		Accumulator: func(column *Column) IAccumulator {
+			return NewCountAccumulator()
+		},
+	}, {
+		Name:        "SUM",
+		IsAggregate: true,
+		AggregateRetType: func(column *Column) (int8, int64) {
+			CheckNumberColumn("SUM", column)
+			return column.Type, 8
+		},
+		Accumulator: func(column *Column) IAccumulator {
+			return NewSumAccumulator(column.Type)
+		},
+	}, {
+		Name:        "AVG",
+		IsAggregate: true,
+		AggregateRetType: func(column *Column) (int8, int64) {
+			CheckNumberColumn("AVG", column)
+			return TypFloat, 8
+		},
+		Accumulator: func(column *Column) IAccumulator {
+			return NewAvgAccumulator()
+		},
+	}, {
+		Name:        "GROUP_CONCAT",
+		IsAggregate: true,
+		AggregateRetType: func(column *Column) (int8, int64) {
+			return TypStr, GroupConcatMaxLen
+		},
+		Accumulator: func(column *Column) IAccumulator {
+			return NewGroupConcatAccumulator()
 		},
 	}, {
 		Name:        "TEST",
@@ -86,6 +119,10 @@ var (
 // 元数据信息先以 json 形式存储，因为经常使用需要常驻内存
 
 func LoadCatalog() {
+	// 上次 ALTER TABLE 已经提交但还没有替换完文件，先替换再读取
+	if record := ReadAlterLog(); record != nil {
+		RenameAlterFiles(record)
+	}
 	bs, err := os.ReadFile(path.Join(BasePath, CatalogTable))
 	HandleErr(err)
 	HandleErr(json.Unmarshal(bs, &tables))
@@ -93,16 +130,136 @@ func LoadCatalog() {
 	bs, err = os.ReadFile(path.Join(BasePath, CatalogIndex))
 	HandleErr(err)
 	HandleErr(json.Unmarshal(bs, &indexes))
+
+	bs, err = os.ReadFile(path.Join(BasePath, CatalogStat))
+	if !os.IsNotExist(err) { // 旧的数据目录没有统计信息
+		HandleErr(err)
+		HandleErr(json.Unmarshal(bs, &stats))
+	}
+	// 恢复上次异常退出时的数据，依赖上面的元数据
+	Recover()
+	RemoveSpillFiles()
 }
 
 func SaveCatalog() {
 	bs, err := json.Marshal(tables)
 	HandleErr(err)
-	HandleErr(os.WriteFile(path.Join(BasePath, CatalogTable), bs, 0666))
+	WriteFileAtomic(path.Join(BasePath, CatalogTable), bs)
 
 	bs, err = json.Marshal(indexes)
 	HandleErr(err)
-	HandleErr(os.WriteFile(path.Join(BasePath, CatalogIndex), bs, 0666))
+	WriteFileAtomic(path.Join(BasePath, CatalogIndex), bs)
+
+	bs, err = json.Marshal(stats)
+	HandleErr(err)
+	WriteFileAtomic(path.Join(BasePath, CatalogStat), bs)
+}
+
+// 先写临时文件再重命名，保证元数据不会只写一半
+func WriteFileAtomic(path0 string, bs []byte) {
+	WriteFileSync(path0+".tmp", bs)
+	HandleErr(os.Rename(path0+".tmp", path0))
+}
+
+func WriteFileSync(path0 string, bs []byte) {
+	file, err := os.Create(path0)
+	HandleErr(err)
+	_, err = file.Write(bs)
+	HandleErr(err)
+	HandleErr(file.Sync())
+	HandleErr(file.Close())
+}
+
+// ALTER TABLE 修改后的元数据先写入临时文件，与数据文件一起由 CommitCatalog 替换
+// meta idxes 为修改后的表与其所有索引，不修改内存中的元数据
+func SaveCatalogTemp(meta *Table, idxes []*Index) {
+	tables0, indexes0, stats0 := alterCatalog(meta, idxes)
+	bs, err := json.Marshal(tables0)
+	HandleErr(err)
+	WriteFileSync(path.Join(BasePath, CatalogTable+".tmp"), bs)
+
+	bs, err = json.Marshal(indexes0)
+	HandleErr(err)
+	WriteFileSync(path.Join(BasePath, CatalogIndex+".tmp"), bs)
+
+	bs, err = json.Marshal(stats0)
+	HandleErr(err)
+	WriteFileSync(path.Join(BasePath, CatalogStat+".tmp"), bs)
+}
+
+// 临时文件写完后替换元数据文件 重复调用没有影响
+func CommitCatalog() {
+	for _, name := range []string{CatalogTable, CatalogIndex, CatalogStat} {
+		RenameIfExist(path.Join(BasePath, name+".tmp"), path.Join(BasePath, name))
+	}
+}
+
+// 内存中的元数据替换为修改后的
+func ReplaceCatalog(meta *Table, idxes []*Index) {
+	tables, indexes, stats = alterCatalog(meta, idxes)
+}
+
+// 替换表与其所有索引 列变了 统计信息需要重新收集
+func alterCatalog(meta *Table, idxes []*Index) ([]*Table, []*Index, []*TableStat) {
+	tables0 := make([]*Table, 0)
+	for _, item := range tables {
+		if item.Name == meta.Name {
+			item = meta
+		}
+		tables0 = append(tables0, item)
+	}
+	indexes0 := make([]*Index, 0)
+	for _, item := range indexes {
+		if item.TableName != meta.Name {
+			indexes0 = append(indexes0, item)
+		}
+	}
+	indexes0 = append(indexes0, idxes...)
+	stats0 := make([]*TableStat, 0)
+	for _, item := range stats {
+		if item.Table != meta.Name {
+			stats0 = append(stats0, item)
+		}
+	}
+	return tables0, indexes0, stats0
+}
+
+// MAX MIN 结果与列的类型长度一致
+func ColumnRetType(column *Column) (int8, int64) {
+	return column.Type, column.Len
+}
+
+func CheckNumberColumn(name string, column *Column) {
+	if column.Type != TypInt && column.Type != TypFloat {
+		panic(fmt.Sprintf("func %s not support column %s", name, column.Name))
+	}
+}
+
+// 复合查询的结果列 列数必须一致 使用左侧的列名
+// 整数与浮点数合并为浮点数 定长与不定长字符串合并为不定长 NULL 字面量与任何类型兼容
+func MergeSetColumns(left []*Column, right []*Column) []*Column {
+	if len(left) != len(right) {
+		panic(fmt.Sprintf("set operation column count not match %d != %d", len(left), len(right)))
+	}
+	res := make([]*Column, 0)
+	for i, column := range left {
+		other := right[i]
+		typ := column.Type
+		switch {
+		case typ == other.Type:
+		case typ == TypNull:
+			typ = other.Type
+		case other.Type == TypNull:
+		case (typ == TypInt || typ == TypFloat) && (other.Type == TypInt || other.Type == TypFloat):
+			typ = TypFloat
+		case (typ == TypStr || typ == TypTxt) && (other.Type == TypStr || other.Type == TypTxt):
+			typ = TypTxt
+		default:
+			panic(&TypeError{Msg: fmt.Sprintf("set operation column %s type %d not compatible with %s type %d", column.Name, column.Type, other.Name, other.Type)})
+		}
+		res = append(res, &Column{Name: column.Name, Type: typ, Len: max(column.Len, other.Len), Nullable: true})
+	}
+	return res
 }
 
 func GetFunc(name string) *Func {
@@ -112,7 +269,7 @@ func GetFunc(name string) *Func {
 			return func0
 		}
 	}
-	panic(fmt.Sprintf("func %s not found", name))
+	panic(&NotFoundError{Kind: "func", Name: name})
 }
 
 func GetTable(table string) *Table {
@@ -121,36 +278,66 @@ func GetTable(table string) *Table {
 			return item
 		}
 	}
-	panic("table not found: " + table)
+	panic(&NotFoundError{Kind: "table", Name: table})
 }
 
 func AddTable(table *Table) {
 	for _, item := range tables {
 		if item.Name == table.Name {
-			panic(fmt.Sprintf("table %s already exists", table.Name))
+			panic(&ExistsError{Kind: "table", Name: table.Name})
 		}
 	}
 	tables = append(tables, table)
 }
 
+func HasTable(table string) bool {
+	for _, item := range tables {
+		if item.Name == table {
+			return true
+		}
+	}
+	return false
+}
+
+// 只移除表本身，索引需要单独移除
+func RemoveTable(table string) {
+	for i, item := range tables {
+		if item.Name == table {
+			tables = append(tables[:i], tables[i+1:]...)
+			return
+		}
+	}
+	panic(&NotFoundError{Kind: "table", Name: table})
+}
+
 func GetIndex(index string) *Index {
 	for _, item := range indexes {
 		if item.Name == index {
 			return item
 		}
 	}
-	panic("index not found: " + index)
+	panic(&NotFoundError{Kind: "index", Name: index})
 }
 
 func AddIndex(index *Index) {
 	for _, item := range indexes {
 		if item.Name == index.Name {
-			panic(fmt.Sprintf("index %s already exists", index.Name))
+			panic(&ExistsError{Kind: "index", Name: index.Name})
 		}
 	}
 	indexes = append(indexes, index)
 }
 
+func RemoveIndex(index string) {
+	for i, item := range indexes {
+		if item.Name == index {
+			indexes = append(indexes[:i], indexes[i+1:]...)
+			return
+		}
+	}
+	panic(&NotFoundError{Kind: "index", Name: index})
+}
+
 func ListIndexes(table string) []*Index {
 	idxes := make([]*Index, 0)
 	for _, index := range indexes {
@@ -160,3 +347,29 @@ func ListIndexes(table string) []*Index {
 	}
 	return idxes
 }
+
+// 没有统计信息返回 nil
+func GetTableStat(table string) *TableStat {
+	for _, item := range stats {
+		if item.Table == table {
+			return item
+		}
+	}
+	return nil
+}
+
+// 重新收集的直接替换
+func SetTableStat(stat *TableStat) {
+	RemoveTableStat(stat.Table)
+	stats = append(stats, stat)
+}
+
+// 表结构变化或数据清空后统计信息失效
+func RemoveTableStat(table string) {
+	for i, item := range stats {
+		if item.Table == table {
+			stats = append(stats[:i], stats[i+1:]...)
+			return
+		}
+	}
+}
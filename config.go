@@ -0,0 +1,34 @@
+/*
+@author: sk
+@date: 2024/10/22
+*/
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+)
+
+// 内存预算 启动时从 data/config.json 读取，文件不存在或缺少的字段使用默认值
+// 例如 {"BufferPoolSize":67108864,"SortBufferSize":16777216}
+
+type Config struct {
+	BufferPoolSize  int64 // 缓存池内存上限
+	SortBufferSize  int64 // 每个排序算子的内存上限 超过后使用外排序
+	GroupBufferSize int64 // 每个哈希聚合算子的内存上限 超过后分区落盘
+}
+
+func LoadConfig() *Config {
+	res := &Config{BufferPoolSize: BufferPoolSize, SortBufferSize: SortBufferSize, GroupBufferSize: GroupBufferSize}
+	bs, err := os.ReadFile(path.Join(BasePath, ConfigFile))
+	if os.IsNotExist(err) {
+		return res
+	}
+	HandleErr(err)
+	HandleErr(json.Unmarshal(bs, res))
+	if res.BufferPoolSize < PageSize { // 至少需要一页
+		res.BufferPoolSize = PageSize
+	}
+	return res
+}
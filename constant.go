@@ -9,26 +9,37 @@ const (
 	ExtDat   = "dat" // 表数据存储文件 表名.dat 二进制 存储
 	ExtIdx   = "idx" // 索引数据存储文件 索引名.idx b+tree 存储 是哪个表的索引通过 index_catalog表 获取
 	ExtStr   = "str" // 不定长字符串存储 对应表名.str 索引不支持不定长文本
+	ExtRun   = "run" // 外排序 聚合落盘的临时文件 前缀_随机串.run 启动时清理残留的
 )
 
 // 数据直接累加紧密存储 每条记录前一个 byte 标记该记录是否被删除  增加尾部增加  删除标记删除  更新直接更新
 // 索引通过 b+tree 存储 key可能是多列 value 是偏移  还有软删标记 byte  增加直接增加  删除标记删除 更新先删除再增加
 // 不定长字符串存储 长度(uint64)+内容
+// 表中存在可以为 NULL 的列时，每条记录删除标记后面还有一个 NULL 位图，每列 1bit 置位表示该列为 NULL，NULL 列的数据部分全部填 0
 // 上面都是不管删除的 长时间使用要进行重建 根据有效的数据重建数据，索引，字符串常量集
 
 const (
 	CatalogTable = "table.catalog" // 其他表信息的元数据表
 	CatalogIndex = "index.catalog" // 其他索引信息的元数据表
+	CatalogStat  = "stat.catalog"  // ANALYZE TABLE 收集的统计信息
 	UndoLog      = "undo.log"      // 采用尾添加的方式，读取时全部读取倒叙恢复
+	RedoLog      = "redo.log"      // 顺序写入，提交时落盘，检查点后可以截断
+	ConfigFile   = "config.json"   // 内存预算等配置 可以没有
+	AlterLog     = "alter.log"     // ALTER TABLE 的临时文件都写好后创建，存在时启动时继续替换文件
 )
 
 const (
-	// 不允许插入 NULL 值
 	TypInt   = 1 // int64
 	TypFloat = 2 // float64
 	TypStr   = 3 // string 定长的
 	TypTxt   = 4 // string 不定长的
 	TypBool  = 5 // 数据库中没有，条件判断中使用的
+	TypNull  = 6 // 数据库中没有，NULL 字面量使用的 NULL 值统一使用 nil 表示
+)
+
+const ( // 布尔字面量只由常量折叠产生
+	TrueValue  = "TRUE"
+	FalseValue = "FALSE"
 )
 
 const (
@@ -37,3 +48,20 @@ const (
 	CmdRollback = "ROLLBACK"
 	CmdExit     = "EXIT"
 )
+
+const (
+	MaxIndexRanges    = 256   // IN 展开的索引范围上限 太多了不如直接范围扫描
+	GroupConcatMaxLen = 1024  // GROUP_CONCAT 结果的长度
+	HistogramBuckets  = 32    // ANALYZE TABLE 每列等高直方图的桶数
+	StatSampleSize    = 10000 // ANALYZE TABLE 每列抽样的值个数
+	StatDistinctLimit = 65536 // ANALYZE TABLE 精确统计不同值个数的上限
+)
+
+// 代价模型 只用于比较执行计划的相对代价  有统计信息时才使用，没有统计信息沿用原来的规则
+const (
+	CostSeqRow         = 1.0     // 全表扫描读取一行
+	CostIndexRow       = 0.8     // 索引扫描读取一项 索引项比数据行小
+	CostLookupRow      = 4.0     // 回表随机读取一行
+	CostCpuRow         = 0.2     // 过滤 hash 比较等 每行的计算
+	DefaultSelectivity = 1.0 / 3 // 无法估计的条件的选择率
+)
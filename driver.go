@@ -48,7 +48,10 @@ const (
 )
 
 const (
-	CmdQuery = 0x03
+	CmdQuit   = 0x01
+	CmdInitDB = 0x02
+	CmdQuery  = 0x03
+	CmdPing   = 0x0E
 )
 
 const (
@@ -56,9 +59,23 @@ const (
 )
 
 const (
-	ColumnLong    = 0x03
-	ColumnVarChar = 0xFD
-	ColumnDouble  = 0x05
+	ColumnLong     = 0x03
+	ColumnLongLong = 0x08
+	ColumnVarChar  = 0xFD
+	ColumnDouble   = 0x05
+)
+
+const (
+	StatusInTrans    = 0x0001 // 处于事务中
+	StatusAutocommit = 0x0002 // 自动提交
+)
+
+const (
+	PkgOk       = 0x00
+	PkgAuthMore = 0x01
+	PkgNull     = 0xFB // 文本行中的 NULL 值
+	PkgEof      = 0xFE
+	PkgErr      = 0xFF
 )
 
 type Package struct {
@@ -69,6 +86,9 @@ type Package struct {
 }
 
 func (p *Package) Read(bs []byte) (n int, err error) {
+	if p.Index >= len(p.Data) && len(bs) > 0 { // 读完了必须返回 EOF 否则 ReadCStr 会死循环
+		return 0, io.EOF
+	}
 	count := copy(bs, p.Data[p.Index:])
 	p.Index += count
 	return count, nil
@@ -105,14 +125,14 @@ func WriteU24(writer io.Writer, val uint32) {
 
 func ReadBytes(reader io.Reader, len0 uint32) []byte {
 	bs := make([]byte, len0)
-	_, err := reader.Read(bs)
+	_, err := io.ReadFull(reader, bs) // 网络数据可能分多次到达
 	HandleErr(err)
 	return bs
 }
 
 func ReadU8(reader io.Reader) uint8 {
 	bs := make([]byte, 1)
-	_, err := reader.Read(bs)
+	_, err := io.ReadFull(reader, bs)
 	HandleErr(err)
 	return bs[0]
 }
@@ -125,7 +145,7 @@ func ReadNStr(reader io.Reader) string {
 
 func ReadU24(reader io.Reader) uint32 {
 	bs := make([]byte, 4)
-	_, err := reader.Read(bs[:3]) // 最高位空着
+	_, err := io.ReadFull(reader, bs[:3]) // 最高位空着
 	HandleErr(err)
 	return binary.LittleEndian.Uint32(bs)
 }
@@ -146,7 +166,7 @@ func ReadCStr(reader io.Reader) string {
 
 func ReadU32(reader io.Reader) uint32 {
 	bs := make([]byte, 4)
-	_, err := reader.Read(bs)
+	_, err := io.ReadFull(reader, bs)
 	HandleErr(err)
 	return binary.LittleEndian.Uint32(bs)
 }
@@ -158,7 +178,7 @@ func ReadFull(reader io.Reader, bs []byte) {
 
 func ReadU16(reader io.Reader) uint16 {
 	bs := make([]byte, 2)
-	_, err := reader.Read(bs)
+	_, err := io.ReadFull(reader, bs)
 	HandleErr(err)
 	return binary.LittleEndian.Uint16(bs)
 }
@@ -170,6 +190,13 @@ func WriteU32(writer io.Writer, val uint32) {
 	HandleErr(err)
 }
 
+func WriteU16(writer io.Writer, val uint16) {
+	bs := make([]byte, 2)
+	binary.LittleEndian.PutUint16(bs, val)
+	_, err := writer.Write(bs)
+	HandleErr(err)
+}
+
 func WriteU8(writer io.Writer, val uint8) {
 	_, err := writer.Write([]byte{val})
 	HandleErr(err)
@@ -265,6 +292,42 @@ func WriteNStr(writer io.Writer, val string) {
 	WriteBytes(writer, []byte(val))
 }
 
+// 长度编码整数 < 251 1byte  0xFC+2byte  0xFD+3byte  0xFE+8byte
+func ReadLenEnc(reader io.Reader) uint64 {
+	first := ReadU8(reader)
+	switch first {
+	case 0xFC:
+		return uint64(ReadU16(reader))
+	case 0xFD:
+		return uint64(ReadU24(reader))
+	case 0xFE:
+		bs := ReadBytes(reader, 8)
+		return binary.LittleEndian.Uint64(bs)
+	default:
+		return uint64(first)
+	}
+}
+
+func WriteLenEnc(writer io.Writer, val uint64) {
+	if val < 251 {
+		WriteU8(writer, uint8(val))
+	} else if val < 1<<16 {
+		WriteU8(writer, 0xFC)
+		WriteU16(writer, uint16(val))
+	} else if val < 1<<24 {
+		WriteU8(writer, 0xFD)
+		WriteU24(writer, uint32(val))
+	} else {
+		WriteU8(writer, 0xFE)
+		WriteBytes(writer, Uint64ToByte(val))
+	}
+}
+
+func WriteLenEncStr(writer io.Writer, val string) {
+	WriteLenEnc(writer, uint64(len(val)))
+	WriteBytes(writer, []byte(val))
+}
+
 func (d *Driver) HandleLoginResp(conn net.Conn) {
 	pkg1 := ReadPackage(conn)
 	pkg2 := ReadPackage(conn)
@@ -313,7 +376,7 @@ type ResultColumn struct {
 
 type Result struct {
 	Columns []*ResultColumn
-	Data    [][]string
+	Data    [][]*string // nil 为 NULL
 	Index   int
 }
 
@@ -323,9 +386,12 @@ func (r *Result) Next() bool {
 }
 
 func (r *Result) GetData(i int) any {
-	data := r.Data[r.Index][i]
+	if r.Data[r.Index][i] == nil {
+		return nil
+	}
+	data := *r.Data[r.Index][i]
 	switch r.Columns[i].Type {
-	case ColumnLong:
+	case ColumnLong, ColumnLongLong:
 		res, err := strconv.ParseInt(data, 10, 64)
 		HandleErr(err)
 		return res
@@ -361,9 +427,17 @@ func (d *DB) Query(sql string, args ...any) *Result {
 	}
 	WritePackage(d.Conn, pkg)
 
-	// 先获取列数目
+	// 先获取列数目 非查询语句直接返回 OK 包，出错返回 ERR 包
 	pkg = ReadPackage(d.Conn)
 	columnCount := ReadU8(pkg)
+	if columnCount == PkgOk {
+		return &Result{Index: -1}
+	}
+	if columnCount == PkgErr {
+		code := ReadU16(pkg)
+		ReadBytes(pkg, 6) // # + sql_state
+		panic(fmt.Sprintf("query error %d: %s", code, string(pkg.Data[pkg.Index:])))
+	}
 	// 循环获取所有列信息
 	columns := make([]*ResultColumn, 0)
 	for i := 0; i < int(columnCount); i++ {
@@ -395,7 +469,7 @@ func (d *DB) Query(sql string, args ...any) *Result {
 		panic(fmt.Sprintf("code error: 0x%x", code))
 	}
 	// 获取具体数据
-	data := make([][]string, 0)
+	data := make([][]*string, 0)
 	for {
 		pkg = ReadPackage(d.Conn)
 		code = ReadU8(pkg)
@@ -403,9 +477,15 @@ func (d *DB) Query(sql string, args ...any) *Result {
 			break
 		}
 		pkg.Reset()
-		row := make([]string, 0)
+		row := make([]*string, 0)
 		for i := 0; i < int(columnCount); i++ {
-			row = append(row, ReadNStr(pkg))
+			if pkg.Data[pkg.Index] == PkgNull {
+				pkg.Index++
+				row = append(row, nil)
+			} else {
+				val := ReadNStr(pkg)
+				row = append(row, &val)
+			}
 		}
 		data = append(data, row)
 	}
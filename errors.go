@@ -0,0 +1,236 @@
+/*
+@author: sk
+@date: 2024/10/18
+*/
+package main
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+)
+
+// 引擎内部出错时直接 panic 带类型的错误，不需要每层都返回 error
+// 在执行一条语句的边界(ExecSql CatchErr)统一 recover 转换为 error 返回，REPL 与服务端报告错误后继续运行
+// 修改语句中途出错时回滚这条语句已做的修改，不影响所在事务之前的修改
+
+// MySQL 错误码 服务端返回 ERR 包使用
+const (
+	ErrCodeSyntax     = 1064 // ER_PARSE_ERROR
+	ErrCodeNoTable    = 1146 // ER_NO_SUCH_TABLE
+	ErrCodeBadField   = 1054 // ER_BAD_FIELD_ERROR
+	ErrCodeNoIndex    = 1091 // ER_CANT_DROP_FIELD_OR_KEY
+	ErrCodeDupKey     = 1062 // ER_DUP_ENTRY
+	ErrCodeBadNull    = 1048 // ER_BAD_NULL_ERROR
+	ErrCodeWrongValue = 1366 // ER_TRUNCATED_WRONG_VALUE_FOR_FIELD
+	ErrCodeIO         = 1030 // ER_GET_ERRNO
+	ErrCodeTableExist = 1050 // ER_TABLE_EXISTS_ERROR
+	ErrCodeDupIndex   = 1061 // ER_DUP_KEYNAME
+	ErrCodeDupField   = 1060 // ER_DUP_FIELDNAME
+	ErrCodeValueCount = 1136 // ER_WRONG_VALUE_COUNT_ON_ROW
+	ErrCodeNonUniq    = 1052 // ER_NON_UNIQ_ERROR
+	ErrCodeNonUniqTbl = 1066 // ER_NONUNIQ_TABLE
+)
+
+type SyntaxError struct { // 词法 语法错误 Pos 为出错位置在 sql 中的下标
+	Pos int
+	Msg string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("syntax error at position %d: %s", e.Pos, e.Msg)
+}
+
+type NotFoundError struct { // 表 列 索引 函数不存在
+	Kind string // table column index func
+	Name string
+}
+
+func (e *NotFoundError) Error() string {
+	return fmt.Sprintf("unknown %s %s", e.Kind, e.Name)
+}
+
+type ExistsError struct { // 创建的表 索引 列已经存在
+	Kind string // table index column
+	Name string
+}
+
+func (e *ExistsError) Error() string {
+	return fmt.Sprintf("%s %s already exists", e.Kind, e.Name)
+}
+
+type AmbiguousError struct { // 表名 列名有歧义 需要加别名或表名限定
+	Kind string // table column
+	Name string
+}
+
+func (e *AmbiguousError) Error() string {
+	return fmt.Sprintf("%s %s is ambiguous", e.Kind, e.Name)
+}
+
+type TypeError struct { // 类型不匹配 值无法转换为对应类型
+	Msg string
+}
+
+func (e *TypeError) Error() string {
+	return "type mismatch: " + e.Msg
+}
+
+type ConstraintError struct { // 违反唯一索引 NOT NULL 长度等约束
+	Kind string // unique not_null too_long value_count
+	Msg  string
+}
+
+func (e *ConstraintError) Error() string {
+	return "constraint violation: " + e.Msg
+}
+
+type IOError struct { // 读写文件出错
+	Err error
+}
+
+func (e *IOError) Error() string {
+	return "io error: " + e.Err.Error()
+}
+
+func (e *IOError) Unwrap() error {
+	return e.Err
+}
+
+type ExecError struct { // 其他执行错误 例如不支持的用法，事务状态不对
+	Msg string
+}
+
+func (e *ExecError) Error() string {
+	return e.Msg
+}
+
+// 把 panic 的值转换为带类型的 error
+func ToError(val any) error {
+	switch err := val.(type) {
+	case *SyntaxError, *NotFoundError, *ExistsError, *AmbiguousError, *TypeError, *ConstraintError, *IOError, *ExecError:
+		return err.(error)
+	case runtime.Error: // 程序本身的问题 也只让这条语句失败
+		return &ExecError{Msg: "internal error: " + err.Error()}
+	case error:
+		return &IOError{Err: err}
+	default:
+		return &ExecError{Msg: fmt.Sprintf("%v", val)}
+	}
+}
+
+func ErrCode(err error) uint16 {
+	var syntaxErr *SyntaxError
+	var notFoundErr *NotFoundError
+	var existsErr *ExistsError
+	var ambiguousErr *AmbiguousError
+	var typeErr *TypeError
+	var constraintErr *ConstraintError
+	var ioErr *IOError
+	switch {
+	case errors.As(err, &syntaxErr):
+		return ErrCodeSyntax
+	case errors.As(err, &notFoundErr):
+		if notFoundErr.Kind == "table" {
+			return ErrCodeNoTable
+		}
+		if notFoundErr.Kind == "column" {
+			return ErrCodeBadField
+		}
+		if notFoundErr.Kind == "index" {
+			return ErrCodeNoIndex
+		}
+	case errors.As(err, &existsErr):
+		switch existsErr.Kind {
+		case "table":
+			return ErrCodeTableExist
+		case "index":
+			return ErrCodeDupIndex
+		case "column":
+			return ErrCodeDupField
+		}
+	case errors.As(err, &ambiguousErr):
+		if ambiguousErr.Kind == "table" {
+			return ErrCodeNonUniqTbl
+		}
+		return ErrCodeNonUniq
+	case errors.As(err, &typeErr):
+		return ErrCodeWrongValue
+	case errors.As(err, &constraintErr):
+		if constraintErr.Kind == "unique" {
+			return ErrCodeDupKey
+		}
+		if constraintErr.Kind == "not_null" {
+			return ErrCodeBadNull
+		}
+		if constraintErr.Kind == "value_count" {
+			return ErrCodeValueCount
+		}
+		return ErrCodeWrongValue
+	case errors.As(err, &ioErr):
+		return ErrCodeIO
+	}
+	return ErrQuery
+}
+
+// 执行 fn 把其中 panic 的错误转换为 error 返回
+func CatchErr(fn func()) (err error) {
+	defer func() {
+		if val := recover(); val != nil {
+			err = ToError(val)
+		}
+	}()
+	fn()
+	return nil
+}
+
+// 执行一条 sql  handle 处理执行结果(打印或返回给客户端)  出错时返回带类型的错误
+// 修改语句不在事务中时开启隐式事务，出错整体回滚；在事务中时只回滚到这条语句开始前
+func ExecSql(storage *Storage, sql string, handle func(node INode, operator IOperator)) error {
+	var node INode
+	var operator IOperator
+	err := CatchErr(func() {
+		node = NewParser(NewScanner(sql).ScanTokens()).ParseTokens()
+		operator = NewTransformer(node, storage).Transform()
+	})
+	if err != nil {
+		return err
+	}
+	switch node.(type) {
+	case *InsertNode, *UpdateNode, *DeleteNode:
+	default:
+		return execOperator(node, operator, handle)
+	}
+	txManager := storage.TransactionManager
+	implicit := !txManager.InTransaction
+	if implicit {
+		if err = CatchErr(txManager.Begin); err != nil {
+			return err
+		}
+	}
+	savepoint := txManager.Savepoint()
+	if err = execOperator(node, operator, handle); err != nil {
+		if implicit {
+			CatchErr(txManager.Rollback)
+		} else {
+			CatchErr(func() { txManager.RollbackTo(savepoint) })
+		}
+		return err
+	}
+	if implicit {
+		return CatchErr(txManager.Commit)
+	}
+	return nil
+}
+
+// 出错时也要关闭算子 关闭时的错误不覆盖执行时的错误
+func execOperator(node INode, operator IOperator, handle func(node INode, operator IOperator)) error {
+	err := CatchErr(func() {
+		operator.Open()
+		handle(node, operator)
+	})
+	if err2 := CatchErr(operator.Close); err == nil {
+		err = err2
+	}
+	return err
+}
@@ -0,0 +1,376 @@
+/*
+@author: sk
+@date: 2024/9/28
+*/
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// EXPLAIN 输出 Transformer 生成的算子树 每个算子一行 子算子缩进  表达式中的子查询也作为子节点输出
+// EXPLAIN ANALYZE 会真正执行语句(包括增删改)，每个算子外面包一层 AnalyzeOperator 统计输出行数，打开次数与耗时
+// 耗时包含子算子的耗时
+
+//======================ExplainOperator========================
+
+type ExplainOperator struct {
+	Input   IOperator
+	Analyze bool
+	Columns []*Column
+	Lines   []string
+	Idx     int
+	Seen    map[*SubQueryNode]struct{} // 同一个子查询可能被多个算子引用 只输出一次
+}
+
+func (e *ExplainOperator) GetColumns() []*Column {
+	return e.Columns
+}
+
+func (e *ExplainOperator) Open() {
+	e.Columns = []*Column{{Name: "plan", Type: TypTxt, Len: 8}}
+	e.Lines, e.Idx, e.Seen = nil, 0, make(map[*SubQueryNode]struct{})
+	if e.Analyze { // 先执行完整个计划再输出
+		e.Input = InstrumentOperator(e.Input)
+		e.Input.Open()
+		for e.Input.Next() != nil {
+		}
+		e.Input.Close()
+	}
+	e.Explain(e.Input, 0)
+	for _, line := range e.Lines { // 客户端按列长度展示
+		e.Columns[0].Len = max(e.Columns[0].Len, int64(len(line)))
+	}
+}
+
+func (e *ExplainOperator) Explain(op IOperator, depth int) {
+	stat := ""
+	if analyze, ok := op.(*AnalyzeOperator); ok {
+		stat = fmt.Sprintf("  (rows=%d loops=%d time=%.3fms)", analyze.Rows, analyze.Loops, float64(analyze.Time.Microseconds())/1000)
+		op = analyze.Input
+	}
+	e.Lines = append(e.Lines, e.Indent(depth)+DescribeOperator(op)+stat)
+	for _, input := range GetInputOperators(op) {
+		e.Explain(*input, depth+1)
+	}
+	for _, node := range GetSubQueries(op) {
+		if _, has := e.Seen[node]; has {
+			continue
+		}
+		e.Seen[node] = struct{}{}
+		line := "SubQuery " + node.Name
+		if len(node.Operator.Params) > 0 {
+			params := make([]string, 0)
+			for _, param := range node.Operator.Params {
+				params = append(params, param.Column.Name)
+			}
+			line += " params: " + strings.Join(params, ", ")
+		}
+		e.Lines = append(e.Lines, e.Indent(depth+1)+line)
+		e.Explain(node.Operator.Input, depth+2)
+	}
+}
+
+func (e *ExplainOperator) Indent(depth int) string {
+	if depth == 0 {
+		return ""
+	}
+	return strings.Repeat("   ", depth-1) + "-> "
+}
+
+func (e *ExplainOperator) Close() {
+}
+
+func (e *ExplainOperator) Next() []any {
+	if e.Idx < len(e.Lines) {
+		e.Idx++
+		return []any{e.Lines[e.Idx-1]}
+	}
+	return nil
+}
+
+func (e *ExplainOperator) Reset() {
+	e.Idx = 0
+}
+
+func NewExplainOperator(input IOperator, analyze bool) IOperator {
+	return &ExplainOperator{Input: input, Analyze: analyze}
+}
+
+//======================AnalyzeOperator========================
+
+type AnalyzeOperator struct {
+	*InputOperator
+	Rows  int64
+	Loops int64 // 打开与重置的次数 相关子查询，嵌套循环连接的内侧会执行多次
+	Time  time.Duration
+}
+
+func (a *AnalyzeOperator) Open() {
+	start := time.Now()
+	a.Input.Open()
+	a.Loops++
+	a.Time += time.Since(start)
+}
+
+func (a *AnalyzeOperator) Reset() {
+	start := time.Now()
+	a.Input.Reset()
+	a.Loops++
+	a.Time += time.Since(start)
+}
+
+func (a *AnalyzeOperator) Next() []any {
+	start := time.Now()
+	res := a.Input.Next()
+	if res != nil {
+		a.Rows++
+	}
+	a.Time += time.Since(start)
+	return res
+}
+
+func NewAnalyzeOperator(input IOperator) *AnalyzeOperator {
+	return &AnalyzeOperator{InputOperator: NewInputOperator(input)}
+}
+
+// 给每个算子(包括子查询的执行计划)包一层 AnalyzeOperator
+func InstrumentOperator(op IOperator) IOperator {
+	for _, input := range GetInputOperators(op) {
+		*input = InstrumentOperator(*input)
+	}
+	for _, node := range GetSubQueries(op) {
+		if _, ok := node.Operator.Input.(*AnalyzeOperator); !ok { // 可能被多个算子引用
+			node.Operator.Input = InstrumentOperator(node.Operator.Input)
+		}
+	}
+	return NewAnalyzeOperator(op)
+}
+
+// 子算子字段的地址 方便替换
+func GetInputOperators(op IOperator) []*IOperator {
+	switch target := op.(type) {
+	case *JoinOperator:
+		return []*IOperator{&target.Left, &target.Right}
+	case *HashJoinOperator:
+		return []*IOperator{&target.Left, &target.Right}
+	case *MergeJoinOperator:
+		return []*IOperator{&target.Left, &target.Right}
+	case *UnionOperator:
+		return []*IOperator{&target.Left, &target.Right}
+	case *IntersectOperator:
+		return []*IOperator{&target.Left, &target.Right}
+	case interface{ GetInputOperator() *InputOperator }: // 单输入的算子
+		return []*IOperator{&target.GetInputOperator().Input}
+	default:
+		return nil
+	}
+}
+
+// 算子表达式中的子查询
+func GetSubQueries(op IOperator) []*SubQueryNode {
+	nodes := make([]INode, 0)
+	switch target := op.(type) {
+	case *FilterOperator:
+		nodes = append(nodes, target.Expr)
+	case *JoinOperator:
+		nodes = append(nodes, target.Expr)
+	case *HashJoinOperator:
+		nodes = append(nodes, target.Expr)
+	case *MergeJoinOperator:
+		nodes = append(nodes, target.Expr)
+	case *FuncExecOperator:
+		nodes = append(nodes, target.Nodes...)
+	case *UpdateOperator:
+		for _, set := range target.Sets {
+			nodes = append(nodes, set.Value)
+		}
+	}
+	res := make([]*SubQueryNode, 0)
+	for _, node := range nodes {
+		res = append(res, FindSubQueries(node)...)
+	}
+	return res
+}
+
+// 不进入子查询内部 内部的子查询属于子查询的执行计划
+func FindSubQueries(node INode) []*SubQueryNode {
+	res := make([]*SubQueryNode, 0)
+	switch target := node.(type) {
+	case *ExprNode:
+		if target != nil {
+			res = append(FindSubQueries(target.Left), FindSubQueries(target.Right)...)
+		}
+	case *FuncNode:
+		for _, param := range target.Params {
+			res = append(res, FindSubQueries(param)...)
+		}
+	case *ListNode:
+		for _, item := range target.Items {
+			res = append(res, FindSubQueries(item)...)
+		}
+	case *SubQueryNode:
+		res = append(res, target)
+	}
+	return res
+}
+
+// 算子名称与关键信息 选择的索引与范围 连接条件 过滤条件 输出列等
+func DescribeOperator(op IOperator) string {
+	name := strings.TrimSuffix(strings.TrimPrefix(fmt.Sprintf("%T", op), "*main."), "Operator")
+	items := make([]string, 0)
+	switch target := op.(type) {
+	case *TableScanOperator:
+		items = append(items, target.Table)
+	case *AliasOperator:
+		items = append(items, target.Table+" AS "+target.Alias)
+	case *IndexScanOperator:
+		items = append(items, fmt.Sprintf("%s(%s)", target.Index, strings.Join(GetIndex(target.Index).Columns, ", ")))
+		if len(target.Ranges) > 0 {
+			ranges := make([]string, 0)
+			for _, rng := range target.Ranges {
+				ranges = append(ranges, rng.String())
+			}
+			items = append(items, "ranges: "+strings.Join(ranges, " "))
+		}
+	case *IndexLookupOperator:
+		items = append(items, target.Table)
+	case *JoinOperator:
+		name = "NestedLoopJoin"
+		items = append(items, target.Type)
+		if target.Expr != nil {
+			items = append(items, "on: "+GetNodeColumnName(target.Expr))
+		}
+	case *HashJoinOperator:
+		items = append(items, target.Type, "keys: "+FormatJoinKeys(target.LeftKeys, target.RightKeys))
+		if target.Expr != nil {
+			items = append(items, "on: "+GetNodeColumnName(target.Expr))
+		}
+		if target.BuildLeft {
+			items = append(items, "build: left")
+		} else {
+			items = append(items, "build: right")
+		}
+	case *MergeJoinOperator:
+		items = append(items, "keys: "+FormatJoinKeys([]string{target.LeftKey}, []string{target.RightKey}))
+		if target.Expr != nil {
+			items = append(items, "on: "+GetNodeColumnName(target.Expr))
+		}
+	case *ProjectionOperator:
+		fields := make([]string, 0)
+		for i, field := range target.SelectFields {
+			if target.Aliases[i] != "" {
+				field += " AS " + target.Aliases[i]
+			}
+			fields = append(fields, field)
+		}
+		items = append(items, "output: "+strings.Join(fields, ", "))
+	case *DistinctOperator:
+		items = append(items, "fields: "+strings.Join(target.DistinctFields, ", "))
+	case *UnionOperator:
+		if target.All {
+			items = append(items, ALL)
+		}
+		items = append(items, "output: "+FormatColumnNames(target.Columns))
+	case *IntersectOperator:
+		if target.Type == EXCEPT {
+			name = "Except"
+		}
+		if target.All {
+			items = append(items, ALL)
+		}
+		items = append(items, "output: "+FormatColumnNames(target.Columns))
+	case *FilterOperator:
+		items = append(items, "cond: "+GetNodeColumnName(target.Expr))
+	case *GroupOperator:
+		if len(target.GroupColumns) > 0 {
+			items = append(items, "by: "+strings.Join(target.GroupColumns, ", "))
+		}
+		funcs := make([]string, 0)
+		for _, item := range target.Funcs {
+			if GetFunc(item.FuncName).IsAggregate {
+				funcs = append(funcs, GetFuncColumnName(item))
+			}
+		}
+		items = append(items, "aggregates: "+strings.Join(DistinctSlice(funcs), ", "))
+		if target.Streaming {
+			items = append(items, "streaming")
+		}
+		if target.PartitionCount > 0 { // EXPLAIN ANALYZE 执行后才知道
+			items = append(items, fmt.Sprintf("partitions: %d", target.PartitionCount))
+		}
+	case *SortOperator:
+		orders := make([]string, 0)
+		for _, order := range target.Orders {
+			item := GetNodeColumnName(order.Field)
+			if order.Desc {
+				item += " " + DESC
+			}
+			orders = append(orders, item)
+		}
+		items = append(items, "by: "+strings.Join(orders, ", "))
+		if target.TopN > 0 {
+			items = append(items, fmt.Sprintf("top: %d", target.TopN))
+		}
+		if len(target.Runs) > 0 { // EXPLAIN ANALYZE 执行后才知道
+			items = append(items, fmt.Sprintf("runs: %d", len(target.Runs)))
+		}
+	case *LimitOperator:
+		items = append(items, fmt.Sprintf("%d offset %d", target.Limit, target.Offset))
+	case *FuncExecOperator:
+		exprs := make([]string, 0)
+		for _, node := range target.Nodes {
+			exprs = append(exprs, GetNodeColumnName(node))
+		}
+		if len(exprs) > 0 { // 打开后会过滤掉已经计算过的
+			items = append(items, "exprs: "+strings.Join(exprs, ", "))
+		}
+	case *ExpandImmOperator:
+		items = append(items, "columns: "+FormatColumnNames(target.ExpandColumns))
+	case *DerivedTableOperator:
+		items = append(items, target.Alias, "output: "+FormatColumnNames(target.Columns))
+	case *InsertOperator:
+		items = append(items, target.Table, fmt.Sprintf("rows: %d", len(target.Data)))
+	case *UpdateOperator:
+		sets := make([]string, 0)
+		for _, set := range target.Sets {
+			sets = append(sets, fmt.Sprintf("%s = %s", set.Field.Value, GetNodeColumnName(set.Value)))
+		}
+		items = append(items, target.Table, "set: "+strings.Join(sets, ", "))
+	case *DeleteOperator:
+		items = append(items, target.Table)
+	case *CreateTableOperator:
+		items = append(items, target.Table)
+	case *CreateIndexOperator:
+		items = append(items, fmt.Sprintf("%s ON %s(%s)", target.Index, target.Table, strings.Join(target.Columns, ", ")))
+	case *DropTableOperator:
+		items = append(items, target.Table)
+	case *DropIndexOperator:
+		items = append(items, target.Index)
+	case *TruncateTableOperator:
+		items = append(items, target.Table)
+	case *AlterTableOperator:
+		items = append(items, target.Table, target.Action, target.Name)
+	case *AnalyzeTableOperator:
+		items = append(items, target.Table)
+	}
+	return strings.TrimSpace(name + " " + strings.Join(items, " "))
+}
+
+func FormatJoinKeys(leftKeys []string, rightKeys []string) string {
+	keys := make([]string, 0)
+	for i, key := range leftKeys {
+		keys = append(keys, key+" = "+rightKeys[i])
+	}
+	return strings.Join(keys, ", ")
+}
+
+func FormatColumnNames(columns []*Column) string {
+	names := make([]string, 0)
+	for _, column := range columns {
+		names = append(names, column.Name)
+	}
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,314 @@
+/*
+@author: sk
+@date: 2024/10/15
+*/
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strings"
+)
+
+// 聚合分为 哈希聚合 流式聚合(输入已按分组列有序)
+// 每个分组只保存分组字段与累加器，不保存分组内的数据，分组 key 使用 EncodeRow 编码没有歧义
+// 哈希聚合内存中的分组超过上限后，新分组的行按 key 的哈希值写入分区文件，内存中的分组照常累加
+// 当前批次输出完后再逐个分区聚合，分区还是放不下就换个哈希种子继续分区
+// 流式聚合相同分组连续出现，key 变化时输出上一个分组，只需要保存当前分组
+
+const (
+	GroupBufferSize      = 4 * 1024 * 1024 // 哈希聚合默认的内存上限 可以通过 Config 修改
+	GroupPartitionCount  = 8               // 每次落盘分成的分区数
+	GroupMaxLevel        = 4               // 分区最多的层数 超过后不再落盘
+	GroupAccumulatorSize = 64              // 粗略估计一个累加器占用的内存
+)
+
+// 所有列都是 表名.列名 的形式 sql可以简写，会自动扩充 起别名的表为 别名.列名 * 也是这里替换的
+// 常量列实际就是与一个只有一行数据的临时表 join 笛卡尔积  会改变列的输出
+type GroupOperator struct { // 支持多列分组
+	*InputOperator
+	GroupColumns []string // 聚合的列  不能简单使用列名称，多表可能存在重复列名 可以统一规划为 表名.列名 长度可以为空
+	// SUM AVG MAX MIN COUNT 有 count 且不是聚合查询的语句需要进行改写为聚合语句 GroupColumns 可以为空 []string
+	// 这里是所有相关的函数，没有区分是否是聚合函数
+	Funcs        []*FuncNode // 聚合函数操作的其他列 例如 max(height)  group by age 聚合函数只能有一个入参且必须为 IDNode
+	Streaming    bool        // 输入已按分组列有序 使用流式聚合
+	MemLimit     int64       // 哈希聚合内存中分组占用的上限 超过后落盘
+	Columns      []*Column   // 输出列 分组列+聚合函数列
+	KeyIdx       []int       // 分组列在输入中的下标
+	KeyColumns   []*Column   // 分组列 计算 key 时按列类型转换
+	ParamIdx     []int       // 聚合函数对应输入的下标 COUNT(*) 为 -1
+	ParamColumns []*Column   // 聚合函数对应输入的列 COUNT(*) 为 nil
+	FuncNodes    []*FuncNode // 聚合函数节点 相同的聚合函数只计算一次
+	// 哈希聚合
+	Data           [][]any // 当前批次计算好的分组
+	DataIdx        int
+	Partitions     []*GroupPartition // 等待聚合的分区
+	PartitionCount int               // 一共落盘过的分区数 不为 0 时 Reset 需要重新计算
+	// 流式聚合
+	Group        []any // 当前分组的分组字段 为 nil 表示还没有分组
+	GroupKey     string
+	Accumulators []IAccumulator
+	End          bool // 输入已经读完
+}
+
+type GroupPartition struct { // 落盘的一个分区 保存的是输入的原始行
+	*SpillFile
+	Level int // 第几层分区 用作哈希种子
+}
+
+func (g *GroupOperator) GetColumns() []*Column {
+	return g.Columns
+}
+
+// 聚合函数的参数 只能是一个 IDNode 或 COUNT(*) 的 StarNode
+func GetAggregateParam(func0 *FuncNode) INode {
+	if len(func0.Params) != 1 {
+		panic(fmt.Sprintf("func0 must one parameter"))
+	}
+	switch param := func0.Params[0].(type) {
+	case *IDNode:
+		return param
+	case *StarNode:
+		if strings.ToUpper(func0.FuncName) != "COUNT" || func0.Distinct {
+			panic(fmt.Sprintf("func %s not support *", func0.FuncName))
+		}
+		return param
+	default:
+		panic(fmt.Sprintf("func %s parameter must be column", func0.FuncName))
+	}
+}
+
+func (g *GroupOperator) Open() {
+	g.InputOperator.Open()
+	g.KeyIdx, g.KeyColumns, g.ParamIdx, g.ParamColumns, g.FuncNodes = nil, nil, nil, nil, nil
+	names := make(map[string]struct{})
+	for _, item := range g.Funcs {
+		func0 := GetFunc(item.FuncName)
+		name := GetFuncColumnName(item)
+		if _, has := names[name]; func0.IsAggregate && !has {
+			names[name] = struct{}{}
+			g.FuncNodes = append(g.FuncNodes, item)
+		}
+	}
+	// 先组装列信息
+	g.Columns = nil
+	columns := g.Input.GetColumns()
+	columnMap := make(map[string]*Column)
+	idxMap := make(map[string]int)
+	for i, column := range columns {
+		columnMap[column.Name] = column
+		idxMap[column.Name] = i
+	}
+	for _, field := range g.GroupColumns {
+		if column, ok := columnMap[field]; ok {
+			g.Columns = append(g.Columns, column)
+			g.KeyIdx = append(g.KeyIdx, idxMap[field])
+			g.KeyColumns = append(g.KeyColumns, column)
+		} else {
+			panic(&NotFoundError{Kind: "column", Name: field})
+		}
+	}
+	for _, funcNode := range g.FuncNodes {
+		var column *Column
+		idx := -1
+		if node, ok := GetAggregateParam(funcNode).(*IDNode); ok {
+			if column, ok = columnMap[node.Value]; !ok {
+				panic(&NotFoundError{Kind: "column", Name: node.Value})
+			}
+			idx = idxMap[node.Value]
+		}
+		func0 := GetFunc(funcNode.FuncName)
+		typ, l := func0.AggregateRetType(column) // 获取对应类型与长度
+		g.Columns = append(g.Columns, &Column{
+			Name: GetFuncColumnName(funcNode), // 列名需要拼接函数名
+			Type: typ,
+			Len:  l,
+		})
+		g.ParamIdx = append(g.ParamIdx, idx)
+		g.ParamColumns = append(g.ParamColumns, column)
+	}
+	g.start()
+}
+
+// 开始聚合 哈希聚合直接计算第一批分组 流式聚合在 Next 中边读边算
+func (g *GroupOperator) start() {
+	g.removePartitions()
+	g.PartitionCount = 0
+	g.Group, g.Accumulators, g.End = nil, nil, false
+	if !g.Streaming {
+		g.aggregate(g.Input.Next, 0)
+	}
+}
+
+// 哈希聚合 next 为输入 分组按第一次出现的顺序输出(落盘的分组在后面输出)
+func (g *GroupOperator) aggregate(next func() []any, level int) {
+	g.Data, g.DataIdx = make([][]any, 0), 0
+	groupMap := make(map[string]int) // 分组 key -> 分组下标
+	accumulators := make([][]IAccumulator, 0)
+	parts := make([]*SpillFile, 0)
+	size := int64(0)
+	for {
+		data := next()
+		if data == nil {
+			break
+		}
+		key := g.genKey(data)
+		idx, ok := groupMap[key]
+		if !ok && (len(parts) > 0 || (size > g.MemLimit && level < GroupMaxLevel)) {
+			if len(parts) == 0 {
+				for i := 0; i < GroupPartitionCount; i++ {
+					parts = append(parts, NewSpillFile("group"))
+				}
+			}
+			parts[HashGroupKey(key, level)%GroupPartitionCount].Write(data)
+			continue
+		}
+		if !ok {
+			group, items := g.newGroup(data)
+			g.Data = append(g.Data, group)
+			accumulators = append(accumulators, items)
+			idx = len(g.Data) - 1
+			groupMap[key] = idx
+			size += int64(len(key)) + RowSize(group) + int64(GroupAccumulatorSize*len(items))
+		}
+		g.addRow(accumulators[idx], data)
+	}
+	if len(g.Data) == 0 && len(g.KeyIdx) == 0 { // 没有分组字段时 即使没有数据也要输出一行
+		group, items := g.newGroup(nil)
+		g.Data = append(g.Data, group)
+		accumulators = append(accumulators, items)
+	}
+	for i, items := range accumulators { // 组装函数数据
+		g.Data[i] = g.finishGroup(g.Data[i], items)
+	}
+	for _, part := range parts {
+		g.Partitions = append(g.Partitions, &GroupPartition{SpillFile: part, Level: level + 1})
+	}
+	g.PartitionCount += len(parts)
+}
+
+// 分组字段都是一样的 直接用第一条数据的
+func (g *GroupOperator) newGroup(data []any) ([]any, []IAccumulator) {
+	res := make([]any, 0)
+	for _, idx := range g.KeyIdx {
+		res = append(res, data[idx])
+	}
+	items := make([]IAccumulator, 0)
+	for i, funcNode := range g.FuncNodes {
+		accumulator := GetFunc(funcNode.FuncName).Accumulator(g.ParamColumns[i])
+		if funcNode.Distinct {
+			accumulator = NewDistinctAccumulator(accumulator)
+		}
+		items = append(items, accumulator)
+	}
+	return res, items
+}
+
+func (g *GroupOperator) addRow(items []IAccumulator, data []any) {
+	for i, accumulator := range items {
+		val := &Value{Type: TypBool, Data: true} // COUNT(*) 每行都计数
+		if g.ParamIdx[i] >= 0 {
+			val = &Value{Type: g.ParamColumns[i].Type, Data: data[g.ParamIdx[i]]}
+		}
+		accumulator.Add(val)
+	}
+}
+
+func (g *GroupOperator) finishGroup(group []any, items []IAccumulator) []any {
+	for _, accumulator := range items {
+		group = append(group, accumulator.Result())
+	}
+	return group
+}
+
+// 分组 key 按列类型转换后编码 计算列中整数与浮点数混用时也能分到同一组 NULL 视为相等
+func (g *GroupOperator) genKey(data []any) string {
+	res := make([]any, 0, len(g.KeyIdx))
+	for _, idx := range g.KeyIdx {
+		res = append(res, data[idx])
+	}
+	return string(EncodeRow(CastSetRow(res, g.KeyColumns)))
+}
+
+// 每层分区使用不同的种子 上一层落到同一分区的 key 这一层可以分开
+func HashGroupKey(key string, level int) uint32 {
+	hash := fnv.New32a()
+	hash.Write([]byte{byte(level)})
+	hash.Write([]byte(key))
+	return hash.Sum32()
+}
+
+// 流式聚合 key 变化时输出上一个分组，并用当前行开始新的分组
+func (g *GroupOperator) nextStreaming() []any {
+	for !g.End {
+		data := g.Input.Next()
+		if data == nil {
+			g.End = true
+			break
+		}
+		key := g.genKey(data)
+		var res []any
+		if g.Group != nil && key != g.GroupKey {
+			res = g.finishGroup(g.Group, g.Accumulators)
+			g.Group = nil
+		}
+		if g.Group == nil {
+			g.Group, g.Accumulators = g.newGroup(data)
+			g.GroupKey = key
+		}
+		g.addRow(g.Accumulators, data)
+		if res != nil {
+			return res
+		}
+	}
+	if g.Group == nil {
+		return nil
+	}
+	res := g.finishGroup(g.Group, g.Accumulators)
+	g.Group, g.Accumulators = nil, nil
+	return res
+}
+
+func (g *GroupOperator) removePartitions() {
+	for _, part := range g.Partitions {
+		part.Remove()
+	}
+	g.Partitions = nil
+}
+
+func (g *GroupOperator) Reset() {
+	g.InputOperator.Reset()
+	if g.Streaming || g.PartitionCount > 0 { // 分区已经读完删除了 需要重新计算
+		g.start()
+	} else {
+		g.DataIdx = 0
+	}
+}
+
+func (g *GroupOperator) Close() {
+	g.InputOperator.Close()
+	g.removePartitions()
+	g.Data = nil
+}
+
+func (g *GroupOperator) Next() []any {
+	if g.Streaming {
+		return g.nextStreaming()
+	}
+	for g.DataIdx >= len(g.Data) { // 当前批次输出完了 聚合下一个分区
+		if len(g.Partitions) == 0 {
+			return nil
+		}
+		part := g.Partitions[0]
+		g.Partitions = g.Partitions[1:]
+		part.Rewind()
+		g.aggregate(part.Read, part.Level)
+		part.Remove()
+	}
+	g.DataIdx++
+	return g.Data[g.DataIdx-1]
+}
+
+func NewGroupOperator(input IOperator, groupColumns []string, funcs []*FuncNode) IOperator {
+	return &GroupOperator{InputOperator: NewInputOperator(input), GroupColumns: groupColumns, Funcs: funcs, MemLimit: GroupBufferSize}
+}
@@ -9,6 +9,7 @@ import (
 	"fmt"
 	"math/rand"
 	"os"
+	"os/signal"
 	"strings"
 )
 
@@ -76,7 +77,28 @@ func main() {
 	//TestDefer()
 
 	//TestCmd()
-	TestDriver()
+	//TestDriver()
+	TestServer()
+}
+
+func TestServer() {
+	// mysql -h 127.0.0.1 -P 3307 -u root -p12345678  也可以使用 Driver 连接
+	LoadCatalog()
+	defer SaveCatalog()
+	storage := NewStorage()
+	defer storage.Close()
+	txManager := NewTransactionManager(storage)
+	storage.TransactionManager = txManager
+
+	server := NewServer("127.0.0.1:3307", "root", "12345678", storage)
+	go func() { // Ctrl + C 关闭监听，保证 defer 能执行
+		ch := make(chan os.Signal, 1)
+		signal.Notify(ch, os.Interrupt)
+		<-ch
+		server.Close()
+	}()
+	fmt.Println("> listen on " + server.Addr)
+	server.Listen()
 }
 
 func TestDriver() {
@@ -90,7 +112,7 @@ func TestDriver() {
 }
 
 func TestCmd() {
-	/*  暂时不支持起别名
+	/*  支持的 sql
 	select id,height from users
 	select id,height,test(test(id)) from users limit 2
 	select * from users where id > 20 AND id < 30
@@ -127,25 +149,21 @@ func TestCmd() {
 
 		switch strings.ToUpper(text) { // 对于输入内容需要先过指令，不满足任何指令才进行sql解析执行
 		case CmdBegin:
-			txManager.Begin()
+			err = CatchErr(txManager.Begin)
 		case CmdCommit:
-			txManager.Commit()
+			err = CatchErr(txManager.Commit)
 		case CmdRollback:
-			txManager.Rollback()
+			err = CatchErr(txManager.Rollback)
 		case CmdExit:
 			fmt.Println("bye")
 			return
 		default:
-			scanner := NewScanner(text)
-			tokens := scanner.ScanTokens()
-			parser := NewParser(tokens)
-			node := parser.ParseTokens()
-			transformer := NewTransformer(node, storage)
-			operator := transformer.Transform()
-
-			operator.Open()
-			PrintTable(operator)
-			operator.Close()
+			err = ExecSql(storage, text, func(node INode, operator IOperator) {
+				PrintTable(operator)
+			})
+		}
+		if err != nil { // 出错只打印错误 继续接收下一条语句
+			fmt.Println("> error: " + err.Error())
 		}
 	}
 }
@@ -171,7 +189,7 @@ func TestCombination() {
 	txManager := NewTransactionManager(storage)
 	storage.TransactionManager = txManager
 
-	/*  暂时不支持起别名
+	/*  支持的 sql
 	select id,height from users
 	select * from users where id > 20 AND id < 30
 	select id,name from users where id > 20 order by id desc
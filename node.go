@@ -16,24 +16,40 @@ type IDNode struct {
 type StarNode struct { // *
 }
 
-type ImmNode struct { // '你好'  2332  22.33 等字面量
+type ImmNode struct { // '你好'  2332  22.33  NULL 等字面量
 	Value string
 	Type  string
 }
 
 type FuncNode struct {
 	FuncName string
-	Params   []INode // 可以是 IDNode ImmNode FuncNode 聚合函数只支持 IDNode
+	Params   []INode // 可以是 IDNode ImmNode FuncNode 聚合函数只支持 IDNode  COUNT(*) 为 StarNode
+	Distinct bool    // 聚合函数只对不同的值计算 例如 COUNT(DISTINCT id)
 }
 
-type ExprNode struct { // 只支持一些简单的 二元条件
-	Left     INode // 可以是  IDNode  ImmNode  FuncNode  ExprNode
-	Right    INode
-	Operator string // 只能是一些关键字
+type ExprNode struct { // 比较 逻辑 算术 字符串拼接 IS NULL 的右边固定为 NULL 字面量
+	Left     INode  // 可以是  IDNode  ImmNode  FuncNode  ExprNode  SubQueryNode
+	Right    INode  // NOT EXISTS 只有 Left  负号转换为 0 - Right  IN LIKE 的右边可以是 ListNode  IN 的右边可以是 SubQueryNode
+	Operator string // 操作符的 token 类型
+}
+
+type ListNode struct { // IN 的值列表 (1,2,3)  带 ESCAPE 的 LIKE 为 (模式,转义字符)
+	Items []INode
+}
+
+type SubQueryNode struct { // 表达式中的子查询 (select ...) 标量子查询只能返回一列最多一行
+	Select   INode             // SelectNode 或 SetOpNode
+	Name     string            // 作为计算列时的列名 转换时按顺序生成
+	Operator *SubQueryOperator // 转换后的执行计划
+}
+
+type ParamNode struct { // 相关子查询中引用的外层列 执行子查询前使用外层当前行的值绑定
+	Column *Column // 外层的列
+	Value  *Value
 }
 
 type OrderNode struct {
-	Field *IDNode
+	Field INode // 可以是 IDNode FuncNode ExprNode
 	Desc  bool
 }
 
@@ -43,24 +59,40 @@ type LimitNode struct {
 }
 
 type JoinNode struct {
+	Type      string // INNER LEFT RIGHT FULL
 	Table     string
+	SubQuery  INode     // 连接子查询(派生表) 此时 Table 为空 必须有别名
+	Alias     string    // 表的别名 可以为空
 	Condition *ExprNode // 必须有 on 必须有条件
 }
 
 type SelectNode struct {
-	Fields   []INode   // 可以是 IDNode  StarNode  FuncNode  ImmNode
-	Distinct []*IDNode // 只支持字段名称
-	From     string    // 仅支持表名
-	Join     *JoinNode // 关联查询
-	Where    *ExprNode // 条件
-	Groups   []*IDNode // 仅支持字段名称 相关聚合函数在字段中
+	Fields   []INode          // 可以是 IDNode  StarNode  FuncNode  ImmNode  ExprNode
+	Distinct []*IDNode        // 只支持字段名称
+	From     string           // 表名
+	SubQuery INode            // from 子查询(派生表) 此时 From 为空 必须有别名
+	Alias    string           // From 表的别名 可以为空
+	Aliases  map[INode]string // 字段的别名 字段节点 -> 别名
+	Joins    []*JoinNode      // 关联查询 按顺序依次与前面的结果连接
+	Where    *ExprNode        // 条件
+	Groups   []*IDNode        // 仅支持字段名称 相关聚合函数在字段中
+	Having   *ExprNode        // 分组后的条件 可以使用聚合函数
 	Orders   []*OrderNode
 	Limit    *LimitNode
 }
 
+type SetOpNode struct { // 复合查询 INTERSECT 优先级高于 UNION EXCEPT  同级从左到右结合
+	Left     INode        // SelectNode 或 SetOpNode 列数与类型必须兼容 结果使用左侧的列名
+	Right    INode        // 同上
+	Operator string       // UNION INTERSECT EXCEPT
+	All      bool         // 保留重复行
+	Orders   []*OrderNode // 作用于整个复合查询的结果 只能使用结果列
+	Limit    *LimitNode
+}
+
 type SetNode struct {
 	Field *IDNode
-	Value INode // 可以是 IDNode ImmNode FuncNode
+	Value INode // 可以是 IDNode ImmNode FuncNode ExprNode
 }
 
 type UpdateNode struct {
@@ -80,9 +112,10 @@ type DeleteNode struct {
 }
 
 type ColumnNode struct {
-	Name *IDNode
-	Type string
-	Len  int64
+	Name    *IDNode
+	Type    string
+	Len     int64
+	NotNull bool
 }
 
 type CreateTableNode struct { // 创建表结构节点
@@ -94,4 +127,37 @@ type CreateIndexNode struct { // 创建索引节点
 	Index   string
 	Table   string
 	Columns []*IDNode
+	Unique  bool
+}
+
+type DropTableNode struct { // 删除表结构节点 会同时删除其所有索引
+	Table    string
+	IfExists bool
+}
+
+type DropIndexNode struct { // 删除索引节点
+	Index string
+	Table string
+}
+
+type AlterTableNode struct { // 修改表结构节点 一次只支持一个操作
+	Table   string
+	Action  string      // ADD DROP RENAME MODIFY
+	Column  *ColumnNode // ADD MODIFY 使用 新的列定义
+	Name    *IDNode     // DROP RENAME 使用 原来的列名
+	NewName *IDNode     // RENAME 使用
+	Default *Value      // ADD 使用 存量数据的填充值，可以为空
+}
+
+type TruncateTableNode struct { // 清空表数据节点
+	Table string
+}
+
+type AnalyzeTableNode struct { // 收集表的统计信息
+	Table string
+}
+
+type ExplainNode struct { // EXPLAIN [ANALYZE] 语句
+	Stmt    INode
+	Analyze bool // 真正执行并统计每个算子的输出行数与耗时
 }
@@ -6,10 +6,11 @@ package main
 
 import (
 	"fmt"
-	"sort"
+	"strings"
+	"unicode"
 )
 
-// 把各种查询，等操作转换为算子，流式处理  物理执行计划组装用的算子，这里暂时忽略逻辑执行计划
+// 把各种查询，等操作转换为算子，流式处理  物理执行计划组装用的算子，逻辑执行计划见 plan.go
 
 type IOperator interface {
 	Open()                 // 初始化
@@ -43,6 +44,11 @@ func (i *InputOperator) Reset() {
 	i.Input.Reset()
 }
 
+// EXPLAIN 使用 获取与替换单输入算子的输入
+func (i *InputOperator) GetInputOperator() *InputOperator {
+	return i
+}
+
 func NewInputOperator(input IOperator) *InputOperator {
 	return &InputOperator{Input: input}
 }
@@ -91,6 +97,7 @@ type TableScanOperator struct { // 只有输出，没有输入的流
 	Storage *Storage
 	Table   string
 	Offset  int64
+	End     int64 // 打开时表的大小，只扫描这之前的数据
 	Columns []*Column
 }
 
@@ -100,9 +107,12 @@ func (t *TableScanOperator) GetColumns() []*Column {
 
 func (t *TableScanOperator) Reset() {
 	t.Offset = 0
+	t.End = t.Storage.TableSize(t.Table)
 }
 
 func (t *TableScanOperator) Open() {
+	t.Offset = 0 // 相关子查询会重复打开
+	t.End = t.Storage.TableSize(t.Table)
 	table := GetTable(t.Table)
 	t.Columns = append(table.Columns, &Column{
 		Name: "offset",
@@ -117,7 +127,7 @@ func (t *TableScanOperator) Close() {
 func (t *TableScanOperator) Next() []any {
 	var res []any
 	var currOffset int64
-	res, currOffset, t.Offset = t.Storage.NextData(t.Table, t.Offset)
+	res, currOffset, t.Offset = t.Storage.NextData(t.Table, t.Offset, t.End)
 	if res == nil {
 		return nil
 	}
@@ -128,14 +138,52 @@ func NewTableScanOperator(storage *Storage, table string) IOperator {
 	return &TableScanOperator{Storage: storage, Table: table, Offset: 0}
 }
 
+//=====================AliasOperator============================
+
+// 表起了别名 把输出列的 表名.列名 替换为 别名.列名  自连接时必须起别名
+type AliasOperator struct {
+	*InputOperator
+	Table, Alias string
+	Columns      []*Column
+}
+
+func (a *AliasOperator) GetColumns() []*Column {
+	return a.Columns
+}
+
+func (a *AliasOperator) Open() {
+	a.InputOperator.Open()
+	a.Columns = make([]*Column, 0)
+	for _, column := range a.Input.GetColumns() {
+		temp := *column
+		temp.Name = RenameColumn(column.Name, a.Table, a.Alias)
+		a.Columns = append(a.Columns, &temp)
+	}
+}
+
+func NewAliasOperator(input IOperator, table string, alias string) IOperator {
+	return &AliasOperator{InputOperator: NewInputOperator(input), Table: table, Alias: alias}
+}
+
+// 把 from.列名 替换为 to.列名 其他的不变
+func RenameColumn(name string, from string, to string) string {
+	if strings.HasPrefix(name, from+".") {
+		return to + name[len(from):]
+	}
+	return name
+}
+
 //=====================IndexScanOperator============================
 
 type IndexScanOperator struct {
-	Storage *Storage
-	Index   string
-	Node    *BTreeNode
-	NodeIdx int
-	Columns []*Column
+	Storage  *Storage
+	Index    string
+	Ranges   []*IndexRange // 为空扫描全部索引 多个范围(IN)需要有序且不重叠，按顺序扫描
+	RangeIdx int
+	Node     *BTreeNode
+	NodeIdx  int
+	End      bool // 扫描完了，防止重新开始
+	Columns  []*Column
 }
 
 func (i *IndexScanOperator) GetColumns() []*Column {
@@ -145,9 +193,12 @@ func (i *IndexScanOperator) GetColumns() []*Column {
 func (i *IndexScanOperator) Reset() {
 	i.Node = nil
 	i.NodeIdx = 0
+	i.RangeIdx = 0
+	i.End = false
 }
 
 func (i *IndexScanOperator) Open() {
+	i.Reset()
 	index := GetIndex(i.Index)
 	table := GetTable(index.TableName)
 	i.Columns = PickColumn(index.Columns, table.Columns)
@@ -162,23 +213,76 @@ func (i *IndexScanOperator) Close() {
 }
 
 func (i *IndexScanOperator) Next() []any {
-	var res []any
-	res, i.Node, i.NodeIdx = i.Storage.NextIndex(i.Index, i.Node, i.NodeIdx)
-	return res
+	for !i.End {
+		var rng *IndexRange
+		if len(i.Ranges) > 0 {
+			rng = i.Ranges[i.RangeIdx]
+		}
+		var res []any
+		res, i.Node, i.NodeIdx = i.Storage.NextIndex(i.Index, rng, i.Node, i.NodeIdx)
+		if res != nil {
+			return res
+		}
+		i.RangeIdx++ // 当前范围扫描完了 开始下一个范围
+		i.End = i.RangeIdx >= len(i.Ranges)
+	}
+	return nil
+}
+
+func NewIndexScanOperator(storage *Storage, index string, ranges []*IndexRange) IOperator {
+	return &IndexScanOperator{Storage: storage, Index: index, Ranges: ranges, Node: nil, NodeIdx: 0}
+}
+
+//=====================IndexLookupOperator============================
+
+// 索引不能覆盖需要的列时，根据索引中的偏移回表查询完整数据 输出与 TableScanOperator 一致
+type IndexLookupOperator struct {
+	*InputOperator // 必须是 IndexScanOperator
+	Storage        *Storage
+	Table          string
+	Columns        []*Column
 }
 
-func NewIndexScanOperator(storage *Storage, index string) IOperator {
-	return &IndexScanOperator{Storage: storage, Index: index, Node: nil, NodeIdx: 0}
+func (i *IndexLookupOperator) GetColumns() []*Column {
+	return i.Columns
+}
+
+func (i *IndexLookupOperator) Open() {
+	i.InputOperator.Open()
+	table := GetTable(i.Table)
+	i.Columns = append(CloneSlice(table.Columns), &Column{
+		Name: "offset",
+		Type: TypInt,
+		Len:  8,
+	})
+}
+
+func (i *IndexLookupOperator) Next() []any {
+	res := i.Input.Next()
+	if res == nil {
+		return nil
+	}
+	offset := res[len(res)-1].(int64) // 最后一个是数据偏移
+	return append(i.Storage.SelectData(i.Table, offset), offset)
+}
+
+func NewIndexLookupOperator(input IOperator, storage *Storage, table string) IOperator {
+	return &IndexLookupOperator{InputOperator: NewInputOperator(input), Storage: storage, Table: table}
 }
 
 //=======================JoinOperator===========================
 
 // 有双层循环连接 与 hash连接(需要先构建hash表且需要落盘) 这里使用双层循环连接
-type JoinOperator struct { // 只支持 内连接 (笛卡尔积就是没有条件的内链接)
-	Left, Right IOperator // 只支持两个
-	LeftData    []any
-	Columns     []*Column
-	Expr        *ExprNode // 连接条件 可以为空，就是没有链接条件
+type JoinOperator struct { // 嵌套循环连接 支持内连接与外连接 (笛卡尔积就是没有条件的内链接)
+	Left, Right  IOperator // 只支持两个
+	Type         string    // INNER LEFT RIGHT FULL
+	LeftData     []any
+	LeftMatched  bool // 当前左侧数据是否匹配过
+	RightIdx     int
+	RightMatched []bool // 右侧每行是否匹配过，右侧每次重置后顺序是一致的
+	RightEnd     bool   // 右侧没有匹配的数据已经输出完毕
+	Columns      []*Column
+	Expr         *ExprNode // 连接条件 可以为空，就是没有链接条件
 }
 
 func (j *JoinOperator) GetColumns() []*Column {
@@ -189,13 +293,15 @@ func (j *JoinOperator) Reset() {
 	j.Left.Reset()
 	j.Right.Reset()
 	j.LeftData = j.Left.Next()
+	j.LeftMatched, j.RightIdx, j.RightMatched, j.RightEnd = false, 0, nil, false
 }
 
 func (j *JoinOperator) Open() {
 	j.Left.Open() // 子表全部打开
 	j.Right.Open()
 	j.LeftData = j.Left.Next()
-	j.Columns = append(j.Left.GetColumns(), j.Right.GetColumns()...)
+	j.LeftMatched, j.RightIdx, j.RightMatched, j.RightEnd = false, 0, nil, false
+	j.Columns = append(CloneSlice(j.Left.GetColumns()), j.Right.GetColumns()...)
 }
 
 func (j *JoinOperator) Close() {
@@ -204,25 +310,332 @@ func (j *JoinOperator) Close() {
 }
 
 func (j *JoinOperator) Next() []any {
-	for {
-		if j.LeftData == nil {
-			return nil
-		}
+	for j.LeftData != nil {
 		rightData := j.Right.Next()
-		if rightData == nil {
-			j.LeftData = j.Left.Next()
+		if rightData == nil { // 左侧没有匹配过的数据 LEFT FULL 需要补 NULL 输出
+			var res []any
+			if !j.LeftMatched && (j.Type == LEFT || j.Type == FULL) {
+				res = append(CloneSlice(j.LeftData), make([]any, len(j.Right.GetColumns()))...)
+			}
+			j.LeftData, j.LeftMatched, j.RightIdx = j.Left.Next(), false, 0
 			j.Right.Reset()
+			if res != nil {
+				return res
+			}
 			continue
 		}
-		res := append(j.LeftData, rightData...)
+		idx := j.RightIdx
+		j.RightIdx++
+		if idx >= len(j.RightMatched) {
+			j.RightMatched = append(j.RightMatched, false)
+		}
+		res := append(CloneSlice(j.LeftData), rightData...) // 需要复制，防止复用 LeftData 的底层数组
 		if j.Expr == nil || CalculateExpr(j.Expr, j.Columns, res) {
+			j.LeftMatched, j.RightMatched[idx] = true, true
 			return res
 		}
 	}
+	if j.RightEnd || (j.Type != RIGHT && j.Type != FULL) {
+		return nil
+	}
+	for { // 左侧遍历完了 RIGHT FULL 再遍历一次右侧输出没有匹配过的数据
+		rightData := j.Right.Next()
+		if rightData == nil {
+			j.RightEnd = true
+			return nil
+		}
+		idx := j.RightIdx
+		j.RightIdx++
+		if idx >= len(j.RightMatched) || !j.RightMatched[idx] {
+			return append(make([]any, len(j.Left.GetColumns())), rightData...)
+		}
+	}
+}
+
+func NewJoinOperator(left IOperator, right IOperator, type0 string, expr *ExprNode) IOperator {
+	return &JoinOperator{Left: left, Right: right, Type: type0, Expr: expr}
+}
+
+// 获取连接 key 存在 NULL 的返回 false  NULL 不与任何值相等
+func GenJoinKey(data []any, idx []int) (string, bool) {
+	buff := &strings.Builder{}
+	for _, i := range idx {
+		if data[i] == nil {
+			return "", false
+		}
+		buff.WriteString(fmt.Sprintf("%v#", data[i]))
+	}
+	return buff.String(), true
 }
 
-func NewJoinOperator(left IOperator, right IOperator, expr *ExprNode) IOperator {
-	return &JoinOperator{Left: left, Right: right, Expr: expr}
+// 获取整行的 key  NULL 视为相等  用于去重与集合运算
+func GenRowKey(data []any) string {
+	buff := &strings.Builder{}
+	for _, item := range data {
+		buff.WriteString(fmt.Sprintf("%v#", item))
+	}
+	return buff.String()
+}
+
+func GetColumnIdx(columns []*Column, names []string) []int {
+	idxMap := make(map[string]int)
+	for i, column := range columns {
+		idxMap[column.Name] = i
+	}
+	res := make([]int, 0)
+	for _, name := range names {
+		if idx, ok := idxMap[name]; ok {
+			res = append(res, idx)
+		} else {
+			panic(&NotFoundError{Kind: "column", Name: name})
+		}
+	}
+	return res
+}
+
+//=======================HashJoinOperator===========================
+
+// 等值连接 先把一侧全部读入内存构建 hash 表，再逐行读取另一侧探测  只读取一次右表
+// 外连接时探测侧没有匹配的直接补 NULL 输出，构建侧没有匹配的在探测结束后统一补 NULL 输出
+type HashJoinOperator struct {
+	Left, Right         IOperator
+	Type                string    // INNER LEFT RIGHT FULL SEMI ANTI
+	LeftKeys, RightKeys []string  // 等值连接的列，一一对应
+	Expr                *ExprNode // 完整的连接条件，hash 匹配后还需要再校验
+	BuildLeft           bool      // 使用左侧构建 hash 表，应该选择数据少的一侧
+	Columns             []*Column
+	BuildRows           [][]any
+	BuildMatched        []bool
+	HashTable           map[string][]int // 连接 key -> BuildRows 下标
+	ProbeIdx            []int
+	ProbeData           []any
+	ProbeMatched        bool
+	ProbeEnd            bool  // 探测侧已经读取完毕
+	Matches             []int // 当前探测行匹配到的数据
+	MatchIdx            int
+	BuildIdx            int // 输出构建侧没有匹配的数据时使用
+}
+
+func (h *HashJoinOperator) GetColumns() []*Column {
+	if h.IsSemi() { // 半连接与反连接只输出左侧
+		return h.Left.GetColumns()
+	}
+	return h.Columns
+}
+
+func (h *HashJoinOperator) Open() {
+	h.Left.Open()
+	h.Right.Open()
+	h.Columns = append(CloneSlice(h.Left.GetColumns()), h.Right.GetColumns()...)
+	buildKeys, probeKeys := h.RightKeys, h.LeftKeys
+	if h.BuildLeft {
+		buildKeys, probeKeys = h.LeftKeys, h.RightKeys
+	}
+	build := h.GetBuild()
+	buildIdx := GetColumnIdx(build.GetColumns(), buildKeys)
+	h.ProbeIdx = GetColumnIdx(h.GetProbe().GetColumns(), probeKeys)
+	h.BuildRows, h.HashTable = make([][]any, 0), make(map[string][]int)
+	for {
+		data := build.Next()
+		if data == nil {
+			break
+		}
+		if key, ok := GenJoinKey(data, buildIdx); ok {
+			h.HashTable[key] = append(h.HashTable[key], len(h.BuildRows))
+		}
+		h.BuildRows = append(h.BuildRows, data) // 外连接时 key 为 NULL 的也需要输出
+	}
+	h.BuildMatched = make([]bool, len(h.BuildRows))
+	h.ProbeData, h.ProbeEnd, h.Matches, h.MatchIdx, h.BuildIdx = nil, false, nil, 0, 0
+}
+
+func (h *HashJoinOperator) GetBuild() IOperator {
+	if h.BuildLeft {
+		return h.Left
+	}
+	return h.Right
+}
+
+func (h *HashJoinOperator) GetProbe() IOperator {
+	if h.BuildLeft {
+		return h.Right
+	}
+	return h.Left
+}
+
+func (h *HashJoinOperator) Close() {
+	h.Left.Close()
+	h.Right.Close()
+	h.BuildRows, h.BuildMatched, h.HashTable = nil, nil, nil
+}
+
+// 半连接 左侧有匹配的输出一次  反连接 左侧没有匹配的输出  都只输出左侧，使用右侧构建
+func (h *HashJoinOperator) IsSemi() bool {
+	return h.Type == SEMI || h.Type == ANTI
+}
+
+// 外连接时 构建侧/探测侧 没有匹配的数据是否需要输出
+func (h *HashJoinOperator) IsOuter(left bool) bool {
+	if left {
+		return h.Type == LEFT || h.Type == FULL
+	}
+	return h.Type == RIGHT || h.Type == FULL
+}
+
+// 输出始终是 左+右 为 nil 的一侧补 NULL
+func (h *HashJoinOperator) JoinData(buildData []any, probeData []any) []any {
+	if buildData == nil {
+		buildData = make([]any, len(h.GetBuild().GetColumns()))
+	}
+	if probeData == nil {
+		probeData = make([]any, len(h.GetProbe().GetColumns()))
+	}
+	if h.BuildLeft {
+		return append(CloneSlice(buildData), probeData...)
+	}
+	return append(CloneSlice(probeData), buildData...)
+}
+
+func (h *HashJoinOperator) Next() []any {
+	for !h.ProbeEnd {
+		if h.MatchIdx < len(h.Matches) {
+			idx := h.Matches[h.MatchIdx]
+			h.MatchIdx++
+			res := h.JoinData(h.BuildRows[idx], h.ProbeData)
+			if h.Expr == nil || CalculateExpr(h.Expr, h.Columns, res) {
+				h.ProbeMatched, h.BuildMatched[idx] = true, true
+				if !h.IsSemi() {
+					return res
+				}
+				h.MatchIdx = len(h.Matches) // 只需要知道有没有匹配
+				if h.Type == SEMI {
+					return CloneSlice(h.ProbeData)
+				}
+			}
+			continue
+		}
+		if h.ProbeData != nil && !h.ProbeMatched && h.Type == ANTI {
+			h.ProbeMatched = true
+			return CloneSlice(h.ProbeData)
+		}
+		if h.ProbeData != nil && !h.ProbeMatched && h.IsOuter(!h.BuildLeft) {
+			h.ProbeMatched = true
+			return h.JoinData(nil, h.ProbeData)
+		}
+		h.ProbeData = h.GetProbe().Next()
+		if h.ProbeData == nil {
+			h.ProbeEnd = true
+			break
+		}
+		h.Matches, h.MatchIdx, h.ProbeMatched = nil, 0, false
+		if key, ok := GenJoinKey(h.ProbeData, h.ProbeIdx); ok {
+			h.Matches = h.HashTable[key]
+		}
+	}
+	if !h.IsOuter(h.BuildLeft) {
+		return nil
+	}
+	for h.BuildIdx < len(h.BuildRows) { // 探测结束 输出构建侧没有匹配过的数据
+		idx := h.BuildIdx
+		h.BuildIdx++
+		if !h.BuildMatched[idx] {
+			return h.JoinData(h.BuildRows[idx], nil)
+		}
+	}
+	return nil
+}
+
+func (h *HashJoinOperator) Reset() { // hash 表不需要重新构建
+	h.GetProbe().Reset()
+	h.ProbeData, h.ProbeEnd, h.Matches, h.MatchIdx, h.BuildIdx = nil, false, nil, 0, 0
+	h.BuildMatched = make([]bool, len(h.BuildRows))
+}
+
+func NewHashJoinOperator(left IOperator, right IOperator, type0 string, leftKeys []string, rightKeys []string, expr *ExprNode, buildLeft bool) IOperator {
+	return &HashJoinOperator{Left: left, Right: right, Type: type0, LeftKeys: leftKeys, RightKeys: rightKeys, Expr: expr, BuildLeft: buildLeft}
+}
+
+//=======================MergeJoinOperator===========================
+
+// 两侧都已经按连接列有序(例如来自索引扫描)时使用，同时向后遍历两侧，每侧只读取一次  只支持内连接
+type MergeJoinOperator struct {
+	Left, Right       IOperator
+	LeftKey, RightKey string    // 两侧排序使用的连接列
+	Expr              *ExprNode // 完整的连接条件
+	Columns           []*Column
+	KeyColumn         *Column
+	LeftIdx, RightIdx int
+	LeftData          []any
+	RightData         []any   // 右侧下一条还没有处理的数据
+	Group             [][]any // 右侧与当前左侧 key 相同的一组数据
+	GroupIdx          int
+}
+
+func (m *MergeJoinOperator) GetColumns() []*Column {
+	return m.Columns
+}
+
+func (m *MergeJoinOperator) Open() {
+	m.Left.Open()
+	m.Right.Open()
+	m.Columns = append(CloneSlice(m.Left.GetColumns()), m.Right.GetColumns()...)
+	m.LeftIdx = GetColumnIdx(m.Left.GetColumns(), []string{m.LeftKey})[0]
+	m.RightIdx = GetColumnIdx(m.Right.GetColumns(), []string{m.RightKey})[0]
+	m.KeyColumn = m.Left.GetColumns()[m.LeftIdx]
+	m.LeftData, m.Group, m.GroupIdx = nil, nil, 0
+	m.RightData = m.Right.Next()
+}
+
+func (m *MergeJoinOperator) Close() {
+	m.Left.Close()
+	m.Right.Close()
+}
+
+func (m *MergeJoinOperator) Next() []any {
+	for {
+		if m.LeftData != nil && m.GroupIdx < len(m.Group) {
+			res := append(CloneSlice(m.LeftData), m.Group[m.GroupIdx]...)
+			m.GroupIdx++
+			if m.Expr == nil || CalculateExpr(m.Expr, m.Columns, res) {
+				return res
+			}
+			continue
+		}
+		leftData := m.Left.Next()
+		if leftData == nil {
+			return nil
+		}
+		key := leftData[m.LeftIdx]
+		if key == nil { // NULL 不与任何值相等
+			m.LeftData, m.Group = nil, nil
+			continue
+		}
+		// 与上一行 key 相同直接复用上一组
+		if len(m.Group) > 0 && ColumnCompare(m.LeftData[m.LeftIdx], key, m.KeyColumn) == 0 {
+			m.LeftData, m.GroupIdx = leftData, 0
+			continue
+		}
+		m.LeftData, m.Group, m.GroupIdx = leftData, nil, 0
+		// 右侧跳过比 key 小的数据，NULL 排在最前面也会被跳过
+		for m.RightData != nil && ColumnCompare(m.RightData[m.RightIdx], key, m.KeyColumn) < 0 {
+			m.RightData = m.Right.Next()
+		}
+		for m.RightData != nil && ColumnCompare(m.RightData[m.RightIdx], key, m.KeyColumn) == 0 {
+			m.Group = append(m.Group, m.RightData)
+			m.RightData = m.Right.Next()
+		}
+	}
+}
+
+func (m *MergeJoinOperator) Reset() {
+	m.Left.Reset()
+	m.Right.Reset()
+	m.LeftData, m.Group, m.GroupIdx = nil, nil, 0
+	m.RightData = m.Right.Next()
+}
+
+func NewMergeJoinOperator(left IOperator, right IOperator, leftKey string, rightKey string, expr *ExprNode) IOperator {
+	return &MergeJoinOperator{Left: left, Right: right, LeftKey: leftKey, RightKey: rightKey, Expr: expr}
 }
 
 //=========================ProjectionOperator==============================
@@ -230,6 +643,7 @@ func NewJoinOperator(left IOperator, right IOperator, expr *ExprNode) IOperator
 type ProjectionOperator struct {
 	*InputOperator
 	SelectFields []string
+	Aliases      []string // 与 SelectFields 一一对应 不为空的使用别名作为输出列名
 	Columns      []*Column
 	DataIdx      []int
 }
@@ -240,6 +654,7 @@ func (p *ProjectionOperator) GetColumns() []*Column {
 
 func (p *ProjectionOperator) Open() {
 	p.InputOperator.Open()
+	p.Columns, p.DataIdx = nil, nil
 	columns := p.Input.GetColumns()
 	columnMap := make(map[string]*Column)
 	idxMap := make(map[string]int)
@@ -247,12 +662,17 @@ func (p *ProjectionOperator) Open() {
 		columnMap[column.Name] = column
 		idxMap[column.Name] = i
 	}
-	for _, field := range p.SelectFields {
+	for i, field := range p.SelectFields {
 		if column, ok := columnMap[field]; ok {
+			if p.Aliases[i] != "" {
+				temp := *column
+				temp.Name = p.Aliases[i]
+				column = &temp
+			}
 			p.Columns = append(p.Columns, column)
 			p.DataIdx = append(p.DataIdx, idxMap[field])
 		} else {
-			panic(fmt.Sprintf("column %s not found", field))
+			panic(&NotFoundError{Kind: "column", Name: field})
 		}
 	}
 }
@@ -269,8 +689,8 @@ func (p *ProjectionOperator) Next() []any {
 	return res
 }
 
-func NewProjectionOperator(input IOperator, selectFields []string) IOperator {
-	return &ProjectionOperator{InputOperator: NewInputOperator(input), SelectFields: selectFields}
+func NewProjectionOperator(input IOperator, selectFields []string, aliases []string) IOperator {
+	return &ProjectionOperator{InputOperator: NewInputOperator(input), SelectFields: selectFields, Aliases: aliases}
 }
 
 //======================DistinctOperator=====================
@@ -289,6 +709,7 @@ func (d *DistinctOperator) GetColumns() []*Column {
 
 func (d *DistinctOperator) Open() {
 	d.Input.Open()
+	d.DataIdx, d.Columns, d.Set = nil, nil, make(map[string]struct{})
 	columns := d.Input.GetColumns()
 	idxMap := make(map[string]int)
 	columnMap := make(map[string]*Column)
@@ -301,7 +722,7 @@ func (d *DistinctOperator) Open() {
 			d.DataIdx = append(d.DataIdx, idx)
 			d.Columns = append(d.Columns, columnMap[field])
 		} else {
-			panic(fmt.Sprintf("column %s not found", field))
+			panic(&NotFoundError{Kind: "column", Name: field})
 		}
 	}
 }
@@ -318,12 +739,10 @@ func (d *DistinctOperator) Next() []any {
 			return nil
 		}
 		res := make([]any, 0)
-		key := fmt.Sprintf("%v", temp[d.DataIdx[0]])
-		res = append(res, temp[d.DataIdx[0]])
-		for i := 1; i < len(d.DataIdx); i++ {
-			key = fmt.Sprintf("%v#%v", key, temp[d.DataIdx[i]])
-			res = append(res, temp[d.DataIdx[i]])
+		for _, idx := range d.DataIdx {
+			res = append(res, temp[idx])
 		}
+		key := GenRowKey(res)
 		if _, ok := d.Set[key]; !ok {
 			d.Set[key] = struct{}{}
 			return res
@@ -335,238 +754,172 @@ func NewDistinctOperator(input IOperator, distinctFields []string) IOperator {
 	return &DistinctOperator{InputOperator: NewInputOperator(input), DistinctFields: distinctFields, Set: make(map[string]struct{})}
 }
 
-//======================FilterOperator========================
+//======================UnionOperator=====================
 
-type FilterOperator struct {
-	*InputOperator
-	Expr *ExprNode // 判断条件 也可以细分查询条件，每个查询条件都一个 Filter 这样方便索引范围查找，不过多次扫描再合并就看值不值了
+// UNION [ALL] 先输出左侧再输出右侧 不带 ALL 时与 DistinctOperator 一样使用 hash 集合去重
+type UnionOperator struct {
+	Left    IOperator
+	Right   IOperator
+	All     bool
+	Columns []*Column // 转换时就确定了 两侧的值按结果列的类型转换
+	Set     map[string]struct{}
+	LeftEnd bool
 }
 
-func (f *FilterOperator) Next() []any {
+func (u *UnionOperator) GetColumns() []*Column {
+	return u.Columns
+}
+
+func (u *UnionOperator) Open() {
+	u.Left.Open()
+	u.Right.Open()
+	u.Set, u.LeftEnd = make(map[string]struct{}), false
+}
+
+func (u *UnionOperator) Close() {
+	u.Left.Close()
+	u.Right.Close()
+}
+
+func (u *UnionOperator) Reset() {
+	u.Left.Reset()
+	u.Right.Reset()
+	u.Set, u.LeftEnd = make(map[string]struct{}), false
+}
+
+func (u *UnionOperator) Next() []any {
 	for {
-		res := f.Input.Next()
-		if res == nil {
+		var res []any
+		if !u.LeftEnd {
+			if res = u.Left.Next(); res == nil {
+				u.LeftEnd = true
+				continue
+			}
+		} else if res = u.Right.Next(); res == nil {
 			return nil
 		}
-		if CalculateExpr(f.Expr, f.Input.GetColumns(), res) {
+		res = CastSetRow(res, u.Columns)
+		if u.All {
+			return res
+		}
+		key := GenRowKey(res)
+		if _, ok := u.Set[key]; !ok {
+			u.Set[key] = struct{}{}
 			return res
 		}
 	}
 }
 
-func NewFilterOperator(input IOperator, expr *ExprNode) IOperator {
-	return &FilterOperator{InputOperator: NewInputOperator(input), Expr: expr}
+func NewUnionOperator(left IOperator, right IOperator, all bool, columns []*Column) IOperator {
+	return &UnionOperator{Left: left, Right: right, All: all, Columns: columns}
 }
 
-//============================GroupOperator=============================
+// 整数列与浮点数列合并时 整数转换为浮点数
+func CastSetRow(data []any, columns []*Column) []any {
+	for i, column := range columns {
+		if val, ok := data[i].(int64); ok && column.Type == TypFloat {
+			data[i] = float64(val)
+		}
+	}
+	return data
+}
 
-// 所有列都是 表名.列名 的形式 sql可以简写，会自动扩充 起别名还是会最终替换为表名称 * 也是这里替换的
-// 常量列实际就是与一个只有一行数据的临时表 join 笛卡尔积  会改变列的输出
-type GroupOperator struct { // 支持多列分组
-	*InputOperator
-	GroupColumns []string // 聚合的列  不能简单使用列名称，多表可能存在重复列名 可以统一规划为 表名.列名 长度可以为空
-	// SUM AVG MAX MIN COUNT 有 count 且不是聚合查询的语句需要进行改写为聚合语句 GroupColumns 可以为空 []string
-	// 这里是所有相关的函数，没有区分是否是聚合函数
-	Funcs []*FuncNode // 聚合函数操作的其他列 例如 max(height)  group by age 聚合函数只能有一个入参且必须为 IDNode
-	// 需要全放到内存 暂时不考虑落盘方案
-	Data    [][]any
-	DataIdx int
+//======================IntersectOperator=====================
+
+// INTERSECT [ALL]  EXCEPT [ALL] 先读取右侧建立 hash 表(记录出现次数) 再逐行检查左侧
+// 带 ALL 时每匹配一次消耗一次右侧的次数，不带 ALL 时结果去重
+type IntersectOperator struct {
+	Left    IOperator
+	Right   IOperator
+	Type    string // INTERSECT EXCEPT
+	All     bool
 	Columns []*Column
+	Counts  map[string]int // 右侧每个 key 剩余的次数
+	Set     map[string]struct{}
 }
 
-func (g *GroupOperator) GetColumns() []*Column {
-	return g.Columns
+func (i *IntersectOperator) GetColumns() []*Column {
+	return i.Columns
 }
 
-func (g *GroupOperator) GetFuncIDNode(func0 *FuncNode) *IDNode {
-	if len(func0.Params) != 1 {
-		panic(fmt.Sprintf("func0 must one parameter"))
-	}
-	return func0.Params[0].(*IDNode)
+func (i *IntersectOperator) Open() {
+	i.Left.Open()
+	i.Right.Open()
+	i.Build()
 }
 
-func (g *GroupOperator) Open() {
-	g.InputOperator.Open()
-	keyIdx := make([]int, 0)          // 聚合 key 的数据下标
-	paramIdx := make([]int, 0)        // 聚合函数对应输入的下标
-	funcNodes := make([]*FuncNode, 0) // 聚合函数节点
-	for _, item := range g.Funcs {
-		func0 := GetFunc(item.FuncName)
-		if func0.IsAggregate {
-			funcNodes = append(funcNodes, item)
-		}
-	}
-	// 先组装列信息
-	columns := g.Input.GetColumns()
-	columnMap := make(map[string]*Column)
-	idxMap := make(map[string]int)
-	for i, column := range columns {
-		columnMap[column.Name] = column
-		idxMap[column.Name] = i
-	}
-	for _, field := range g.GroupColumns {
-		if column, ok := columnMap[field]; ok {
-			g.Columns = append(g.Columns, column)
-			keyIdx = append(keyIdx, idxMap[field])
-		} else {
-			panic(fmt.Sprintf("column %s not found", field))
-		}
-	}
-	for _, funcNode := range funcNodes {
-		node := g.GetFuncIDNode(funcNode)
-		if column, ok := columnMap[node.Value]; ok {
-			func0 := GetFunc(funcNode.FuncName)
-			typ, l := func0.AggregateRetType(column) // 获取对应类型与长度
-			g.Columns = append(g.Columns, &Column{
-				Name: GetFuncColumnName(funcNode), // 列名需要拼接函数名
-				Type: typ,
-				Len:  l,
-			})
-			paramIdx = append(paramIdx, idxMap[node.Value])
-		} else {
-			panic(fmt.Sprintf("column %s not found", node.Value))
-		}
-	}
-	// 拉取信息进行组装
-	temp := make(map[string][][]any)
+func (i *IntersectOperator) Build() {
+	i.Counts, i.Set = make(map[string]int), make(map[string]struct{})
 	for {
-		res := g.Input.Next()
+		res := i.Right.Next()
 		if res == nil {
 			break
 		}
-		key := g.GenKey(res, keyIdx)
-		temp[key] = append(temp[key], res)
-	}
-	for _, items := range temp {
-		res := make([]any, 0) // 组装分组数据
-		for _, idx := range keyIdx {
-			res = append(res, items[0][idx]) // 分组字段都是一样的随便选一个就行 这里直接用第一个的
-		} // 组装函数数据
-		for i, funcNode := range funcNodes {
-			func0 := GetFunc(funcNode.FuncName)
-			params := make([]*Value, 0)
-			column := columns[paramIdx[i]]
-			for _, data := range items {
-				params = append(params, &Value{
-					Type: column.Type,
-					Data: data[paramIdx[i]],
-				})
-			}
-			res = append(res, func0.Call(params))
-		}
-		g.Data = append(g.Data, res)
+		i.Counts[GenRowKey(CastSetRow(res, i.Columns))]++
 	}
-	g.DataIdx = 0
 }
 
-func (g *GroupOperator) GenKey(res []any, idx []int) string {
-	if len(idx) == 0 {
-		return ""
-	}
-	key := fmt.Sprintf("%v", res[idx[0]])
-	for i := 1; i < len(idx); i++ {
-		key = fmt.Sprintf("%v#%v", key, res[idx[i]])
-	}
-	return key
+func (i *IntersectOperator) Close() {
+	i.Left.Close()
+	i.Right.Close()
 }
 
-func (g *GroupOperator) Reset() {
-	g.InputOperator.Reset()
-	g.DataIdx = 0
+func (i *IntersectOperator) Reset() {
+	i.Left.Reset()
+	i.Right.Reset()
+	i.Build()
 }
 
-func (g *GroupOperator) Next() []any {
-	if g.DataIdx < len(g.Data) {
-		g.DataIdx++
-		return g.Data[g.DataIdx-1]
-	} else {
-		return nil
+func (i *IntersectOperator) Next() []any {
+	for {
+		res := i.Left.Next()
+		if res == nil {
+			return nil
+		}
+		res = CastSetRow(res, i.Columns)
+		key := GenRowKey(res)
+		count := i.Counts[key]
+		if !i.All {
+			if _, ok := i.Set[key]; ok || (count > 0) != (i.Type == INTERSECT) {
+				continue
+			}
+			i.Set[key] = struct{}{}
+			return res
+		}
+		if count > 0 {
+			i.Counts[key]--
+		}
+		if (count > 0) == (i.Type == INTERSECT) {
+			return res
+		}
 	}
 }
 
-func NewGroupOperator(input IOperator, groupColumns []string, funcs []*FuncNode) IOperator {
-	return &GroupOperator{InputOperator: NewInputOperator(input), GroupColumns: groupColumns, Funcs: funcs}
+func NewIntersectOperator(left IOperator, right IOperator, type0 string, all bool, columns []*Column) IOperator {
+	return &IntersectOperator{Left: left, Right: right, Type: type0, All: all, Columns: columns}
 }
 
-//=======================SortOperator==========================
+//======================FilterOperator========================
 
-// 排序分为 内排序 外排序(数据太大内存放不下)
-// 外排序，排序完放在临时文件中，每次 next读取一部分进行返回
-// 暂时仅实现内排序
-type SortOperator struct {
+type FilterOperator struct {
 	*InputOperator
-	Orders  []*OrderNode // 按顺序来，支持多列排序
-	Data    [][]any
-	DataIdx int
+	Expr *ExprNode // 判断条件 也可以细分查询条件，每个查询条件都一个 Filter 这样方便索引范围查找，不过多次扫描再合并就看值不值了
 }
 
-func (s *SortOperator) Open() {
-	s.InputOperator.Open()
-	// 准备数据
+func (f *FilterOperator) Next() []any {
 	for {
-		res := s.Input.Next()
+		res := f.Input.Next()
 		if res == nil {
-			break
+			return nil
 		}
-		s.Data = append(s.Data, res)
-	}
-	columns := s.Input.GetColumns()
-	columnMap := make(map[string]*Column)
-	idxMap := make(map[string]int)
-	for idx, column := range columns {
-		idxMap[column.Name] = idx
-		columnMap[column.Name] = column
-	}
-	dataIdx := make([]int, 0)
-	dataColumns := make([]*Column, 0)
-	for _, order := range s.Orders {
-		if idx, ok := idxMap[order.Field.Value]; ok {
-			dataIdx = append(dataIdx, idx)
-			dataColumns = append(dataColumns, columnMap[order.Field.Value])
-		} else {
-			panic(fmt.Sprintf("field %s not found", order.Field.Value))
-		}
-	}
-	sort.Slice(s.Data, func(i, j int) bool {
-		for k, order := range s.Orders {
-			column := dataColumns[k]
-			res := CompareValue(&Value{
-				Type: column.Type,
-				Data: s.Data[i][dataIdx[k]],
-			}, &Value{
-				Type: column.Type,
-				Data: s.Data[j][dataIdx[k]],
-			})
-			if res == 0 { // 当前比较一致进行下一级
-				continue
-			}
-			if order.Desc {
-				return res > 0
-			} else {
-				return res < 0
-			}
+		if CalculateExpr(f.Expr, f.Input.GetColumns(), res) {
+			return res
 		}
-		return true
-	})
-	s.DataIdx = 0
-}
-
-func (s *SortOperator) Reset() {
-	s.InputOperator.Reset()
-	s.DataIdx = 0
-}
-
-func (s *SortOperator) Next() []any {
-	if s.DataIdx < len(s.Data) {
-		s.DataIdx++
-		return s.Data[s.DataIdx-1]
-	} else {
-		return nil
 	}
 }
 
-func NewSortOperator(input IOperator, orders []*OrderNode) IOperator {
-	return &SortOperator{InputOperator: NewInputOperator(input), Orders: orders}
+func NewFilterOperator(input IOperator, expr *ExprNode) IOperator {
+	return &FilterOperator{InputOperator: NewInputOperator(input), Expr: expr}
 }
 
 //==========================LimitOperator=======================
@@ -589,6 +942,7 @@ func (l *LimitOperator) Next() []any {
 
 func (l *LimitOperator) Open() {
 	l.InputOperator.Open()
+	l.Count = 0
 	for i := 0; i < l.Offset; i++ {
 		if res := l.Input.Next(); res == nil {
 			break
@@ -614,7 +968,7 @@ func NewLimitOperator(input IOperator, limit int, offset int) IOperator {
 
 type FuncExecOperator struct {
 	*InputOperator
-	Funcs   []*FuncNode // 这里只处理普通函数不处理聚合函数
+	Nodes   []INode // 这里只处理普通函数与表达式 不处理聚合函数
 	Columns []*Column
 }
 
@@ -625,21 +979,26 @@ func (f *FuncExecOperator) GetColumns() []*Column {
 func (f *FuncExecOperator) Open() {
 	f.Input.Open()
 	columns := CloneSlice(f.Input.GetColumns())
-	funcNodes := make([]*FuncNode, 0)
-	for _, funcNode := range f.Funcs {
-		func0 := GetFunc(funcNode.FuncName)
-		if func0.IsAggregate { // 只处理非聚合函数
+	nameSet := make(map[string]struct{})
+	for _, column := range columns {
+		nameSet[column.Name] = struct{}{}
+	}
+	nodes := make([]INode, 0)
+	for _, node := range f.Nodes {
+		name := GetNodeColumnName(node)
+		if _, has := nameSet[name]; has { // 已经计算过了(聚合函数，排序前计算的表达式)
 			continue
 		}
-		funcNodes = append(funcNodes, funcNode)
-		typ, l := func0.RetType()
+		nameSet[name] = struct{}{}
+		nodes = append(nodes, node)
+		typ, l := GetNodeType(node, f.Input.GetColumns())
 		columns = append(columns, &Column{
-			Name: GetFuncColumnName(funcNode),
+			Name: name,
 			Type: typ,
 			Len:  l,
 		})
 	}
-	f.Funcs = funcNodes
+	f.Nodes = nodes
 	f.Columns = columns
 }
 
@@ -648,28 +1007,29 @@ func (f *FuncExecOperator) Next() []any {
 	if res == nil {
 		return nil
 	}
-	for _, funcNode := range f.Funcs {
-		val := ParseValue(funcNode, f.Input.GetColumns(), res)
+	for _, node := range f.Nodes {
+		val := ParseValue(node, f.Input.GetColumns(), res)
 		res = append(res, ValueToAny(val, val.Type))
 	}
 	return res
 }
 
-func NewFuncExecOperator(input IOperator, funcs []*FuncNode) *FuncExecOperator {
-	return &FuncExecOperator{InputOperator: NewInputOperator(input), Funcs: funcs}
+func NewFuncExecOperator(input IOperator, nodes []INode) *FuncExecOperator {
+	return &FuncExecOperator{InputOperator: NewInputOperator(input), Nodes: nodes}
 }
 
 //=======================ExpandImmOperator=====================
 
 type ExpandImmOperator struct {
 	*InputOperator
-	Columns    []*Column
-	ExpandData []any
+	ExpandColumns []*Column
+	ExpandData    []any
+	Columns       []*Column
 }
 
 func (e *ExpandImmOperator) Open() {
 	e.InputOperator.Open()
-	e.Columns = append(e.Input.GetColumns(), e.Columns...)
+	e.Columns = append(CloneSlice(e.Input.GetColumns()), e.ExpandColumns...)
 }
 
 func (e *ExpandImmOperator) GetColumns() []*Column {
@@ -685,7 +1045,97 @@ func (e *ExpandImmOperator) Next() []any {
 }
 
 func NewExpandImmOperator(input IOperator, columns []*Column, expandData []any) *ExpandImmOperator {
-	return &ExpandImmOperator{InputOperator: NewInputOperator(input), Columns: columns, ExpandData: expandData}
+	return &ExpandImmOperator{InputOperator: NewInputOperator(input), ExpandColumns: columns, ExpandData: expandData}
+}
+
+//=====================SubQueryOperator====================
+
+// 表达式中的子查询 每次使用外层当前行绑定参数后重新执行(重新打开整个执行计划)
+// 结果按参数值缓存，不相关子查询只会执行一次
+type SubQueryOperator struct {
+	*InputOperator              // 子查询的执行计划
+	Params         []*ParamNode // 需要使用外层当前行绑定的参数
+	Refs           []*ParamNode // 子查询中用到的所有参数(包含更外层绑定的) 作为缓存的 key
+	Columns        []*Column    // 转换时就确定了 不需要打开执行计划
+	Cache          map[string][][]any
+}
+
+func (s *SubQueryOperator) GetColumns() []*Column {
+	return s.Columns
+}
+
+func (s *SubQueryOperator) Rows(columns []*Column, data []any) [][]any {
+	for _, param := range s.Params {
+		idx := GetColumnIdx(columns, []string{param.Column.Name})[0]
+		param.Value = &Value{Type: columns[idx].Type, Data: data[idx]}
+	}
+	buff := &strings.Builder{}
+	for _, ref := range s.Refs {
+		buff.WriteString(fmt.Sprintf("%v#", ref.Value.Data))
+	}
+	key := buff.String()
+	if rows, ok := s.Cache[key]; ok {
+		return rows
+	}
+	rows := make([][]any, 0)
+	s.Open()
+	for {
+		res := s.Next()
+		if res == nil {
+			break
+		}
+		rows = append(rows, res)
+	}
+	s.Close()
+	s.Cache[key] = rows
+	return rows
+}
+
+func NewSubQueryOperator(input IOperator, params []*ParamNode, refs []*ParamNode, columns []*Column) *SubQueryOperator {
+	return &SubQueryOperator{InputOperator: NewInputOperator(input), Params: params, Refs: refs, Columns: columns,
+		Cache: make(map[string][][]any)}
+}
+
+//=====================DerivedTableOperator====================
+
+// from join 中的子查询(派生表) 输出列重命名为 别名.列名 子查询中的 表名.列名 只保留列名
+type DerivedTableOperator struct {
+	*InputOperator
+	Alias   string
+	Columns []*Column // 转换时就确定了
+}
+
+func (d *DerivedTableOperator) GetColumns() []*Column {
+	return d.Columns
+}
+
+func NewDerivedTableOperator(input IOperator, alias string, columns []*Column) *DerivedTableOperator {
+	res := make([]*Column, 0)
+	names := make(map[string]struct{})
+	for _, column := range columns {
+		temp := *column
+		temp.Name = fmt.Sprintf("%s.%s", alias, GetShortName(column.Name))
+		if _, has := names[temp.Name]; has {
+			panic(&ExistsError{Kind: "column", Name: temp.Name})
+		}
+		names[temp.Name] = struct{}{}
+		res = append(res, &temp)
+	}
+	return &DerivedTableOperator{InputOperator: NewInputOperator(input), Alias: alias, Columns: res}
+}
+
+// 表名.列名 只保留列名 其他的(别名，函数，表达式)保持不变
+func GetShortName(name string) string {
+	idx := strings.IndexRune(name, '.')
+	if idx <= 0 {
+		return name
+	}
+	for _, ch := range name {
+		if ch != '.' && ch != '_' && !unicode.IsLetter(ch) && !unicode.IsDigit(ch) {
+			return name
+		}
+	}
+	return name[idx+1:]
 }
 
 //=====================InsertOperator====================
@@ -740,7 +1190,7 @@ func (u *UpdateOperator) Next() []any {
 			setIdx = append(setIdx, idx)
 			setColumns = append(setColumns, columnMap[set.Field.Value])
 		} else {
-			panic(fmt.Sprintf("field %s not found", set.Field.Value))
+			panic(&NotFoundError{Kind: "column", Name: set.Field.Value})
 		}
 	}
 	effectedRow := int64(0)
@@ -838,7 +1288,7 @@ func NewDeleteOperator(input IOperator, storage *Storage, table string) IOperato
 
 //====================CreateTableOperator=======================
 
-type CreateTableOperator struct { // 暂时不支持表结构的修改
+type CreateTableOperator struct { // 表结构的修改见 AlterTableOperator
 	*OnceOperator
 	Table   string
 	Columns []*Column
@@ -850,6 +1300,7 @@ func (c *CreateTableOperator) CreateTable() int64 {
 		Columns: c.Columns,
 	}
 	AddTable(table)
+	SaveCatalog() // DDL 不记录 REDO LOG 元数据直接落盘
 	return 1
 }
 
@@ -867,6 +1318,7 @@ type CreateIndexOperator struct { // 暂时不支持索引结构的修改
 	Index   string
 	Table   string
 	Columns []string
+	Unique  bool
 }
 
 func (c *CreateIndexOperator) CreateIndex() int64 {
@@ -875,29 +1327,243 @@ func (c *CreateIndexOperator) CreateIndex() int64 {
 		Name:      c.Index,
 		TableName: c.Table,
 		Columns:   c.Columns,
+		NonUnique: !c.Unique,
 	}
 	AddIndex(index)
+	defer func() { // 存量数据不满足唯一索引等 移除元数据与建了一半的索引文件
+		if err := recover(); err != nil {
+			RemoveIndex(index.Name)
+			c.Storage.DropIndex(index.Name)
+			panic(err)
+		}
+	}()
 	// 为存量数据创建索引
-	operator := NewTableScanOperator(c.Storage, c.Table)
-	operator.Open()
-	effectedRow := int64(0)
-	btree := c.Storage.OpenIndex(index.Name)
+	effectedRow := c.Storage.BuildIndex(index)
+	SaveCatalog() // DDL 不记录 REDO LOG 索引与元数据直接落盘
+	return effectedRow
+}
+
+func NewCreateIndexOperator(storage *Storage, index string, table string, columns []string, unique bool) IOperator {
+	res := &CreateIndexOperator{Index: index, Table: table, Columns: columns, Storage: storage, Unique: unique}
+	res.OnceOperator = NewOnceOperator(res.CreateIndex)
+	return res
+}
+
+//========================DropTableOperator=========================
+
+type DropTableOperator struct { // 删除表与其所有索引，不能回滚
+	*OnceOperator
+	Storage  *Storage
+	Table    string
+	IfExists bool
+}
+
+func (d *DropTableOperator) DropTable() int64 {
+	if !HasTable(d.Table) {
+		if d.IfExists {
+			return 0
+		}
+		panic(&NotFoundError{Kind: "table", Name: d.Table})
+	}
+	d.Storage.TransactionManager.BeforeDDL()
+	// 先删除文件再删除元数据，中途异常最多留下一个空表
+	indexes0 := ListIndexes(d.Table)
+	d.Storage.DropTable(d.Table)
+	for _, index := range indexes0 {
+		RemoveIndex(index.Name)
+	}
+	RemoveTable(d.Table)
+	RemoveTableStat(d.Table)
+	SaveCatalog()
+	return 1
+}
+
+func NewDropTableOperator(storage *Storage, table string, ifExists bool) IOperator {
+	res := &DropTableOperator{Storage: storage, Table: table, IfExists: ifExists}
+	res.OnceOperator = NewOnceOperator(res.DropTable)
+	return res
+}
+
+//========================DropIndexOperator=========================
+
+type DropIndexOperator struct {
+	*OnceOperator
+	Storage *Storage
+	Index   string
+	Table   string
+}
+
+func (d *DropIndexOperator) DropIndex() int64 {
+	index := GetIndex(d.Index)
+	if index.TableName != d.Table {
+		panic(&NotFoundError{Kind: "index", Name: fmt.Sprintf("%s on table %s", d.Index, d.Table)})
+	}
+	d.Storage.TransactionManager.BeforeDDL()
+	d.Storage.DropIndex(d.Index)
+	RemoveIndex(d.Index)
+	SaveCatalog()
+	return 1
+}
+
+func NewDropIndexOperator(storage *Storage, index string, table string) IOperator {
+	res := &DropIndexOperator{Storage: storage, Index: index, Table: table}
+	res.OnceOperator = NewOnceOperator(res.DropIndex)
+	return res
+}
+
+//========================TruncateTableOperator=========================
+
+type TruncateTableOperator struct { // 清空表数据，不能回滚
+	*OnceOperator
+	Storage *Storage
+	Table   string
+}
+
+func (t *TruncateTableOperator) TruncateTable() int64 {
+	GetTable(t.Table) // 校验表存在
+	t.Storage.TransactionManager.BeforeDDL()
+	t.Storage.TruncateTable(t.Table)
+	RemoveTableStat(t.Table)
+	SaveCatalog()
+	return 1
+}
+
+func NewTruncateTableOperator(storage *Storage, table string) IOperator {
+	res := &TruncateTableOperator{Storage: storage, Table: table}
+	res.OnceOperator = NewOnceOperator(res.TruncateTable)
+	return res
+}
+
+//========================AnalyzeTableOperator=========================
+
+type AnalyzeTableOperator struct { // 流式读取全表收集统计信息 返回表的行数
+	*OnceOperator
+	Storage *Storage
+	Table   string
+}
+
+func (a *AnalyzeTableOperator) AnalyzeTable() int64 {
+	builder := NewStatBuilder(GetTable(a.Table))
+	offset, end := int64(0), a.Storage.TableSize(a.Table)
 	for {
-		res := operator.Next()
-		if res == nil {
+		var data []any
+		data, _, offset = a.Storage.NextData(a.Table, offset, end)
+		if data == nil {
 			break
 		}
-		data0 := PickData(index.Columns, operator.GetColumns(), res)
-		offset := res[len(res)-1].(int64)
-		btree.AddData(data0, offset)
-		effectedRow++
+		builder.Add(data)
 	}
-	operator.Close()
-	return effectedRow
+	SetTableStat(builder.Build())
+	SaveCatalog()
+	return builder.Rows
 }
 
-func NewCreateIndexOperator(storage *Storage, index string, table string, columns []string) IOperator {
-	res := &CreateIndexOperator{Index: index, Table: table, Columns: columns, Storage: storage}
-	res.OnceOperator = NewOnceOperator(res.CreateIndex)
+func NewAnalyzeTableOperator(storage *Storage, table string) IOperator {
+	res := &AnalyzeTableOperator{Storage: storage, Table: table}
+	res.OnceOperator = NewOnceOperator(res.AnalyzeTable)
 	return res
 }
+
+//========================AlterTableOperator=========================
+
+// 记录都是定长的，修改列定义需要重写整个表的数据并重建所有索引，不能回滚
+type AlterTableOperator struct {
+	*OnceOperator
+	Storage *Storage
+	Table   string
+	Action  string  // ADD DROP RENAME MODIFY
+	Column  *Column // ADD MODIFY 新的列定义
+	Name    string  // 操作的列名
+	NewName string  // RENAME 的新列名
+	Default any     // ADD 存量数据的填充值
+}
+
+func (a *AlterTableOperator) AlterTable() int64 {
+	meta := GetTable(a.Table)
+	idx := -1
+	for i, column := range meta.Columns {
+		if column.Name == a.Name {
+			idx = i
+		}
+	}
+	if a.Action == ADD && idx >= 0 {
+		panic(&ExistsError{Kind: "column", Name: a.Name})
+	}
+	if a.Action != ADD && idx < 0 {
+		panic(&NotFoundError{Kind: "column", Name: a.Name})
+	}
+	a.Storage.TransactionManager.BeforeDDL()
+	// 修改都在副本上进行，新的数据与元数据都准备好后再一起替换
+	columns := CloneSlice(meta.Columns)
+	indexes0 := make([]*Index, 0)
+	for _, index := range ListIndexes(a.Table) {
+		index0 := *index
+		index0.Columns = CloneSlice(index.Columns)
+		indexes0 = append(indexes0, &index0)
+	}
+	record := &AlterRecord{Table: a.Table}
+	var convert func([]any) []any // 为空不需要重写数据
+	switch a.Action {
+	case ADD:
+		if a.Default == nil && !a.Column.Nullable {
+			panic(&ConstraintError{Kind: "not_null", Msg: fmt.Sprintf("column %s not null must have default value", a.Name)})
+		}
+		columns = append(columns, a.Column)
+		convert = func(data []any) []any {
+			return append(data, a.Default)
+		}
+	case DROP:
+		if len(columns) == 1 {
+			panic(&ExecError{Msg: "can not drop the only column"})
+		}
+		columns = append(columns[:idx], columns[idx+1:]...)
+		convert = func(data []any) []any {
+			return append(data[:idx], data[idx+1:]...)
+		}
+		remains := make([]*Index, 0)
+		for _, index := range indexes0 { // 索引移除对应列，没有列的索引直接删除
+			index.Columns = SubSlice(index.Columns, []string{a.Name})
+			if len(index.Columns) == 0 {
+				record.DropIndexes = append(record.DropIndexes, index.Name)
+			} else {
+				remains = append(remains, index)
+			}
+		}
+		indexes0 = remains
+	case RENAME:
+		for _, column := range columns {
+			if column.Name == a.NewName {
+				panic(&ExistsError{Kind: "column", Name: a.NewName})
+			}
+		}
+		column := *columns[idx] // 不修改原来的列，可能还在其他地方使用
+		column.Name = a.NewName
+		columns[idx] = &column
+		for _, index := range indexes0 {
+			for i, item := range index.Columns {
+				if item == a.Name {
+					index.Columns[i] = a.NewName
+				}
+			}
+		}
+	case MODIFY:
+		if a.Column.Type == TypTxt {
+			for _, index := range indexes0 {
+				if len(SubSlice(index.Columns, []string{a.Name})) != len(index.Columns) {
+					panic(&TypeError{Msg: fmt.Sprintf("column %s used by index %s can not be text", a.Name, index.Name)})
+				}
+			}
+		}
+		columns[idx] = a.Column
+		convert = func(data []any) []any {
+			data[idx] = ConvertData(data[idx], a.Column)
+			return data
+		}
+	}
+	if convert != nil {
+		a.Storage.RewriteTable(a.Table, columns, convert, indexes0)
+		record.Rewrite = true
+	}
+	a.Storage.SwitchTable(record, &Table{Name: meta.Name, Columns: columns}, indexes0)
+	return 1
+}
@@ -21,16 +21,34 @@ select * from t2 where a > b
 select a,b from t3 where a > c order by b
 select a,count(*) from t4 where b > 100 group by a
 select t1.name,t2.age from t1 left join t2 on t1.name = t2.name
+select a from t1 union all select b from t2 intersect select c from t3 order by a limit 10
 update t2 set n = 22,a = 33 where a > 100 AND b = 100
 insert into t3(a,b,z,d) values(2,3,2,4)
 delete from t3 where a = 100
 CREATE TABLE t2(uid int,name text)
 CREATE INDEX idx ON t2(a,b)
+CREATE UNIQUE INDEX idx ON t2(a)
+DROP TABLE IF EXISTS t2
+DROP INDEX idx ON t2
+TRUNCATE TABLE t2
+ALTER TABLE t2 ADD COLUMN age int DEFAULT 18
+ALTER TABLE t2 DROP COLUMN age
+ALTER TABLE t2 RENAME COLUMN name TO nick
+ALTER TABLE t2 MODIFY COLUMN nick varchar(64)
+ANALYZE TABLE t2
+EXPLAIN select a from t1 where a > 10
+EXPLAIN ANALYZE update t2 set n = 22 where a > 100
 */
 
 func (p *Parser) ParseTokens() INode {
+	if p.Match(EXPLAIN) {
+		analyze := p.Match(ANALYZE)
+		return &ExplainNode{Stmt: p.ParseTokens(), Analyze: analyze}
+	}
 	if p.Match(SELECT) {
-		return p.parseSelect()
+		res := p.parseSelect()
+		p.MustRead(EOF) // 子查询也使用 parseSelect 在这里检查结束
+		return res
 	}
 	if p.Match(UPDATE) {
 		return p.parseUpdate()
@@ -46,10 +64,32 @@ func (p *Parser) ParseTokens() INode {
 			return p.parseCreateTable()
 		}
 		if p.Match(INDEX) {
-			return p.parseCreateIndex()
+			return p.parseCreateIndex(false)
+		}
+		if p.Match(UNIQUE) {
+			p.MustRead(INDEX)
+			return p.parseCreateIndex(true)
+		}
+	}
+	if p.Match(DROP) {
+		if p.Match(TABLE) {
+			return p.parseDropTable()
+		}
+		if p.Match(INDEX) {
+			return p.parseDropIndex()
 		}
 	}
-	panic("unknown sql type")
+	if p.Match(TRUNCATE) {
+		return p.parseTruncateTable()
+	}
+	if p.Match(ANALYZE) {
+		return p.parseAnalyzeTable()
+	}
+	if p.Match(ALTER) {
+		p.MustRead(TABLE)
+		return p.parseAlterTable()
+	}
+	panic(&SyntaxError{Pos: p.Tokens[p.Idx].Pos, Msg: "unknown sql type"})
 }
 
 func (p *Parser) parseColumn() *ColumnNode {
@@ -59,12 +99,15 @@ func (p *Parser) parseColumn() *ColumnNode {
 	typ := p.MustRead(INT, FLOAT, VARCHAR, TEXT)
 	res.Type = strings.ToUpper(typ.Value)
 	if p.Match(LPAREN) {
-		temp := p.MustRead(INT)
-		l, err := strconv.ParseInt(temp.Value, 10, 64)
-		HandleErr(err)
-		res.Len = l
+		res.Len = p.MustReadInt()
 		p.MustRead(RPAREN)
 	}
+	if p.Match(NOT) { // 默认允许为 NULL
+		p.MustRead(NULL)
+		res.NotNull = true
+	} else {
+		p.Match(NULL)
+	}
 	return res
 }
 
@@ -84,8 +127,8 @@ func (p *Parser) parseCreateTable() INode {
 	return res
 }
 
-func (p *Parser) parseCreateIndex() INode {
-	res := &CreateIndexNode{}
+func (p *Parser) parseCreateIndex(unique bool) INode {
+	res := &CreateIndexNode{Unique: unique}
 	// index
 	index := p.MustRead(ID)
 	res.Index = index.Value
@@ -105,6 +148,80 @@ func (p *Parser) parseCreateIndex() INode {
 	return res
 }
 
+func (p *Parser) parseDropTable() INode {
+	res := &DropTableNode{}
+	if p.Match(IF) {
+		p.MustRead(EXISTS)
+		res.IfExists = true
+	}
+	table := p.MustRead(ID)
+	res.Table = table.Value
+	p.MustRead(EOF)
+	return res
+}
+
+func (p *Parser) parseDropIndex() INode {
+	res := &DropIndexNode{}
+	index := p.MustRead(ID)
+	res.Index = index.Value
+	p.MustRead(ON)
+	table := p.MustRead(ID)
+	res.Table = table.Value
+	p.MustRead(EOF)
+	return res
+}
+
+func (p *Parser) parseTruncateTable() INode {
+	res := &TruncateTableNode{}
+	p.Match(TABLE) // TABLE 可以省略
+	table := p.MustRead(ID)
+	res.Table = table.Value
+	p.MustRead(EOF)
+	return res
+}
+
+func (p *Parser) parseAnalyzeTable() INode {
+	res := &AnalyzeTableNode{}
+	p.MustRead(TABLE)
+	table := p.MustRead(ID)
+	res.Table = table.Value
+	p.MustRead(EOF)
+	return res
+}
+
+func (p *Parser) parseAlterTable() INode {
+	res := &AlterTableNode{}
+	table := p.MustRead(ID)
+	res.Table = table.Value
+	action := p.MustRead(ADD, DROP, RENAME, MODIFY)
+	res.Action = action.Type
+	if action.Type == RENAME {
+		p.MustRead(COLUMN)
+	} else {
+		p.Match(COLUMN) // COLUMN 可以省略
+	}
+	switch action.Type {
+	case ADD:
+		res.Column = p.parseColumn()
+		if p.Match(DEFAULT) {
+			res.Default = p.parseValue()
+		}
+	case DROP:
+		name := p.MustRead(ID)
+		res.Name = &IDNode{Value: name.Value}
+	case RENAME:
+		name := p.MustRead(ID)
+		res.Name = &IDNode{Value: name.Value}
+		p.MustRead(TO)
+		name = p.MustRead(ID)
+		res.NewName = &IDNode{Value: name.Value}
+	case MODIFY:
+		res.Column = p.parseColumn()
+	}
+	p.MustRead(EOF)
+	return res
+}
+
 func (p *Parser) parseDelete() INode {
 	res := &DeleteNode{}
 	p.MustRead(FROM)
@@ -130,22 +247,18 @@ func (p *Parser) parseInsert() INode {
 	// 至少有一个
 	p.MustRead(LPAREN)
 	temp := make([]*Value, 0)
-	val := p.MustRead(INT, FLOAT, STR)
-	temp = append(temp, &Value{Value: val.Value})
+	temp = append(temp, p.parseValue())
 	for p.Match(COMMA) {
-		val = p.MustRead(INT, FLOAT, STR)
-		temp = append(temp, &Value{Value: val.Value})
+		temp = append(temp, p.parseValue())
 	}
 	p.MustRead(RPAREN)
 	res.Values = append(res.Values, temp)
 	for p.Match(COMMA) {
 		p.MustRead(LPAREN)
 		temp = make([]*Value, 0)
-		val = p.MustRead(INT, FLOAT, STR)
-		temp = append(temp, &Value{Value: val.Value})
+		temp = append(temp, p.parseValue())
 		for p.Match(COMMA) {
-			val = p.MustRead(INT, FLOAT, STR)
-			temp = append(temp, &Value{Value: val.Value})
+			temp = append(temp, p.parseValue())
 		}
 		p.MustRead(RPAREN)
 		res.Values = append(res.Values, temp)
@@ -154,6 +267,70 @@ func (p *Parser) parseInsert() INode {
 	return res
 }
 
+func (p *Parser) parseJoin() *JoinNode {
+	joinType := ""
+	token := p.Read()
+	switch token.Type {
+	case JOIN:
+		joinType = INNER
+	case INNER:
+		joinType = INNER
+		p.MustRead(JOIN)
+	case LEFT, RIGHT, FULL:
+		joinType = token.Type
+		p.Match(OUTER) // OUTER 可以省略
+		p.MustRead(JOIN)
+	default:
+		p.UnRead()
+		return nil
+	}
+	res := &JoinNode{Type: joinType}
+	res.Table, res.SubQuery, res.Alias = p.parseTable()
+	if p.Match(ON) { // 链接条件是可选的
+		res.Condition = p.parseExpr()
+	}
+	return res
+}
+
+// 表名 [别名] 或 (子查询) 别名
+func (p *Parser) parseTable() (string, INode, string) {
+	if !p.Match(LPAREN) {
+		table := p.MustRead(ID)
+		return table.Value, nil, p.parseAlias()
+	}
+	p.MustRead(SELECT)
+	query := p.parseSelect()
+	p.MustRead(RPAREN)
+	alias := p.parseAlias()
+	if alias == "" {
+		panic(&SyntaxError{Pos: p.Tokens[p.Idx].Pos, Msg: "derived table must have alias"})
+	}
+	return "", query, alias
+}
+
+// [AS] 别名  AS 可以省略
+func (p *Parser) parseAlias() string {
+	if p.Match(AS) {
+		return p.MustRead(ID).Value
+	}
+	if p.Match(ID) {
+		return p.Tokens[p.Idx-1].Value
+	}
+	return ""
+}
+
+func (p *Parser) parseValue() *Value {
+	if p.Match(MINUS) { // 负数
+		val := p.MustRead(INT, FLOAT)
+		return &Value{Value: "-" + val.Value}
+	}
+	val := p.MustRead(INT, FLOAT, STR, NULL)
+	if val.Type == NULL {
+		return &Value{Type: TypNull}
+	}
+	return &Value{Value: val.Value}
+}
+
 func (p *Parser) parseUpdate() INode {
 	res := &UpdateNode{}
 	// table
@@ -176,60 +353,102 @@ func (p *Parser) parseUpdate() INode {
 func (p *Parser) parseSet() *SetNode {
 	field := p.MustRead(ID)
 	p.MustRead(EQ)
-	token := p.Read()
-	if token.Type == INT || token.Type == FLOAT || token.Type == STR {
-		return &SetNode{
-			Field: &IDNode{Value: field.Value},
-			Value: &ImmNode{Value: token.Value, Type: token.Type},
-		}
+	return &SetNode{
+		Field: &IDNode{Value: field.Value},
+		Value: p.parseOperand(),
 	}
-	if token.Type != ID {
-		panic(fmt.Sprintf("token type %s not ID", token.Type))
+}
+
+// 复合查询 调用前已经读取了第一个 SELECT  order by limit 作用于整个复合查询
+func (p *Parser) parseSelect() INode {
+	res := p.parseUnion()
+	var orders []*OrderNode
+	var limit *LimitNode
+	// order by
+	if p.Match(ORDER) {
+		p.MustRead(BY)
+		orders = append(orders, p.parseOrder())
+		for p.Match(COMMA) {
+			orders = append(orders, p.parseOrder())
+		}
 	}
-	if p.Match(LPAREN) {
-		return &SetNode{
-			Field: &IDNode{Value: field.Value},
-			Value: p.parseFunc(token),
+	// limit
+	if p.Match(LIMIT) {
+		limit = &LimitNode{
+			Limit: int(p.MustReadInt()),
+		}
+		if p.Match(OFFSET) { // 依赖 limit 否则不能单独出现 offset
+			limit.Offset = int(p.MustReadInt())
 		}
 	}
-	return &SetNode{
-		Field: &IDNode{field.Value},
-		Value: &IDNode{Value: token.Value},
+	switch target := res.(type) {
+	case *SelectNode:
+		target.Orders, target.Limit = orders, limit
+	case *SetOpNode:
+		target.Orders, target.Limit = orders, limit
 	}
+	return res
 }
 
-func (p *Parser) parseSelect() INode {
+// UNION EXCEPT 优先级低于 INTERSECT
+func (p *Parser) parseUnion() INode {
+	res := p.parseIntersect()
+	for p.Match(UNION) || p.Match(EXCEPT) {
+		operator := p.Tokens[p.Idx-1].Type
+		all := p.Match(ALL)
+		p.MustRead(SELECT)
+		res = &SetOpNode{Left: res, Right: p.parseIntersect(), Operator: operator, All: all}
+	}
+	return res
+}
+
+func (p *Parser) parseIntersect() INode {
+	res := INode(p.parseSelectCore())
+	for p.Match(INTERSECT) {
+		all := p.Match(ALL)
+		p.MustRead(SELECT)
+		res = &SetOpNode{Left: res, Right: p.parseSelectCore(), Operator: INTERSECT, All: all}
+	}
+	return res
+}
+
+// 不包含 order by limit 的单个 select
+func (p *Parser) parseSelectCore() *SelectNode {
 	res := &SelectNode{}
 	// select
+	res.Aliases = make(map[INode]string)
 	if p.Match(DISTINCT) { // 有 DISTINCT 的话，select 就直接使用 DISTINCT 的列
-		field := p.MustRead(ID)
-		res.Distinct = append(res.Distinct, &IDNode{Value: field.Value})
-		for p.Match(COMMA) {
-			field = p.MustRead(ID)
-			res.Distinct = append(res.Distinct, &IDNode{Value: field.Value})
+		for {
+			field := &IDNode{Value: p.MustRead(ID).Value}
+			if alias := p.parseAlias(); alias != "" {
+				res.Aliases[field] = alias
+			}
+			res.Distinct = append(res.Distinct, field)
+			if !p.Match(COMMA) {
+				break
+			}
 		}
 		for _, item := range res.Distinct {
 			res.Fields = append(res.Fields, item)
 		}
 	} else {
-		res.Fields = append(res.Fields, p.parseField())
-		for p.Match(COMMA) {
-			res.Fields = append(res.Fields, p.parseField())
+		for {
+			field := p.parseField()
+			if alias := p.parseAlias(); alias != "" {
+				res.Aliases[field] = alias
+			}
+			res.Fields = append(res.Fields, field)
+			if !p.Match(COMMA) {
+				break
+			}
 		}
 	}
 	// from
 	p.MustRead(FROM)
-	table := p.MustRead(ID)
-	res.From = table.Value
-	// join
-	if p.Match(JOIN) {
-		table = p.MustRead(ID)
-		res.Join = &JoinNode{
-			Table: table.Value,
-		}
-		if p.Match(ON) { // 链接条件是可选的
-			res.Join.Condition = p.parseExpr()
-		}
+	res.From, res.SubQuery, res.Alias = p.parseTable()
+	// join 可以有多个
+	for join := p.parseJoin(); join != nil; join = p.parseJoin() {
+		res.Joins = append(res.Joins, join)
 	}
 	// where
 	if p.Match(WHERE) {
@@ -245,35 +464,15 @@ func (p *Parser) parseSelect() INode {
 			res.Groups = append(res.Groups, &IDNode{Value: group.Value})
 		}
 	}
-	// order by
-	if p.Match(ORDER) {
-		p.MustRead(BY)
-		res.Orders = append(res.Orders, p.parseOrder())
-		for p.Match(COMMA) {
-			res.Orders = append(res.Orders, p.parseOrder())
-		}
-	}
-	// limit
-	if p.Match(LIMIT) {
-		temp := p.MustRead(INT)
-		limit, err := strconv.ParseInt(temp.Value, 10, 64)
-		HandleErr(err)
-		res.Limit = &LimitNode{
-			Limit: int(limit),
-		}
-		if p.Match(OFFSET) { // 依赖 limit 否则不能单独出现 offset
-			temp = p.MustRead(INT)
-			offset, err := strconv.ParseInt(temp.Value, 10, 64)
-			HandleErr(err)
-			res.Limit.Offset = int(offset)
-		}
+	// having
+	if p.Match(HAVING) {
+		res.Having = p.parseExpr()
 	}
-	p.MustRead(EOF)
 	return res
 }
 
 func (p *Parser) parseOrder() *OrderNode {
-	field := p.MustRead(ID)
+	field := p.parseOperand()
 	desc := false
 	if p.Match(ASC) {
 		desc = false
@@ -281,85 +480,187 @@ func (p *Parser) parseOrder() *OrderNode {
 		desc = true
 	}
 	return &OrderNode{
-		Field: &IDNode{Value: field.Value},
+		Field: field,
 		Desc:  desc,
 	}
 }
 
 func (p *Parser) parseField() INode {
-	token := p.Read()
-	if token.Type == STAR {
+	if p.Match(STAR) {
 		return &StarNode{}
 	}
-	if token.Type == INT || token.Type == FLOAT || token.Type == STR {
-		return &ImmNode{Value: token.Value, Type: token.Type}
-	}
-	if token.Type != ID {
-		panic(fmt.Sprintf("parseField err token %v not id", token.Type))
-	}
-	if p.Match(LPAREN) {
-		return p.parseFunc(token)
-	}
-	return &IDNode{Value: token.Value}
+	return p.parseOperand() // 字段可以是任意表达式
 }
 
 func (p *Parser) parseParam() INode {
-	token := p.Read()
-	if token.Type == INT || token.Type == FLOAT || token.Type == STR {
-		return &ImmNode{Value: token.Value, Type: token.Type}
-	}
-	if token.Type != ID {
-		panic(fmt.Sprintf("parseParam err token %v not id", token.Type))
-	}
-	if p.Match(LPAREN) { // 支持函数嵌套调用
-		return p.parseFunc(token)
-	}
-	return &IDNode{Value: token.Value}
+	return p.parseOperand() // 支持函数嵌套调用与表达式
+}
+
+// 二元操作符的优先级 越大越先计算 同一优先级左结合  NOT 的优先级在 AND 与比较之间
+var Precedences = map[string]int{
+	OR:  1,
+	AND: 2,
+	EQ:  4, NE: 4, GT: 4, GE: 4, LT: 4, LE: 4, IS: 4, IN: 4, BETWEEN: 4, LIKE: 4,
+	PLUS: 5, MINUS: 5, CONCAT: 5,
+	STAR: 6, SLASH: 6, PERCENT: 6,
 }
 
+const (
+	NotPrecedence = 3
+)
+
+// 条件表达式 结果必须是 ExprNode
 func (p *Parser) parseExpr() *ExprNode {
-	left := p.parseSubExpr()
+	node := p.parseOperand()
+	if expr, ok := node.(*ExprNode); ok {
+		return expr
+	}
+	panic(&SyntaxError{Pos: p.Tokens[p.Idx-1].Pos, Msg: "need condition expression"})
+}
+
+// 任意表达式 可以是 IDNode ImmNode FuncNode ExprNode
+func (p *Parser) parseOperand() INode {
+	return p.parseBinary(1)
+}
+
+// 优先级爬升 只处理优先级不低于 minPrec 的操作符
+func (p *Parser) parseBinary(minPrec int) INode {
+	left := p.parseUnary()
 	for {
 		token := p.Read()
-		if token.Type == AND || token.Type == OR {
+		not := false
+		if token.Type == NOT && Precedences[IN] >= minPrec { // NOT IN  NOT BETWEEN  NOT LIKE
+			not = true
+			token = p.MustRead(IN, BETWEEN, LIKE)
+		}
+		prec, ok := Precedences[token.Type]
+		if !ok || prec < minPrec {
+			p.UnRead()
+			return left
+		}
+		if token.Type == IN || token.Type == BETWEEN || token.Type == LIKE {
+			left = p.parsePredicate(left, token.Type, not)
+			continue
+		}
+		if token.Type == IS { // IS NULL  IS NOT NULL
+			operator := IS
+			if p.Match(NOT) {
+				operator = ISNOT
+			}
+			null := p.MustRead(NULL)
 			left = &ExprNode{
 				Left:     left,
-				Right:    p.parseSubExpr(),
-				Operator: token.Value,
+				Right:    &ImmNode{Value: null.Value, Type: NULL},
+				Operator: operator,
 			}
-		} else {
-			p.UnRead()
-			return left.(*ExprNode)
+			continue
+		}
+		left = &ExprNode{
+			Left:     left,
+			Right:    p.parseBinary(prec + 1),
+			Operator: token.Type,
 		}
 	}
 }
 
-func (p *Parser) parseSubExpr() INode {
-	left := p.parseExprItem()
-	for {
-		token := p.Read()
-		if token.Type == EQ || token.Type == NE || token.Type == GT || token.Type == GE ||
-			token.Type == LT || token.Type == LE {
-			left = &ExprNode{
-				Left:     left,
-				Right:    p.parseExprItem(),
-				Operator: token.Type,
+// IN (值列表)  BETWEEN 转换为 >= AND <=  LIKE 模式 [ESCAPE 转义字符]
+func (p *Parser) parsePredicate(left INode, operator string, not bool) INode {
+	var res *ExprNode
+	switch operator {
+	case IN:
+		p.MustRead(LPAREN)
+		if p.Match(SELECT) { // IN (子查询)
+			query := &SubQueryNode{Select: p.parseSelect()}
+			p.MustRead(RPAREN)
+			if not {
+				return &ExprNode{Left: left, Right: query, Operator: NOTIN}
 			}
-		} else {
-			p.UnRead()
-			return left
+			return &ExprNode{Left: left, Right: query, Operator: IN}
+		}
+		list := &ListNode{Items: []INode{p.parseOperand()}}
+		for p.Match(COMMA) {
+			list.Items = append(list.Items, p.parseOperand())
+		}
+		p.MustRead(RPAREN)
+		if not {
+			return &ExprNode{Left: left, Right: list, Operator: NOTIN}
+		}
+		return &ExprNode{Left: left, Right: list, Operator: IN}
+	case BETWEEN: // 边界不能包含 AND 只解析比比较优先级高的部分
+		low := p.parseBinary(Precedences[BETWEEN] + 1)
+		p.MustRead(AND)
+		high := p.parseBinary(Precedences[BETWEEN] + 1)
+		res = &ExprNode{
+			Left:     &ExprNode{Left: left, Right: low, Operator: GE},
+			Right:    &ExprNode{Left: left, Right: high, Operator: LE},
+			Operator: AND,
+		}
+	default:
+		var pattern INode = p.parseBinary(Precedences[LIKE] + 1)
+		if p.Match(ESCAPE) {
+			escape := p.MustRead(STR)
+			pattern = &ListNode{Items: []INode{pattern, &ImmNode{Value: escape.Value, Type: STR}}}
+		}
+		if not {
+			return &ExprNode{Left: left, Right: pattern, Operator: NOTLIKE}
+		}
+		return &ExprNode{Left: left, Right: pattern, Operator: LIKE}
+	}
+	if not {
+		return &ExprNode{Left: res, Operator: NOT}
+	}
+	return res
+}
+
+func (p *Parser) parseUnary() INode {
+	if p.Match(NOT) {
+		return &ExprNode{
+			Left:     p.parseBinary(NotPrecedence + 1),
+			Operator: NOT,
+		}
+	}
+	if p.Match(PLUS) {
+		return p.parseUnary()
+	}
+	if p.Match(EXISTS) { // EXISTS (子查询)
+		p.MustRead(LPAREN)
+		p.MustRead(SELECT)
+		query := &SubQueryNode{Select: p.parseSelect()}
+		p.MustRead(RPAREN)
+		return &ExprNode{Left: query, Operator: EXISTS}
+	}
+	if p.Match(MINUS) {
+		item := p.parseUnary()
+		if imm, ok := item.(*ImmNode); ok && (imm.Type == INT || imm.Type == FLOAT) { // 负数字面量直接合并
+			if strings.HasPrefix(imm.Value, "-") {
+				imm.Value = imm.Value[1:]
+			} else {
+				imm.Value = "-" + imm.Value
+			}
+			return imm
+		}
+		return &ExprNode{
+			Left:     &ImmNode{Value: "0", Type: INT},
+			Right:    item,
+			Operator: MINUS,
 		}
 	}
+	return p.parseExprItem()
 }
 
 func (p *Parser) parseExprItem() INode {
 	if p.Match(LPAREN) {
-		item := p.parseExpr()
+		if p.Match(SELECT) { // 标量子查询
+			query := &SubQueryNode{Select: p.parseSelect()}
+			p.MustRead(RPAREN)
+			return query
+		}
+		item := p.parseOperand()
 		p.MustRead(RPAREN)
 		return item
 	}
 	token := p.Read()
-	if token.Type == INT || token.Type == FLOAT || token.Type == STR {
+	if token.Type == INT || token.Type == FLOAT || token.Type == STR || token.Type == NULL {
 		return &ImmNode{Value: token.Value, Type: token.Type}
 	} else if token.Type == ID {
 		if p.Match(LPAREN) {
@@ -368,11 +669,16 @@ func (p *Parser) parseExprItem() INode {
 			return &IDNode{Value: token.Value}
 		}
 	}
-	panic(fmt.Sprintf("parseExpr err token %v type", token.Type))
+	panic(&SyntaxError{Pos: token.Pos, Msg: fmt.Sprintf("unexpected %s", token.Type)})
 }
 
 func (p *Parser) parseFunc(token *Token) *FuncNode {
 	params := make([]INode, 0)
+	if p.Match(STAR) { // COUNT(*)
+		p.MustRead(RPAREN)
+		return &FuncNode{FuncName: token.Value, Params: []INode{&StarNode{}}}
+	}
+	distinct := p.Match(DISTINCT)
 	if !p.Match(RPAREN) {
 		params = append(params, p.parseParam())
 		for p.Match(COMMA) {
@@ -383,11 +689,12 @@ func (p *Parser) parseFunc(token *Token) *FuncNode {
 	return &FuncNode{
 		FuncName: token.Value,
 		Params:   params,
+		Distinct: distinct,
 	}
 }
 
 func (p *Parser) Match(type0 string) bool {
-	if p.Tokens[p.Idx].Type == type0 {
+	if p.Idx < len(p.Tokens) && p.Tokens[p.Idx].Type == type0 {
 		p.Idx++
 		return true
 	}
@@ -395,10 +702,23 @@ func (p *Parser) Match(type0 string) bool {
 }
 
 func (p *Parser) Read() *Token {
+	if p.Idx >= len(p.Tokens) { // 已经读过 EOF 了
+		panic(&SyntaxError{Pos: p.Tokens[len(p.Tokens)-1].Pos, Msg: "unexpected end"})
+	}
 	p.Idx++
 	return p.Tokens[p.Idx-1]
 }
 
+// 整数字面量 超出范围也是语法错误
+func (p *Parser) MustReadInt() int64 {
+	token := p.MustRead(INT)
+	res, err := strconv.ParseInt(token.Value, 10, 64)
+	if err != nil {
+		panic(&SyntaxError{Pos: token.Pos, Msg: fmt.Sprintf("invalid int %s", token.Value)})
+	}
+	return res
+}
+
 func (p *Parser) MustRead(types ...string) *Token {
 	token := p.Read()
 	for _, type0 := range types {
@@ -406,7 +726,7 @@ func (p *Parser) MustRead(types ...string) *Token {
 			return token
 		}
 	}
-	panic(fmt.Sprintf("MustRead err type %v not types %v", token.Type, types))
+	panic(&SyntaxError{Pos: token.Pos, Msg: fmt.Sprintf("need %s get %s", strings.Join(types, " or "), token.Type)})
 }
 
 func (p *Parser) UnRead() {
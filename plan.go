@@ -0,0 +1,431 @@
+/*
+@author: sk
+@date: 2024/10/8
+*/
+package main
+
+import "strings"
+
+// 逻辑执行计划 只描述 from join where 部分(扫描，连接与过滤)，经过改写规则后再转换为物理算子
+// 改写规则: 常量折叠与条件化简，过滤条件下推到连接两侧与扫描，投影下推到扫描
+// 分组，排序，投影等后续部分没有可以改写的，依旧直接生成物理算子
+
+type IPlan interface {
+	GetAliases() []string // 输出包含的表
+}
+
+type ScanPlan struct { // 扫描表或派生表
+	Table   string
+	Alias   string
+	Derived *DerivedTableOperator // 不为空时是派生表
+	Fields  []string              // 上层需要的列 用于选择覆盖索引
+	Prune   bool                  // 是否裁剪为只输出 Fields 单表查询最后的投影就在扫描之上，不需要裁剪
+	Cond    *ExprNode             // 下推的过滤条件 只引用该表
+}
+
+func (s *ScanPlan) GetAliases() []string {
+	return []string{s.Alias}
+}
+
+type JoinPlan struct { // 左深树 右侧总是 ScanPlan
+	Left  IPlan
+	Right *ScanPlan
+	Type  string
+	Cond  *ExprNode
+}
+
+func (j *JoinPlan) GetAliases() []string {
+	return append(j.Left.GetAliases(), j.Right.Alias)
+}
+
+type FilterPlan struct { // 不能下推的条件
+	Input IPlan
+	Cond  *ExprNode
+}
+
+func (f *FilterPlan) GetAliases() []string {
+	return f.Input.GetAliases()
+}
+
+// 都是内连接时按 getJoinOrder 的顺序连接，连接条件放到所有引用的表都已连接的第一个连接上
+// 否则按书写顺序连接  where 条件放在最上面，由改写规则下推
+func (t *Transformer) buildPlan(node *SelectNode) IPlan {
+	scans := make(map[string]*ScanPlan)
+	order := []string{node.Alias}
+	scans[node.Alias] = &ScanPlan{Table: node.From, Alias: node.Alias, Derived: t.Derived[node.Alias]}
+	for _, join := range node.Joins {
+		order = append(order, join.Alias)
+		scans[join.Alias] = &ScanPlan{Table: join.Table, Alias: join.Alias, Derived: t.Derived[join.Alias]}
+	}
+	var res IPlan
+	if joinOrder := t.getJoinOrder(node); joinOrder != nil {
+		conds := make([]*ExprNode, 0)
+		for _, join := range node.Joins {
+			conds = append(conds, t.splitAnd(join.Condition)...)
+		}
+		joined := make(map[string]struct{})
+		for _, alias := range joinOrder {
+			joined[alias] = struct{}{}
+			if res == nil {
+				res = scans[alias]
+				continue
+			}
+			uses, rests := make([]*ExprNode, 0), make([]*ExprNode, 0)
+			for _, cond := range conds {
+				if t.isJoined(cond, joined) {
+					uses = append(uses, cond)
+				} else {
+					rests = append(rests, cond)
+				}
+			}
+			conds = rests
+			res = &JoinPlan{Left: res, Right: scans[alias], Type: INNER, Cond: t.joinAnd(uses)}
+		}
+	} else {
+		res = scans[node.Alias]
+		for _, join := range node.Joins {
+			res = &JoinPlan{Left: res, Right: scans[join.Alias], Type: join.Type, Cond: join.Condition}
+		}
+	}
+	if node.Where != nil {
+		res = &FilterPlan{Input: res, Cond: node.Where}
+	}
+	return res
+}
+
+// 条件引用的表是否都已连接
+func (t *Transformer) isJoined(cond *ExprNode, joined map[string]struct{}) bool {
+	for _, alias := range t.getCondAliases(cond) {
+		if _, ok := joined[alias]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// 条件引用的当前查询中的表 外层查询的列已经替换为参数了
+func (t *Transformer) getCondAliases(cond *ExprNode) []string {
+	res := make([]string, 0)
+	for _, field := range t.extraNodeField(cond) {
+		alias := field[:strings.IndexRune(field, '.')]
+		if _, ok := t.Tables[alias]; ok {
+			res = append(res, alias)
+		}
+	}
+	return DistinctSlice(res)
+}
+
+// 依次应用改写规则 fields 为整个查询用到的所有列
+func (t *Transformer) rewritePlan(plan IPlan, fields []string) IPlan {
+	plan = t.foldPlan(plan)
+	plan = t.pushDownFilter(plan, nil)
+	t.pushDownProjection(plan, fields, false)
+	return plan
+}
+
+//=========================常量折叠=========================
+
+func (t *Transformer) foldPlan(plan IPlan) IPlan {
+	switch target := plan.(type) {
+	case *FilterPlan:
+		target.Input = t.foldPlan(target.Input)
+		if target.Cond = t.foldCond(target.Cond); target.Cond == nil {
+			return target.Input
+		}
+	case *JoinPlan:
+		target.Left = t.foldPlan(target.Left)
+		target.Cond = t.foldCond(target.Cond)
+	case *ScanPlan:
+		target.Cond = t.foldCond(target.Cond)
+	}
+	return plan
+}
+
+// 对 AND 连接的每个条件折叠 恒为 TRUE 的移除，结果为 FALSE 或 NULL 的整个条件都不满足，没有条件返回 nil
+func (t *Transformer) foldCond(cond *ExprNode) *ExprNode {
+	res := make([]*ExprNode, 0)
+	for _, item := range t.splitAnd(cond) {
+		switch temp := t.foldConstant(item).(type) {
+		case *ExprNode:
+			res = append(res, t.foldSelfCompare(temp))
+		case *ImmNode:
+			if temp.Type != BOOL || temp.Value != TrueValue {
+				return &ExprNode{Left: &ImmNode{Value: TrueValue, Type: BOOL}, Operator: NOT}
+			}
+		}
+	}
+	return t.joinAnd(res)
+}
+
+// 列 = 列 只有 NULL 时不成立 改写为 列 IS NOT NULL
+// 结果为 NULL 与 FALSE 只有在顶层的 AND 条件中才等价，NOT 等表达式内部的不能改写
+func (t *Transformer) foldSelfCompare(cond *ExprNode) *ExprNode {
+	if cond.Operator != EQ && cond.Operator != GE && cond.Operator != LE {
+		return cond
+	}
+	id1, ok1 := cond.Left.(*IDNode)
+	id2, ok2 := cond.Right.(*IDNode)
+	if ok1 && ok2 && id1.Value == id2.Value {
+		return &ExprNode{Left: id1, Right: &ImmNode{Value: "NULL", Type: NULL}, Operator: ISNOT}
+	}
+	return cond
+}
+
+// 只引用常量的表达式直接计算出结果  AND OR 中的 TRUE FALSE 可以化简
+func (t *Transformer) foldConstant(node INode) INode {
+	switch target := node.(type) {
+	case *ListNode:
+		for i, item := range target.Items {
+			target.Items[i] = t.foldConstant(item)
+		}
+		return target
+	case *ExprNode:
+		if target.Operator == EXISTS {
+			return target
+		}
+		target.Left = t.foldConstant(target.Left)
+		if target.Right != nil {
+			target.Right = t.foldConstant(target.Right)
+		}
+		if t.isConstant(target) {
+			return t.evalConstant(target)
+		}
+		switch target.Operator {
+		case AND:
+			if t.isBool(target.Left, false) || t.isBool(target.Right, false) {
+				return &ImmNode{Value: FalseValue, Type: BOOL}
+			}
+			if t.isBool(target.Left, true) {
+				return target.Right
+			}
+			if t.isBool(target.Right, true) {
+				return target.Left
+			}
+		case OR:
+			if t.isBool(target.Left, true) || t.isBool(target.Right, true) {
+				return &ImmNode{Value: TrueValue, Type: BOOL}
+			}
+			if t.isBool(target.Left, false) {
+				return target.Right
+			}
+			if t.isBool(target.Right, false) {
+				return target.Left
+			}
+		}
+		return target
+	default:
+		return node
+	}
+}
+
+func (t *Transformer) isConstant(node INode) bool {
+	switch target := node.(type) {
+	case *ImmNode:
+		return true
+	case *ListNode:
+		for _, item := range target.Items {
+			if !t.isConstant(item) {
+				return false
+			}
+		}
+		return true
+	case *ExprNode:
+		return target.Operator != EXISTS && t.isConstant(target.Left) && (target.Right == nil || t.isConstant(target.Right))
+	default:
+		return false
+	}
+}
+
+func (t *Transformer) isBool(node INode, val bool) bool {
+	imm, ok := node.(*ImmNode)
+	return ok && imm.Type == BOOL && (imm.Value == TrueValue) == val
+}
+
+// 计算出错(例如类型不匹配)的不折叠 留到执行时再报错
+func (t *Transformer) evalConstant(expr *ExprNode) (res INode) {
+	defer func() {
+		if err := recover(); err != nil {
+			res = expr
+		}
+	}()
+	return ValueToImmNode(EvalExpr(t.typeConstant(expr).(*ExprNode), nil, nil))
+}
+
+// 字面量没有类型信息，两个字面量之间无法比较  复制一份把字面量替换为按 token 类型绑定好值的参数
+func (t *Transformer) typeConstant(node INode) INode {
+	switch target := node.(type) {
+	case *ImmNode:
+		typ := TokenTypeToType(target.Type)
+		val := &Value{Type: typ}
+		if target.Type == BOOL {
+			val.Data = target.Value == TrueValue
+		} else {
+			val.Data = ValueToAny(&Value{Value: target.Value}, typ)
+		}
+		return &ParamNode{Column: &Column{Name: GetNodeColumnName(target), Type: typ}, Value: val}
+	case *ListNode:
+		res := &ListNode{}
+		for _, item := range target.Items {
+			res.Items = append(res.Items, t.typeConstant(item))
+		}
+		return res
+	case *ExprNode:
+		res := &ExprNode{Left: t.typeConstant(target.Left), Right: target.Right, Operator: target.Operator}
+		if target.Right != nil && target.Operator != LIKE && target.Operator != NOTLIKE { // LIKE 的转义字符必须是字面量
+			res.Right = t.typeConstant(target.Right)
+		}
+		return res
+	default:
+		return node
+	}
+}
+
+//=========================条件下推=========================
+
+// conds 为上层下推过来的条件 尽量下推到扫描上，内连接引用两侧的条件合并到连接条件中
+// 外连接只能下推到保留的一侧，连接条件只引用补 NULL 一侧的可以下推到该侧
+func (t *Transformer) pushDownFilter(plan IPlan, conds []*ExprNode) IPlan {
+	switch target := plan.(type) {
+	case *FilterPlan:
+		return t.pushDownFilter(target.Input, append(conds, t.splitAnd(target.Cond)...))
+	case *ScanPlan:
+		target.Cond = t.joinAnd(append(t.splitAnd(target.Cond), conds...))
+		return target
+	case *JoinPlan:
+		leftAliases := t.getAliasSet(target.Left.GetAliases())
+		rightAliases := t.getAliasSet(target.Right.GetAliases())
+		lefts, rights, keeps, rests := make([]*ExprNode, 0), make([]*ExprNode, 0), make([]*ExprNode, 0), make([]*ExprNode, 0)
+		for _, cond := range t.splitAnd(target.Cond) {
+			switch side := t.getCondSide(cond, leftAliases, rightAliases); {
+			case side == LEFT && target.Type == INNER:
+				lefts = append(lefts, cond)
+			case side == RIGHT && (target.Type == INNER || target.Type == LEFT):
+				rights = append(rights, cond)
+			case side == LEFT && target.Type == RIGHT:
+				lefts = append(lefts, cond)
+			default:
+				keeps = append(keeps, cond)
+			}
+		}
+		for _, cond := range conds {
+			switch side := t.getCondSide(cond, leftAliases, rightAliases); {
+			case side == LEFT && (target.Type == INNER || target.Type == LEFT):
+				lefts = append(lefts, cond)
+			case side == RIGHT && (target.Type == INNER || target.Type == RIGHT):
+				rights = append(rights, cond)
+			case side == FULL && target.Type == INNER:
+				keeps = append(keeps, cond)
+			default:
+				rests = append(rests, cond)
+			}
+		}
+		target.Left = t.pushDownFilter(target.Left, lefts)
+		target.Right = t.pushDownFilter(target.Right, rights).(*ScanPlan)
+		target.Cond = t.joinAnd(keeps)
+		if len(rests) > 0 {
+			return &FilterPlan{Input: target, Cond: t.joinAnd(rests)}
+		}
+		return target
+	default:
+		return plan
+	}
+}
+
+func (t *Transformer) getAliasSet(aliases []string) map[string]struct{} {
+	res := make(map[string]struct{})
+	for _, alias := range aliases {
+		res[alias] = struct{}{}
+	}
+	return res
+}
+
+// 条件引用了哪一侧 只引用左侧 LEFT 只引用右侧 RIGHT 两侧都有 FULL 没有引用任何表返回空
+func (t *Transformer) getCondSide(cond *ExprNode, leftAliases map[string]struct{}, rightAliases map[string]struct{}) string {
+	hasLeft, hasRight := false, false
+	for _, alias := range t.getCondAliases(cond) {
+		if _, ok := leftAliases[alias]; ok {
+			hasLeft = true
+		} else if _, ok = rightAliases[alias]; ok {
+			hasRight = true
+		}
+	}
+	switch {
+	case hasLeft && hasRight:
+		return FULL
+	case hasLeft:
+		return LEFT
+	case hasRight:
+		return RIGHT
+	default:
+		return ""
+	}
+}
+
+//=========================投影下推=========================
+
+// 连接两侧的扫描只输出上层需要的列 减少连接时处理的数据 派生表已经是裁剪过的了
+func (t *Transformer) pushDownProjection(plan IPlan, fields []string, prune bool) {
+	switch target := plan.(type) {
+	case *FilterPlan:
+		t.pushDownProjection(target.Input, fields, prune)
+	case *JoinPlan:
+		t.pushDownProjection(target.Left, fields, true)
+		t.pushDownProjection(target.Right, fields, true)
+	case *ScanPlan:
+		if target.Derived == nil {
+			target.Fields = t.getTableFields(target.Alias, fields)
+			target.Prune = prune
+		}
+	}
+}
+
+//=========================生成物理算子=========================
+
+func (t *Transformer) lowerPlan(plan IPlan) IOperator {
+	switch target := plan.(type) {
+	case *FilterPlan:
+		return NewFilterOperator(t.lowerPlan(target.Input), target.Cond)
+	case *JoinPlan:
+		join := &JoinNode{Type: target.Type, Table: target.Right.Table, Alias: target.Right.Alias, Condition: target.Cond}
+		return t.transformJoin(t.lowerPlan(target.Left), t.lowerPlan(target.Right), join)
+	case *ScanPlan:
+		return t.lowerScan(target)
+	default:
+		panic("unknown plan")
+	}
+}
+
+// 扫描方式使用下推的条件选择  条件过滤后再裁剪列
+func (t *Transformer) lowerScan(scan *ScanPlan) IOperator {
+	if scan.Derived != nil {
+		if scan.Cond != nil {
+			return NewFilterOperator(scan.Derived, scan.Cond)
+		}
+		return scan.Derived
+	}
+	var res IOperator = t.scanTable(scan.Table, scan.Alias, scan.Fields, scan.Cond)
+	width := t.getScanWidth(res)
+	if scan.Cond != nil {
+		res = NewFilterOperator(res, scan.Cond)
+	}
+	if scan.Prune && len(scan.Fields) > 0 && len(scan.Fields) < width {
+		res = NewProjectionOperator(res, scan.Fields, make([]string, len(scan.Fields)))
+	}
+	return res
+}
+
+// 扫描输出的列数 索引扫描输出索引列与行号
+func (t *Transformer) getScanWidth(input IOperator) int {
+	switch target := input.(type) {
+	case *AliasOperator:
+		return t.getScanWidth(target.Input)
+	case *IndexScanOperator:
+		return len(GetIndex(target.Index).Columns) + 1
+	case *IndexLookupOperator:
+		return len(GetTable(target.Table).Columns)
+	case *TableScanOperator:
+		return len(GetTable(target.Table).Columns)
+	default:
+		return 0
+	}
+}
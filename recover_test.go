@@ -0,0 +1,291 @@
+/*
+@author: sk
+@date: 2024/10/20
+*/
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+)
+
+// 崩溃恢复测试 每个用例使用临时目录下的空数据目录
+// 不调用 storage.Close 直接重新加载，相当于进程在下一个检查点前异常退出，缓存池中的脏页都丢失了
+
+func newTestStorage(t *testing.T) *Storage {
+	wd, err := os.Getwd()
+	HandleErr(err)
+	HandleErr(os.Chdir(t.TempDir()))
+	t.Cleanup(func() {
+		HandleErr(os.Chdir(wd))
+	})
+	HandleErr(os.Mkdir(BasePath, 0755))
+	for _, name := range []string{CatalogTable, CatalogIndex, CatalogStat} {
+		HandleErr(os.WriteFile(path.Join(BasePath, name), []byte("[]"), 0644))
+	}
+	return openTestStorage(t)
+}
+
+func openTestStorage(t *testing.T) *Storage {
+	if err := CatchErr(LoadCatalog); err != nil {
+		t.Fatalf("load catalog: %v", err)
+	}
+	storage := NewStorage()
+	storage.TransactionManager = NewTransactionManager(storage)
+	return storage
+}
+
+func execTest(t *testing.T, storage *Storage, sql string) error {
+	return ExecSql(storage, sql, func(node INode, operator IOperator) {
+		for operator.Next() != nil {
+		}
+	})
+}
+
+func mustExecTest(t *testing.T, storage *Storage, sql string) {
+	if err := execTest(t, storage, sql); err != nil {
+		t.Fatalf("%s: %v", sql, err)
+	}
+}
+
+func queryTest(t *testing.T, storage *Storage, sql string) []string {
+	res := make([]string, 0)
+	err := ExecSql(storage, sql, func(node INode, operator IOperator) {
+		for row := operator.Next(); row != nil; row = operator.Next() {
+			res = append(res, fmt.Sprint(row))
+		}
+	})
+	if err != nil {
+		t.Fatalf("%s: %v", sql, err)
+	}
+	return res
+}
+
+func checkRows(t *testing.T, storage *Storage, sql string, want ...string) {
+	res := queryTest(t, storage, sql)
+	if fmt.Sprint(res) != fmt.Sprint(want) {
+		t.Fatalf("%s: got %v want %v", sql, res, want)
+	}
+}
+
+// 回滚的插入没有 REDO 记录，数据也可能没有落盘，回滚产生的 REDO 删除记录重做时需要跳过
+func TestRecoverAfterRollback(t *testing.T) {
+	storage := newTestStorage(t)
+	mustExecTest(t, storage, "create table cr(a int,b varchar(8))")
+	mustExecTest(t, storage, "insert into cr values(1,'a')")
+	txManager := storage.TransactionManager
+	txManager.Begin()
+	mustExecTest(t, storage, "insert into cr values(2,'b')")
+	mustExecTest(t, storage, "insert into cr values(3,'c')")
+	txManager.Rollback()
+	mustExecTest(t, storage, "insert into cr values(4,'d')")
+	storage = openTestStorage(t) // 崩溃
+	checkRows(t, storage, "select a, b from cr", "[1 a]", "[4 d]")
+	storage.Close()
+}
+
+// 自动提交的修改语句出错时整体回滚，崩溃后依旧可以正常启动
+func TestRecoverAfterFailedStatement(t *testing.T) {
+	storage := newTestStorage(t)
+	mustExecTest(t, storage, "create table cu(a int)")
+	mustExecTest(t, storage, "create unique index cu_a on cu(a)")
+	mustExecTest(t, storage, "insert into cu values(1)")
+	if err := execTest(t, storage, "insert into cu values(2),(1)"); err == nil {
+		t.Fatalf("duplicate key not reported")
+	}
+	checkRows(t, storage, "select a from cu", "[1]")
+	if _, err := os.Stat(path.Join(BasePath, UndoLog)); !os.IsNotExist(err) {
+		t.Fatalf("undo.log should not be written without flushing pages")
+	}
+	storage = openTestStorage(t) // 崩溃
+	checkRows(t, storage, "select a from cu", "[1]")
+	mustExecTest(t, storage, "insert into cu values(2)")
+	checkRows(t, storage, "select a from cu", "[1]", "[2]")
+	storage.Close()
+}
+
+// 事务中的语句出错只回滚这条语句，提交后崩溃其余修改依旧存在
+func TestRecoverAfterStatementRollback(t *testing.T) {
+	storage := newTestStorage(t)
+	mustExecTest(t, storage, "create table cs(a int,b varchar(8))")
+	mustExecTest(t, storage, "create unique index cs_a on cs(a)")
+	mustExecTest(t, storage, "insert into cs values(1,'a'),(2,'b')")
+	txManager := storage.TransactionManager
+	txManager.Begin()
+	mustExecTest(t, storage, "insert into cs values(3,'c')")
+	if err := execTest(t, storage, "update cs set a = 1 where a = 2"); err == nil {
+		t.Fatalf("duplicate key not reported")
+	}
+	mustExecTest(t, storage, "delete from cs where a = 1")
+	txManager.Commit()
+	storage = openTestStorage(t) // 崩溃
+	checkRows(t, storage, "select a, b from cs", "[2 b]", "[3 c]")
+	storage.Close()
+}
+
+// 事务没有提交就崩溃 启动时按 undo.log 回滚
+func TestRecoverUncommitted(t *testing.T) {
+	storage := newTestStorage(t)
+	mustExecTest(t, storage, "create table cx(a int)")
+	mustExecTest(t, storage, "insert into cx values(1)")
+	storage.TransactionManager.Begin()
+	mustExecTest(t, storage, "insert into cx values(2)")
+	mustExecTest(t, storage, "delete from cx where a = 1")
+	storage.Sync("cx")           // 未提交的数据也可能被写入磁盘
+	storage = openTestStorage(t) // 崩溃
+	checkRows(t, storage, "select a from cx", "[1]")
+	storage.Close()
+}
+
+func checkNoTempFiles(t *testing.T) {
+	files, err := filepath.Glob(path.Join(BasePath, "*.tmp"))
+	HandleErr(err)
+	if len(files) > 0 {
+		t.Fatalf("temp files left: %v", files)
+	}
+}
+
+// 修改列类型时数据转换失败 原来的数据与元数据不变 临时文件被删除
+func TestAlterConvertFailed(t *testing.T) {
+	storage := newTestStorage(t)
+	mustExecTest(t, storage, "create table ca(a int,b varchar(8))")
+	mustExecTest(t, storage, "create index ca_a on ca(a)")
+	mustExecTest(t, storage, "insert into ca values(1,'x'),(2,'y')")
+	if err := execTest(t, storage, "alter table ca modify column b int"); err == nil {
+		t.Fatalf("convert error not reported")
+	}
+	checkNoTempFiles(t)
+	if err := execTest(t, storage, "alter table ca drop column a"); err != nil {
+		t.Fatalf("drop column: %v", err)
+	}
+	checkRows(t, storage, "select b from ca", "[x]", "[y]")
+	storage.Close()
+	storage = openTestStorage(t)
+	checkRows(t, storage, "select b from ca", "[x]", "[y]")
+	if err := CatchErr(func() { GetIndex("ca_a") }); err == nil {
+		t.Fatalf("index ca_a should be dropped")
+	}
+	storage.Close()
+}
+
+// 临时文件都写好但还没有写入 alter.log 时崩溃 启动时丢弃临时文件
+func TestRecoverAlterUncommitted(t *testing.T) {
+	storage := newTestStorage(t)
+	mustExecTest(t, storage, "create table cb(a int)")
+	mustExecTest(t, storage, "insert into cb values(1),(2)")
+	storage.TransactionManager.BeforeDDL()
+	columns := []*Column{GetTable("cb").Columns[0], {Name: "cb.b", Type: TypInt, Len: 8, Nullable: true}}
+	storage.RewriteTable("cb", columns, func(data []any) []any {
+		return append(data, nil)
+	}, nil)
+	SaveCatalogTemp(&Table{Name: "cb", Columns: columns}, nil)
+	storage = openTestStorage(t) // 崩溃
+	checkNoTempFiles(t)
+	checkRows(t, storage, "select * from cb", "[1]", "[2]")
+	storage.Close()
+}
+
+// alter.log 写入后崩溃 启动时继续替换文件并重建索引
+func TestRecoverAlterCommitted(t *testing.T) {
+	storage := newTestStorage(t)
+	mustExecTest(t, storage, "create table cc(a int)")
+	mustExecTest(t, storage, "create index cc_a on cc(a)")
+	mustExecTest(t, storage, "insert into cc values(1),(2)")
+	mustExecTest(t, storage, "delete from cc where a = 1")
+	storage.TransactionManager.BeforeDDL()
+	columns := []*Column{GetTable("cc").Columns[0], {Name: "cc.b", Type: TypInt, Len: 8, Nullable: true}}
+	storage.RewriteTable("cc", columns, func(data []any) []any {
+		return append(data, int64(3))
+	}, ListIndexes("cc"))
+	SaveCatalogTemp(&Table{Name: "cc", Columns: columns}, ListIndexes("cc"))
+	WriteFileAtomic(path.Join(BasePath, AlterLog), []byte(`{"Table":"cc","Rewrite":true}`))
+	storage = openTestStorage(t) // 崩溃
+	checkNoTempFiles(t)
+	if _, err := os.Stat(path.Join(BasePath, AlterLog)); !os.IsNotExist(err) {
+		t.Fatalf("alter.log should be removed")
+	}
+	checkRows(t, storage, "select a, b from cc", "[2 3]")
+	checkRows(t, storage, "select a, b from cc where a = 2", "[2 3]")
+	storage.Close()
+}
+
+// 删除列后唯一索引的列变少出现重复 提交前就报错，表结构与数据都不变
+func TestAlterDropUniqueDuplicate(t *testing.T) {
+	storage := newTestStorage(t)
+	mustExecTest(t, storage, "create table au(id int,name varchar(8))")
+	mustExecTest(t, storage, "create unique index au_u on au(id,name)")
+	mustExecTest(t, storage, "insert into au values(1,'a'),(2,'a')")
+	if err := execTest(t, storage, "alter table au drop column id"); err == nil {
+		t.Fatalf("duplicate key not reported")
+	}
+	checkNoTempFiles(t)
+	if _, err := os.Stat(path.Join(BasePath, AlterLog)); !os.IsNotExist(err) {
+		t.Fatalf("alter.log should not be written")
+	}
+	checkRows(t, storage, "select * from au", "[1 a]", "[2 a]")
+	storage = openTestStorage(t) // 崩溃
+	checkRows(t, storage, "select * from au", "[1 a]", "[2 a]")
+	checkRows(t, storage, "select name from au where id = 2 and name = 'a'", "[a]")
+	storage.Close()
+}
+
+// 存量数据不满足唯一索引时建索引失败 不留下建了一半的索引
+func TestCreateUniqueIndexFailed(t *testing.T) {
+	storage := newTestStorage(t)
+	mustExecTest(t, storage, "create table ci(id int,name varchar(8))")
+	mustExecTest(t, storage, "insert into ci values(1,'a'),(1,'b'),(2,'c')")
+	if err := execTest(t, storage, "create unique index ci_id on ci(id)"); err == nil {
+		t.Fatalf("duplicate key not reported")
+	}
+	if _, err := os.Stat(path.Join(BasePath, "ci_id."+ExtIdx)); !os.IsNotExist(err) {
+		t.Fatalf("index file should be removed")
+	}
+	checkRows(t, storage, "select name from ci where id = 1", "[a]", "[b]")
+	mustExecTest(t, storage, "create index ci_id on ci(id)")
+	checkRows(t, storage, "select name from ci where id = 1", "[a]", "[b]")
+	storage.Close()
+	storage = openTestStorage(t)
+	checkRows(t, storage, "select name from ci where id = 1", "[a]", "[b]")
+	storage.Close()
+}
+
+// 唯一索引中 NULL 可以重复 非 NULL 的值依旧不能重复
+func TestUniqueIndexNull(t *testing.T) {
+	storage := newTestStorage(t)
+	mustExecTest(t, storage, "create table cn(id int,name varchar(8))")
+	mustExecTest(t, storage, "create unique index cn_name on cn(name)")
+	mustExecTest(t, storage, "insert into cn values(1,null),(2,null),(3,'a')")
+	if err := execTest(t, storage, "insert into cn values(4,'a')"); err == nil {
+		t.Fatalf("duplicate key not reported")
+	}
+	checkRows(t, storage, "select id from cn where name = 'a'", "[3]")
+	checkRows(t, storage, "select id from cn where name is null", "[1]", "[2]")
+	mustExecTest(t, storage, "drop index cn_name on cn")
+	mustExecTest(t, storage, "insert into cn values(5,null)")
+	mustExecTest(t, storage, "create unique index cn_name on cn(name)")
+	storage.Close()
+}
+
+// 检查点之后索引只有部分页被写入(例如节点分裂写了一半)就崩溃 启动时根据数据重建索引
+func TestRecoverPartialIndexPages(t *testing.T) {
+	storage := newTestStorage(t)
+	mustExecTest(t, storage, "create table cp(a int,b varchar(64))")
+	mustExecTest(t, storage, "create index cp_a on cp(a)")
+	storage.TransactionManager.Checkpoint()
+	for i := 0; i < 300; i++ {
+		mustExecTest(t, storage, fmt.Sprintf("insert into cp values(%d,'%064d')", i, i))
+	}
+	file := storage.OpenIndex("cp_a").File
+	for key, page := range storage.Pool.Pages {
+		if key.File == file && key.Offset/PageSize%2 == 0 { // 只写入一部分页
+			storage.Pool.FlushPage(page)
+		}
+	}
+	storage = openTestStorage(t) // 崩溃
+	checkRows(t, storage, "select count(*) from cp where a >= 0", "[300]")
+	checkRows(t, storage, "select b from cp where a = 299", fmt.Sprintf("[%064d]", 299))
+	storage.Close()
+}
@@ -0,0 +1,204 @@
+/*
+@author: sk
+@date: 2024/9/14
+*/
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path"
+)
+
+// redo.log 前 8byte 为文件头，记录文件中第一条记录的 LSN  LSN 即记录在整个日志流中的字节偏移，单调递增
+// 每条记录 记录长度(uint32) LSN(int64) 类型(uint8) 表名长度(uint8) 表名 偏移(int64) 数据(剩余部分)
+// 事务中的修改先缓存在内存，提交时与提交记录一起顺序写入并落盘，不在事务中的修改每次都直接写入
+// 数据文件与索引只在检查点时落盘，检查点记录之前的修改都已经在数据文件中了，恢复时只需要重做最后一个检查点之后已提交的记录
+// 所有重做操作都是幂等的(按偏移覆盖写入，标记删除/恢复)，重复执行不会有问题
+
+const (
+	RedoTxt        = 1 // 写入不定长文本 Offset 为 .str 中的偏移 Data 为长度+内容
+	RedoInsert     = 2 // 写入一条记录 Offset 为 .dat 中的偏移 Data 为删除标记+数据
+	RedoDelete     = 3 // 标记删除一条记录
+	RedoRestore    = 4 // 恢复一条被标记删除的记录
+	RedoCommit     = 5 // 提交记录，只有后面跟着提交记录的修改才需要重做
+	RedoCheckpoint = 6 // 检查点记录，之前的修改都已落盘
+)
+
+const (
+	RedoHeaderSize = 8
+	CheckpointSize = 1024 * 1024     // 距离上次检查点写入了这么多日志就做一次检查点
+	MaxRedoSize    = 8 * 1024 * 1024 // 检查点时日志超过该大小就截断
+)
+
+type RedoRecord struct {
+	Lsn    int64
+	Type   int8
+	Table  string
+	Offset int64
+	Data   []byte
+}
+
+type RedoLogger struct {
+	File          *os.File
+	BaseLsn       int64 // 文件中第一条记录的 LSN
+	NextLsn       int64
+	CheckpointLsn int64         // 最后一个检查点的 LSN
+	Records       []*RedoRecord // 还未写入的记录
+}
+
+func NewRedoLogger() *RedoLogger {
+	file := OpenOrCreate(path.Join(BasePath, RedoLog))
+	size, err := file.Seek(0, 2)
+	HandleErr(err)
+	if size < RedoHeaderSize { // 新文件写入文件头
+		_, err = file.WriteAt(Int64ToByte(0), 0)
+		HandleErr(err)
+		size = RedoHeaderSize
+	}
+	bs := make([]byte, RedoHeaderSize)
+	_, err = file.ReadAt(bs, 0)
+	HandleErr(err)
+	baseLsn := ByteToInt64(bs)
+	nextLsn := baseLsn + size - RedoHeaderSize
+	return &RedoLogger{File: file, BaseLsn: baseLsn, NextLsn: nextLsn, CheckpointLsn: baseLsn}
+}
+
+func (l *RedoLogger) AddRecord(record *RedoRecord) {
+	l.Records = append(l.Records, record)
+}
+
+// 丢弃还未写入的记录，事务回滚时使用
+func (l *RedoLogger) Discard() {
+	l.Records = nil
+}
+
+// 追加提交记录后把缓存的记录全部写入并落盘 返回是否需要做检查点
+func (l *RedoLogger) Commit() bool {
+	if len(l.Records) == 0 {
+		return false
+	}
+	l.Records = append(l.Records, &RedoRecord{Type: RedoCommit})
+	l.Write(l.Records)
+	l.Records = nil
+	return l.NextLsn-l.CheckpointLsn > CheckpointSize
+}
+
+func (l *RedoLogger) Write(records []*RedoRecord) {
+	buff := &bytes.Buffer{}
+	for _, record := range records {
+		record.Lsn = l.NextLsn + int64(buff.Len())
+		buff.Write(MarshalRedoRecord(record))
+	}
+	_, err := l.File.WriteAt(buff.Bytes(), l.NextLsn-l.BaseLsn+RedoHeaderSize)
+	HandleErr(err)
+	HandleErr(l.File.Sync())
+	l.NextLsn += int64(buff.Len())
+}
+
+// 调用前需要保证所有数据都已经落盘
+func (l *RedoLogger) Checkpoint() {
+	l.CheckpointLsn = l.NextLsn
+	if l.NextLsn-l.BaseLsn < MaxRedoSize {
+		l.Write([]*RedoRecord{{Type: RedoCheckpoint}})
+		return
+	} // 日志太大了，之前的记录都不再需要了直接截断
+	l.BaseLsn = l.NextLsn
+	_, err := l.File.WriteAt(Int64ToByte(l.BaseLsn), 0)
+	HandleErr(err)
+	HandleErr(l.File.Truncate(RedoHeaderSize))
+	HandleErr(l.File.Sync())
+}
+
+func (l *RedoLogger) Close() {
+	HandleErr(l.File.Close())
+}
+
+// 读取最后一个检查点之后的所有已提交记录(不包含提交记录本身)
+func (l *RedoLogger) ReadCommitted() []*RedoRecord {
+	size := l.NextLsn - l.BaseLsn
+	bs := make([]byte, size)
+	_, err := l.File.ReadAt(bs, RedoHeaderSize)
+	HandleErr(err)
+	res := make([]*RedoRecord, 0)
+	pending := make([]*RedoRecord, 0)
+	for len(bs) > 0 {
+		record, n := UnmarshalRedoRecord(bs)
+		if record == nil { // 写了一半的记录，后面的都不要了
+			break
+		}
+		bs = bs[n:]
+		switch record.Type {
+		case RedoCheckpoint:
+			res = res[:0]
+			pending = pending[:0]
+			l.CheckpointLsn = record.Lsn
+		case RedoCommit:
+			res = append(res, pending...)
+			pending = pending[:0]
+		default:
+			pending = append(pending, record)
+		}
+	}
+	return res
+}
+
+func MarshalRedoRecord(record *RedoRecord) []byte {
+	buff := &bytes.Buffer{}
+	buff.Write(Int64ToByte(record.Lsn))
+	buff.WriteByte(byte(record.Type))
+	buff.WriteByte(byte(len(record.Table)))
+	buff.WriteString(record.Table)
+	buff.Write(Int64ToByte(record.Offset))
+	buff.Write(record.Data)
+	bs := make([]byte, 4)
+	binary.LittleEndian.PutUint32(bs, uint32(buff.Len()))
+	return append(bs, buff.Bytes()...)
+}
+
+// 返回解析出的记录与消耗的字节数 数据不完整返回 nil
+func UnmarshalRedoRecord(bs []byte) (*RedoRecord, int) {
+	if len(bs) < 4 {
+		return nil, 0
+	}
+	l := int(binary.LittleEndian.Uint32(bs))
+	if l < 8+1+1+8 || len(bs) < 4+l {
+		return nil, 0
+	}
+	bs = bs[4 : 4+l]
+	tableLen := int(bs[9])
+	idx := 10 + tableLen
+	return &RedoRecord{
+		Lsn:    ByteToInt64(bs[:8]),
+		Type:   int8(bs[8]),
+		Table:  string(bs[10:idx]),
+		Offset: ByteToInt64(bs[idx : idx+8]),
+		Data:   CloneSlice(bs[idx+8:]),
+	}, 4 + l
+}
+
+// 启动时重做最后一个检查点之后已提交的修改，之后再由 undo.log 回滚未提交的事务
+// 返回是否重做了修改
+func RecoverRedoLog(storage *Storage) bool {
+	records := storage.TransactionManager.RedoLogger.ReadCommitted()
+	for _, record := range records {
+		switch record.Type {
+		case RedoTxt:
+			storage.ReplayTxt(record.Table, record.Offset, record.Data)
+		case RedoInsert:
+			storage.ReplayInsert(record.Table, record.Offset, record.Data)
+		case RedoDelete:
+			storage.ReplayDelete(record.Table, record.Offset)
+		case RedoRestore:
+			storage.RevertDelete(record.Table, record.Offset)
+		default:
+			panic(fmt.Sprintf("invalid redo record type %d", record.Type))
+		}
+	}
+	if len(records) > 0 {
+		storage.TransactionManager.Checkpoint()
+	}
+	return len(records) > 0
+}
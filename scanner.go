@@ -33,6 +33,17 @@ func (s *Scanner) ScanToken() *Token {
 		return NewToken(RPAREN, ")")
 	case '=':
 		return NewToken(EQ, "=")
+	case '+':
+		return NewToken(PLUS, "+")
+	case '-':
+		return NewToken(MINUS, "-")
+	case '/':
+		return NewToken(SLASH, "/")
+	case '%':
+		return NewToken(PERCENT, "%")
+	case '|':
+		s.MustMatch('|')
+		return NewToken(CONCAT, "||")
 	case '!':
 		s.MustMatch('=')
 		return NewToken(NE, "!=")
@@ -48,9 +59,12 @@ func (s *Scanner) ScanToken() *Token {
 		return NewToken(LT, "<")
 	case '\'': // STR
 		l := s.Idx
-		for s.Sql[s.Idx] != '\'' {
+		for s.HasMore() && s.Sql[s.Idx] != '\'' {
 			s.Idx++
 		}
+		if !s.HasMore() {
+			panic(&SyntaxError{Pos: l - 1, Msg: "unterminated string"})
+		}
 		r := s.Idx
 		s.Idx++
 		return NewToken(STR, s.Sql[l:r])
@@ -86,7 +100,7 @@ func (s *Scanner) ScanToken() *Token {
 			}
 			return NewToken(ID, val)
 		} else {
-			panic(fmt.Sprintf("unknown token type: %c", ch))
+			panic(&SyntaxError{Pos: l, Msg: fmt.Sprintf("unknown token %c", ch)})
 		}
 	}
 }
@@ -94,11 +108,15 @@ func (s *Scanner) ScanToken() *Token {
 func (s *Scanner) ScanTokens() []*Token {
 	tokens := make([]*Token, 0)
 	for s.HasMore() {
+		pos := s.Idx
 		if token := s.ScanToken(); token != nil {
+			token.Pos = pos
 			tokens = append(tokens, token)
 		}
 	}
-	tokens = append(tokens, NewToken(EOF, ""))
+	eof := NewToken(EOF, "")
+	eof.Pos = len(s.Sql)
+	tokens = append(tokens, eof)
 	return tokens
 }
 
@@ -109,14 +127,13 @@ func (s *Scanner) Read() byte {
 }
 
 func (s *Scanner) MustMatch(val byte) {
-	res := s.Read()
-	if res != val {
-		panic(fmt.Sprintf("invalid token need %c get %c", val, res))
+	if !s.Match(val) {
+		panic(&SyntaxError{Pos: s.Idx, Msg: fmt.Sprintf("need %c", val)})
 	}
 }
 
 func (s *Scanner) Match(val byte) bool {
-	if s.Sql[s.Idx] == val {
+	if s.HasMore() && s.Sql[s.Idx] == val {
 		s.Idx++
 		return true
 	}
@@ -0,0 +1,375 @@
+/*
+@author: sk
+@date: 2024/9/8
+*/
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// 服务端实现 driver.go 中客户端对应的协议部分，这样 mysql 客户端与 Driver 都可以直接连接到该引擎
+// 握手 Greeting -> HandshakeResponse41 -> AuthMoreData(快速认证成功) -> OK
+// 查询 COM_QUERY -> 列数目 -> 列定义 -> EOF -> 文本行 -> EOF  非查询语句返回 OK  出错返回 ERR
+
+const (
+	ServerVersion  = "8.0.0-my_sql"
+	ServerCharset  = 33 // utf8_general_ci
+	BinaryCharset  = 63 // 数字类型使用
+	ServerFeatures = FeatLongPassword | FeatFoundRows | FeatLongFlag | FeatConnectWithDb | FeatProtocol41 |
+		FeatTransactions | FeatSecureConn | FeatPluginAuth | FeatPluginAuthData
+)
+
+const (
+	ErrAccessDenied = 1045
+	ErrUnknownCmd   = 1047
+	ErrQuery        = 1105 // ER_UNKNOWN_ERROR 暂时所有执行错误都使用这个
+)
+
+type Server struct {
+	Addr               string
+	User               string
+	Passwd             string
+	Storage            *Storage
+	TransactionManager *TransactionManager
+	Lock               sync.Mutex // 引擎本身不支持并发，所有连接的语句串行执行
+	TxOwner            *Session   // 事务是引擎全局的，同一时间只能有一个连接开启事务
+	TxDone             *sync.Cond // 事务结束时唤醒等待的连接
+	ConnId             uint32
+	Listener           net.Listener
+}
+
+func NewServer(addr string, user string, passwd string, storage *Storage) *Server {
+	res := &Server{Addr: addr, User: user, Passwd: passwd, Storage: storage, TransactionManager: storage.TransactionManager}
+	res.TxDone = sync.NewCond(&res.Lock)
+	return res
+}
+
+func (s *Server) Listen() {
+	var err error
+	s.Listener, err = net.Listen("tcp", s.Addr)
+	HandleErr(err)
+	for {
+		conn, err := s.Listener.Accept()
+		if err != nil { // 关闭监听后退出
+			return
+		}
+		session := NewSession(s, conn, atomic.AddUint32(&s.ConnId, 1))
+		go session.Serve()
+	}
+}
+
+func (s *Server) Close() {
+	if s.Listener != nil {
+		HandleErr(s.Listener.Close())
+	}
+}
+
+// Session 对应一个客户端连接
+type Session struct {
+	Server     *Server
+	Conn       net.Conn
+	ConnId     uint32
+	EncryptKey []byte
+	DB         string
+	Num        uint8 // 单个通讯过程需要不断累加
+}
+
+func NewSession(server *Server, conn net.Conn, connId uint32) *Session {
+	encryptKey := make([]byte, 20)
+	for i := 0; i < len(encryptKey); i++ { // 盐值不能包含 0x00
+		encryptKey[i] = byte(rand.Intn(127) + 1)
+	}
+	return &Session{Server: server, Conn: conn, ConnId: connId, EncryptKey: encryptKey}
+}
+
+func (s *Session) Serve() {
+	defer func() {
+		if err := recover(); err != nil && err != io.EOF { // 连接异常直接断开，不影响其他连接
+			fmt.Printf("conn %d closed: %v\n", s.ConnId, err)
+		}
+		s.Close()
+	}()
+	if !s.HandleHandshake() {
+		return
+	}
+	for {
+		pkg := ReadPackage(s.Conn)
+		s.Num = pkg.Num
+		cmd := ReadU8(pkg)
+		switch cmd {
+		case CmdQuit:
+			return
+		case CmdPing, CmdInitDB: // 只有一个库，切换库直接返回成功
+			s.WriteOk(0)
+		case CmdQuery:
+			s.HandleQuery(string(pkg.Data[1:]))
+		default:
+			s.WriteErr(ErrUnknownCmd, fmt.Sprintf("unknown command: 0x%x", cmd))
+		}
+	}
+}
+
+func (s *Session) Close() {
+	s.Server.Lock.Lock()
+	if s.Server.TxOwner == s { // 连接断开时还有未提交的事务，直接回滚
+		CatchErr(s.Server.TransactionManager.Rollback)
+		s.endTx()
+	}
+	s.Server.Lock.Unlock()
+	s.Conn.Close() // 连接可能已经被对端关闭了，忽略错误
+}
+
+func (s *Session) HandleHandshake() bool {
+	s.WriteGreeting()
+	pkg := ReadPackage(s.Conn)
+	s.Num = pkg.Num
+	flags := ReadU32(pkg)
+	ReadU32(pkg) // 最大包大小
+	ReadU8(pkg)  // 字符集
+	ReadBytes(pkg, 23)
+	user := ReadCStr(pkg)
+	var authData []byte
+	if flags&FeatPluginAuthData != 0 {
+		authData = ReadBytes(pkg, uint32(ReadLenEnc(pkg)))
+	} else if flags&FeatSecureConn != 0 {
+		authData = ReadBytes(pkg, uint32(ReadU8(pkg)))
+	} else {
+		authData = []byte(ReadCStr(pkg))
+	}
+	if flags&FeatConnectWithDb != 0 {
+		s.DB = ReadCStr(pkg)
+	}
+	plugin := AuthPlugin
+	if flags&FeatPluginAuth != 0 {
+		plugin = ReadCStr(pkg)
+	}
+	if plugin != AuthPlugin { // 客户端使用了其他认证方式，要求切换到 caching_sha2_password
+		authData = s.HandleAuthSwitch()
+	}
+	if user != s.Server.User || !checkPasswd(s.Server.Passwd, s.EncryptKey, authData) {
+		s.WriteErr(ErrAccessDenied, fmt.Sprintf("Access denied for user '%s'", user))
+		return false
+	}
+	// 快速认证成功 后面跟一个 OK 包
+	s.WritePackage([]byte{PkgAuthMore, 0x03})
+	s.WriteOk(0)
+	return true
+}
+
+func (s *Session) WriteGreeting() {
+	buff := &bytes.Buffer{}
+	WriteU8(buff, 10) // 协议版本
+	WriteCStr(buff, ServerVersion)
+	WriteU32(buff, s.ConnId)
+	WriteBytes(buff, s.EncryptKey[:8]) // 部分盐值
+	WriteU8(buff, 0)
+	WriteU16(buff, uint16(ServerFeatures&0xFFFF)) // 低 2 位
+	WriteU8(buff, ServerCharset)
+	WriteU16(buff, s.GetStatus())
+	WriteU16(buff, uint16(ServerFeatures>>16)) // 高 2 位
+	WriteU8(buff, uint8(len(s.EncryptKey)+1))
+	WriteBytes(buff, make([]byte, 10))
+	WriteBytes(buff, s.EncryptKey[8:]) // 剩余盐值
+	WriteU8(buff, 0)
+	WriteCStr(buff, AuthPlugin)
+	s.Num = 0 // 握手包从 0 开始
+	WritePackage(s.Conn, &Package{Len: uint32(buff.Len()), Num: s.Num, Data: buff.Bytes()})
+}
+
+func (s *Session) HandleAuthSwitch() []byte {
+	buff := &bytes.Buffer{}
+	WriteU8(buff, PkgEof)
+	WriteCStr(buff, AuthPlugin)
+	WriteBytes(buff, s.EncryptKey)
+	WriteU8(buff, 0)
+	s.WritePackage(buff.Bytes())
+	pkg := ReadPackage(s.Conn)
+	s.Num = pkg.Num
+	return pkg.Data
+}
+
+func checkPasswd(passwd string, encryptKey []byte, authData []byte) bool {
+	if len(passwd) == 0 {
+		return len(authData) == 0
+	} // 加密过程是确定的，直接按相同方式加密对比即可
+	return bytes.Equal(encryptPasswd(passwd, encryptKey), authData)
+}
+
+func (s *Session) HandleQuery(sql string) {
+	s.Server.Lock.Lock()
+	defer s.Server.Lock.Unlock()
+	// 其他连接的事务还没有结束时等待，不能加入别人的事务，也不能提交或回滚别人的事务
+	for s.Server.TxOwner != nil && s.Server.TxOwner != s {
+		s.Server.TxDone.Wait()
+	}
+	sql = strings.TrimRight(strings.TrimSpace(sql), "; \t\r\n")
+	txManager := s.Server.TransactionManager
+	var err error
+	switch strings.ToUpper(sql) { // 对于输入内容需要先过指令，不满足任何指令才进行sql解析执行
+	case CmdBegin:
+		if err = CatchErr(txManager.Begin); err == nil {
+			s.Server.TxOwner = s
+			s.WriteOk(0)
+		}
+	case CmdCommit:
+		if err = CatchErr(txManager.Commit); err == nil {
+			s.WriteOk(0)
+		}
+	case CmdRollback:
+		if err = CatchErr(txManager.Rollback); err == nil {
+			s.WriteOk(0)
+		}
+	default:
+		affected := int64(-1)
+		err = ExecSql(s.Server.Storage, sql, func(node INode, operator IOperator) {
+			switch node.(type) {
+			case *SelectNode, *SetOpNode, *ExplainNode:
+				s.WriteResultSet(operator)
+			default: // 非查询语句只有一行一列 影响的行数 提交成功后再返回
+				affected = operator.Next()[0].(int64)
+			}
+		})
+		if err == nil && affected >= 0 {
+			s.WriteOk(uint64(affected))
+		}
+	}
+	if s.Server.TxOwner == s && !txManager.InTransaction { // 提交 回滚 或提交出错事务都结束了
+		s.endTx()
+	}
+	if err != nil { // 单条语句出错仅返回 ERR 包，连接继续可用
+		s.WriteErr(ErrCode(err), err.Error())
+	}
+}
+
+// 需要持有 Server.Lock 调用
+func (s *Session) endTx() {
+	s.Server.TxOwner = nil
+	s.Server.TxDone.Broadcast()
+}
+
+func (s *Session) WriteResultSet(operator IOperator) {
+	// 先把数据全部拿到，防止写到一半出错无法再返回 ERR 包
+	columns := operator.GetColumns()
+	data := make([][]any, 0)
+	for {
+		res := operator.Next()
+		if res == nil {
+			break
+		}
+		data = append(data, res)
+	}
+	buff := &bytes.Buffer{}
+	WriteLenEnc(buff, uint64(len(columns)))
+	s.WritePackage(buff.Bytes())
+	for _, column := range columns {
+		s.WritePackage(s.GenColumnDef(column))
+	}
+	s.WriteEof()
+	for _, row := range data {
+		buff = &bytes.Buffer{}
+		for _, item := range row {
+			if item == nil {
+				WriteU8(buff, PkgNull)
+			} else {
+				WriteLenEncStr(buff, FormatData(item))
+			}
+		}
+		s.WritePackage(buff.Bytes())
+	}
+	s.WriteEof()
+}
+
+func (s *Session) GenColumnDef(column *Column) []byte {
+	table := ""
+	name := column.Name
+	if idx := strings.IndexRune(name, '.'); idx >= 0 { // 内部列名都是 表名.列名
+		table = name[:idx]
+		name = name[idx+1:]
+	}
+	var typ uint8
+	var charset uint16
+	var l uint32
+	var decimals uint8
+	switch column.Type {
+	case TypInt, TypBool:
+		typ, charset, l = ColumnLongLong, BinaryCharset, 20
+	case TypFloat:
+		typ, charset, l, decimals = ColumnDouble, BinaryCharset, 22, 0x1F
+	default:
+		typ, charset, l = ColumnVarChar, ServerCharset, uint32(column.Len)
+	}
+	buff := &bytes.Buffer{}
+	WriteLenEncStr(buff, "def")
+	WriteLenEncStr(buff, s.DB)
+	WriteLenEncStr(buff, table)
+	WriteLenEncStr(buff, table)
+	WriteLenEncStr(buff, name)
+	WriteLenEncStr(buff, name)
+	WriteLenEnc(buff, 0x0C) // 后面固定长度字段的长度
+	WriteU16(buff, charset)
+	WriteU32(buff, l)
+	WriteU8(buff, typ)
+	WriteU16(buff, 0) // flags
+	WriteU8(buff, decimals)
+	WriteU16(buff, 0)
+	return buff.Bytes()
+}
+
+func (s *Session) GetStatus() uint16 {
+	if s.Server.TxOwner == s && s.Server.TransactionManager.InTransaction {
+		return StatusInTrans
+	}
+	return StatusAutocommit
+}
+
+func (s *Session) WriteOk(affectedRows uint64) {
+	buff := &bytes.Buffer{}
+	WriteU8(buff, PkgOk)
+	WriteLenEnc(buff, affectedRows)
+	WriteLenEnc(buff, 0) // last insert id
+	WriteU16(buff, s.GetStatus())
+	WriteU16(buff, 0) // warnings
+	s.WritePackage(buff.Bytes())
+}
+
+func (s *Session) WriteEof() {
+	buff := &bytes.Buffer{}
+	WriteU8(buff, PkgEof)
+	WriteU16(buff, 0) // warnings
+	WriteU16(buff, s.GetStatus())
+	s.WritePackage(buff.Bytes())
+}
+
+func (s *Session) WriteErr(code uint16, msg string) {
+	buff := &bytes.Buffer{}
+	WriteU8(buff, PkgErr)
+	WriteU16(buff, code)
+	WriteBytes(buff, []byte("#HY000"))
+	WriteBytes(buff, []byte(msg))
+	s.WritePackage(buff.Bytes())
+}
+
+func (s *Session) WritePackage(data []byte) {
+	s.Num++ // 回包序号需要在请求包的基础上累加
+	WritePackage(s.Conn, &Package{Len: uint32(len(data)), Num: s.Num, Data: data})
+}
+
+func FormatData(data any) string {
+	switch temp := data.(type) {
+	case bool:
+		if temp {
+			return "1"
+		}
+		return "0"
+	default:
+		return fmt.Sprintf("%v", data)
+	}
+}
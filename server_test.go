@@ -0,0 +1,62 @@
+/*
+@author: sk
+@date: 2024/10/21
+*/
+package main
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+// 连接测试服务 服务启动前连接会失败，重试几次
+func connectTestServer(t *testing.T, addr string) *DB {
+	for i := 0; i < 50; i++ {
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			conn.Close()
+			return NewDriver(addr, "root", "12345678", "test").Connect()
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("connect %s failed", addr)
+	return nil
+}
+
+// 一个连接的事务没有结束时，其他连接的语句等待事务结束，不会加入到别人的事务中
+func TestServerTxOwner(t *testing.T) {
+	storage := newTestStorage(t)
+	mustExecTest(t, storage, "create table st(a int)")
+	server := NewServer("127.0.0.1:13307", "root", "12345678", storage)
+	go server.Listen()
+	defer server.Close()
+	db1 := connectTestServer(t, server.Addr)
+	db2 := connectTestServer(t, server.Addr)
+	db1.Query("begin")
+	db1.Query("insert into st values(1)")
+	done := make(chan error)
+	go func() {
+		done <- CatchErr(func() {
+			db2.Query("insert into st values(2)")
+		})
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("statement of another session should wait, err = %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	db1.Query("rollback")
+	if err := <-done; err != nil {
+		t.Fatalf("insert after rollback: %v", err)
+	}
+	res := db1.Query("select a from st")
+	rows := make([]any, 0)
+	for res.Next() {
+		rows = append(rows, res.GetData(0))
+	}
+	if fmt.Sprint(rows) != "[2]" {
+		t.Fatalf("got %v want [2]", rows)
+	}
+	storage.Close()
+}
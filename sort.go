@@ -0,0 +1,304 @@
+/*
+@author: sk
+@date: 2024/10/12
+*/
+package main
+
+import (
+	"container/heap"
+	"sort"
+)
+
+// 排序分为 内排序 外排序(数据太大内存放不下)
+// 缓存的数据不超过内存上限时直接内排序，超过时把已缓存的数据排好序写入一个临时文件(有序段)
+// 全部读取完后多路归并，Next 每次从各有序段的当前行中取最小的返回
+// 同时打开的有序段有上限，同一层的有序段攒够 SortMergeWays 个就先归并为上一层的一个有序段，最后归并时也不超过 SortMergeWays 路
+// 上面直接是 LIMIT 时只需要前 TopN 行，使用大小为 TopN 的大顶堆，不需要缓存与排序全部数据
+
+const (
+	SortBufferSize = 4 * 1024 * 1024 // 排序默认的内存上限 超过后写入临时文件使用外排序 可以通过 Config 修改
+	SortMergeWays  = 16              // 一次最多归并的有序段数
+)
+
+type SortOperator struct {
+	*InputOperator
+	Orders       []*OrderNode // 按顺序来，支持多列排序
+	TopN         int          // 大于 0 时只保留前 TopN 行
+	MemLimit     int64        // 内存中最多缓存的数据大小 超过后使用外排序
+	OrderIdx     []int        // 排序列在行中的下标
+	OrderColumns []*Column
+	Data         [][]any
+	DataIdx      int
+	Runs         []*SortRun // 外排序的有序段 为空表示是内排序
+	Merger       *SortMerger
+}
+
+func (s *SortOperator) Open() {
+	s.InputOperator.Open()
+	s.removeRuns() // 可能会重复打开(子查询)
+	columns := s.Input.GetColumns()
+	columnMap := make(map[string]*Column)
+	idxMap := make(map[string]int)
+	for idx, column := range columns {
+		idxMap[column.Name] = idx
+		columnMap[column.Name] = column
+	}
+	s.OrderIdx, s.OrderColumns = nil, nil
+	for _, order := range s.Orders {
+		name := GetNodeColumnName(order.Field) // 表达式需要提前计算好
+		if idx, ok := idxMap[name]; ok {
+			s.OrderIdx = append(s.OrderIdx, idx)
+			s.OrderColumns = append(s.OrderColumns, columnMap[name])
+		} else {
+			panic(&NotFoundError{Kind: "column", Name: name})
+		}
+	}
+	// 准备数据
+	s.Data = nil
+	if s.TopN > 0 {
+		s.openTopN()
+	} else {
+		size := int64(0)
+		for {
+			res := s.Input.Next()
+			if res == nil {
+				break
+			}
+			s.Data = append(s.Data, res)
+			if size += RowSize(res); size > s.MemLimit {
+				s.spill()
+				size = 0
+			}
+		}
+		if len(s.Runs) > 0 { // 剩余的也写入临时文件 统一归并
+			if len(s.Data) > 0 {
+				s.spill()
+			}
+			s.merge()
+		} else {
+			s.sortData()
+		}
+	}
+	s.DataIdx = 0
+}
+
+// 大顶堆 堆顶是目前保留的行中最大的，新行比堆顶小就替换掉堆顶
+func (s *SortOperator) openTopN() {
+	rows := &RowHeap{LessRow: func(row1 []any, row2 []any) bool {
+		return s.less(row2, row1)
+	}}
+	for {
+		res := s.Input.Next()
+		if res == nil {
+			break
+		}
+		if rows.Len() < s.TopN {
+			heap.Push(rows, res)
+		} else if s.less(res, rows.Rows[0]) {
+			rows.Rows[0] = res
+			heap.Fix(rows, 0)
+		}
+	}
+	s.Data = rows.Rows
+	s.sortData()
+}
+
+func (s *SortOperator) sortData() {
+	sort.SliceStable(s.Data, func(i, j int) bool {
+		return s.less(s.Data[i], s.Data[j])
+	})
+}
+
+// 按排序列依次比较 完全相等时返回 false
+func (s *SortOperator) less(row1 []any, row2 []any) bool {
+	for k, order := range s.Orders {
+		column := s.OrderColumns[k]
+		res := CompareValue(&Value{
+			Type: column.Type,
+			Data: row1[s.OrderIdx[k]],
+		}, &Value{
+			Type: column.Type,
+			Data: row2[s.OrderIdx[k]],
+		})
+		if res == 0 { // 当前比较一致进行下一级
+			continue
+		}
+		if order.Desc {
+			return res > 0
+		} else {
+			return res < 0
+		}
+	}
+	return false
+}
+
+// 缓存的数据排好序写入一个新的临时文件
+func (s *SortOperator) spill() {
+	s.sortData()
+	file := NewSpillFile("sort")
+	for _, row := range s.Data {
+		file.Write(row)
+	}
+	s.Runs = append(s.Runs, &SortRun{SpillFile: file})
+	s.Data = nil
+	// 末尾的有序段层数是非递增的 末尾同一层的攒够了就归并为上一层的一个
+	for n := len(s.Runs); n >= SortMergeWays && s.Runs[n-SortMergeWays].Level == s.Runs[n-1].Level; n = len(s.Runs) {
+		s.mergeRuns(SortMergeWays)
+	}
+}
+
+// 归并末尾的 n 个有序段为一个新的有序段
+func (s *SortOperator) mergeRuns(n int) {
+	runs := s.Runs[len(s.Runs)-n:]
+	merger := &SortMerger{LessRow: s.less}
+	for _, run := range runs {
+		run.Rewind()
+		if run.Row != nil {
+			merger.Runs = append(merger.Runs, run)
+		}
+	}
+	heap.Init(merger)
+	file := NewSpillFile("sort")
+	for row := merger.Next(); row != nil; row = merger.Next() {
+		file.Write(row)
+	}
+	res := &SortRun{SpillFile: file, Level: runs[0].Level + 1}
+	for _, run := range runs {
+		run.Remove()
+	}
+	s.Runs = append(s.Runs[:len(s.Runs)-n], res)
+}
+
+// 所有有序段从头开始读取 各段的当前行放入小顶堆 有序段太多的先归并末尾较小的
+func (s *SortOperator) merge() {
+	for len(s.Runs) > SortMergeWays {
+		s.mergeRuns(min(SortMergeWays, len(s.Runs)-SortMergeWays+1))
+	}
+	s.Merger = &SortMerger{LessRow: s.less}
+	for _, run := range s.Runs {
+		run.Rewind()
+		if run.Row != nil {
+			s.Merger.Runs = append(s.Merger.Runs, run)
+		}
+	}
+	heap.Init(s.Merger)
+}
+
+func (s *SortOperator) removeRuns() {
+	for _, run := range s.Runs {
+		run.Remove()
+	}
+	s.Runs, s.Merger = nil, nil
+}
+
+func (s *SortOperator) Reset() {
+	s.InputOperator.Reset()
+	s.DataIdx = 0
+	if len(s.Runs) > 0 {
+		s.merge()
+	}
+}
+
+func (s *SortOperator) Close() {
+	s.InputOperator.Close()
+	s.removeRuns()
+	s.Data = nil
+}
+
+func (s *SortOperator) Next() []any {
+	if len(s.Runs) > 0 {
+		return s.Merger.Next()
+	}
+	if s.DataIdx < len(s.Data) {
+		s.DataIdx++
+		return s.Data[s.DataIdx-1]
+	} else {
+		return nil
+	}
+}
+
+func NewSortOperator(input IOperator, orders []*OrderNode) IOperator {
+	return &SortOperator{InputOperator: NewInputOperator(input), Orders: orders, MemLimit: SortBufferSize}
+}
+
+//=========================有序段=========================
+
+type SortRun struct { // 临时文件中的一个有序段
+	*SpillFile
+	Row   []any // 当前行 读完为 nil
+	Level int   // 由多少层归并得到 直接落盘的为 0
+}
+
+func (r *SortRun) Rewind() {
+	r.SpillFile.Rewind()
+	r.Row = r.Read()
+}
+
+type SortMerger struct { // 按各有序段当前行排序的小顶堆 实现 heap.Interface
+	Runs    []*SortRun
+	LessRow func(row1 []any, row2 []any) bool
+}
+
+func (m *SortMerger) Len() int {
+	return len(m.Runs)
+}
+
+func (m *SortMerger) Less(i, j int) bool {
+	return m.LessRow(m.Runs[i].Row, m.Runs[j].Row)
+}
+
+func (m *SortMerger) Swap(i, j int) {
+	m.Runs[i], m.Runs[j] = m.Runs[j], m.Runs[i]
+}
+
+func (m *SortMerger) Push(x any) {
+	m.Runs = append(m.Runs, x.(*SortRun))
+}
+
+func (m *SortMerger) Pop() any {
+	res := m.Runs[len(m.Runs)-1]
+	m.Runs = m.Runs[:len(m.Runs)-1]
+	return res
+}
+
+// 取出堆顶有序段的当前行 该段读完了就移出堆
+func (m *SortMerger) Next() []any {
+	if len(m.Runs) == 0 {
+		return nil
+	}
+	run := m.Runs[0]
+	res := run.Row
+	if run.Row = run.Read(); run.Row == nil {
+		heap.Pop(m)
+	} else {
+		heap.Fix(m, 0)
+	}
+	return res
+}
+
+type RowHeap struct { // 实现 heap.Interface
+	Rows    [][]any
+	LessRow func(row1 []any, row2 []any) bool
+}
+
+func (h *RowHeap) Len() int {
+	return len(h.Rows)
+}
+
+func (h *RowHeap) Less(i, j int) bool {
+	return h.LessRow(h.Rows[i], h.Rows[j])
+}
+
+func (h *RowHeap) Swap(i, j int) {
+	h.Rows[i], h.Rows[j] = h.Rows[j], h.Rows[i]
+}
+
+func (h *RowHeap) Push(x any) {
+	h.Rows = append(h.Rows, x.([]any))
+}
+
+func (h *RowHeap) Pop() any {
+	res := h.Rows[len(h.Rows)-1]
+	h.Rows = h.Rows[:len(h.Rows)-1]
+	return res
+}
@@ -0,0 +1,159 @@
+/*
+@author: sk
+@date: 2024/10/15
+*/
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// 内存放不下的中间数据(外排序的有序段，聚合的分区)写入 BasePath 下的临时文件
+// 临时文件名为 前缀_随机串.run 用完即删，异常退出残留的启动时清理
+
+type SpillFile struct {
+	File   *os.File
+	Writer *bufio.Writer
+	Reader *bufio.Reader
+}
+
+func (f *SpillFile) Write(row []any) {
+	bs := EncodeRow(row)
+	_, err := f.Writer.Write(Uint64ToByte(uint64(len(bs))))
+	HandleErr(err)
+	_, err = f.Writer.Write(bs)
+	HandleErr(err)
+}
+
+// 写完后从头开始读取 可以重复调用
+func (f *SpillFile) Rewind() {
+	HandleErr(f.Writer.Flush())
+	_, err := f.File.Seek(0, io.SeekStart)
+	HandleErr(err)
+	f.Reader = bufio.NewReader(f.File)
+}
+
+// 读取下一行 读完返回 nil
+func (f *SpillFile) Read() []any {
+	bs := make([]byte, 8)
+	if _, err := io.ReadFull(f.Reader, bs); err == io.EOF {
+		return nil
+	} else {
+		HandleErr(err)
+	}
+	bs = make([]byte, ByteToUint64(bs))
+	_, err := io.ReadFull(f.Reader, bs)
+	HandleErr(err)
+	return DecodeRow(bs)
+}
+
+func (f *SpillFile) Remove() {
+	HandleErr(f.File.Close())
+	HandleErr(os.Remove(f.File.Name()))
+}
+
+func NewSpillFile(prefix string) *SpillFile {
+	file, err := os.CreateTemp(BasePath, prefix+"_*."+ExtRun)
+	HandleErr(err)
+	return &SpillFile{File: file, Writer: bufio.NewWriter(file)}
+}
+
+// 清理上次异常退出残留的临时文件 ALTER TABLE 没有提交的 .tmp 文件也一起删除
+func RemoveSpillFiles() {
+	files, err := filepath.Glob(path.Join(BasePath, "*_*."+ExtRun))
+	HandleErr(err)
+	temps, err := filepath.Glob(path.Join(BasePath, "*.tmp"))
+	HandleErr(err)
+	for _, file := range append(files, temps...) {
+		HandleErr(os.Remove(file))
+	}
+}
+
+//=========================行编码=========================
+
+// 中间数据可能包含计算列，不按列类型编码，每个值前面一个字节标记类型
+// 字符串为 长度(uint64)+内容  编码结果没有歧义，也用作分组的 key
+const (
+	RowTagNull  = 0
+	RowTagInt   = 1
+	RowTagFloat = 2
+	RowTagStr   = 3
+	RowTagBool  = 4
+)
+
+func EncodeRow(row []any) []byte {
+	buff := &bytes.Buffer{}
+	for _, item := range row {
+		switch val := item.(type) {
+		case nil:
+			buff.WriteByte(RowTagNull)
+		case int64:
+			buff.WriteByte(RowTagInt)
+			buff.Write(Int64ToByte(val))
+		case float64:
+			buff.WriteByte(RowTagFloat)
+			buff.Write(Float64ToByte(val))
+		case string:
+			buff.WriteByte(RowTagStr)
+			buff.Write(Uint64ToByte(uint64(len(val))))
+			buff.WriteString(val)
+		case bool:
+			buff.WriteByte(RowTagBool)
+			if val {
+				buff.WriteByte(1)
+			} else {
+				buff.WriteByte(0)
+			}
+		default:
+			panic(fmt.Sprintf("unsupported row value %v", item))
+		}
+	}
+	return buff.Bytes()
+}
+
+func DecodeRow(bs []byte) []any {
+	res := make([]any, 0)
+	for i := 0; i < len(bs); {
+		tag := bs[i]
+		i++
+		switch tag {
+		case RowTagNull:
+			res = append(res, nil)
+		case RowTagInt:
+			res = append(res, ByteToInt64(bs[i:i+8]))
+			i += 8
+		case RowTagFloat:
+			res = append(res, ByteToFloat64(bs[i:i+8]))
+			i += 8
+		case RowTagStr:
+			l := int(ByteToUint64(bs[i : i+8]))
+			i += 8
+			res = append(res, string(bs[i:i+l]))
+			i += l
+		case RowTagBool:
+			res = append(res, bs[i] == 1)
+			i++
+		}
+	}
+	return res
+}
+
+// 粗略估计一行占用的内存 用于判断是否超过内存上限
+func RowSize(row []any) int64 {
+	res := int64(24 + 16*len(row))
+	for _, item := range row {
+		switch val := item.(type) {
+		case int64, float64:
+			res += 8
+		case string:
+			res += int64(len(val))
+		}
+	}
+	return res
+}
@@ -0,0 +1,193 @@
+/*
+@author: sk
+@date: 2024/10/3
+*/
+package main
+
+import (
+	"math/rand"
+	"sort"
+)
+
+// ANALYZE TABLE 收集的统计信息 与元数据一样以 json 形式存储在 stat.catalog 并常驻内存
+// 直方图是等高的，每个桶的行数大致相同，只记录桶内的最大值，值使用字符串存储，比较时按列类型转换
+// 统计信息不会随增删改更新，数据变化较大时需要重新 ANALYZE TABLE
+
+type TableStat struct {
+	Table   string
+	Rows    int64
+	Columns []*ColumnStat
+}
+
+type ColumnStat struct {
+	Name     string // 表名.列名
+	Distinct int64  // 不同的非 NULL 值的个数
+	Nulls    int64
+	Buckets  []*Bucket // 按上界有序 不定长文本不收集直方图
+}
+
+type Bucket struct {
+	Upper string // 桶内的最大值
+	Count int64
+}
+
+// 逐行累计统计信息，不需要把整张表读进内存
+// 每列用蓄水池抽样保留至多 StatSampleSize 个非 NULL 值来构建直方图，行数不超过抽样数时结果是精确的
+// 不同值的个数在 StatDistinctLimit 以内精确统计，超过后按样本估计
+type StatBuilder struct {
+	Table   *Table
+	Rows    int64
+	Nulls   []int64
+	Samples [][]*Value         // 每列的样本
+	Seen    []int64            // 每列见过的非 NULL 值个数
+	Values  []map[any]struct{} // 每列见过的不同值 超过上限后置为 nil
+	Rand    *rand.Rand         // 固定种子 同样的数据得到同样的统计信息
+}
+
+func NewStatBuilder(table *Table) *StatBuilder {
+	size := len(table.Columns)
+	res := &StatBuilder{Table: table, Nulls: make([]int64, size), Samples: make([][]*Value, size),
+		Seen: make([]int64, size), Values: make([]map[any]struct{}, size), Rand: rand.New(rand.NewSource(1))}
+	for i := range res.Values {
+		res.Values[i] = make(map[any]struct{})
+	}
+	return res
+}
+
+func (b *StatBuilder) Add(row []any) {
+	b.Rows++
+	for i, column := range b.Table.Columns {
+		if row[i] == nil {
+			b.Nulls[i]++
+			continue
+		}
+		if b.Values[i] != nil {
+			b.Values[i][row[i]] = struct{}{}
+			if len(b.Values[i]) > StatDistinctLimit {
+				b.Values[i] = nil
+			}
+		}
+		b.Seen[i]++
+		val := &Value{Type: column.Type, Data: row[i]}
+		if len(b.Samples[i]) < StatSampleSize {
+			b.Samples[i] = append(b.Samples[i], val)
+		} else if j := b.Rand.Int63n(b.Seen[i]); j < StatSampleSize { // 第 n 个值以 k/n 的概率替换样本中的一个
+			b.Samples[i][j] = val
+		}
+	}
+}
+
+func (b *StatBuilder) Build() *TableStat {
+	res := &TableStat{Table: b.Table.Name, Rows: b.Rows}
+	for i, column := range b.Table.Columns {
+		vals := b.Samples[i]
+		sort.Slice(vals, func(x, y int) bool {
+			return CompareValue(vals[x], vals[y]) < 0
+		})
+		stat := &ColumnStat{Name: column.Name, Nulls: b.Nulls[i]}
+		if b.Values[i] != nil {
+			stat.Distinct = int64(len(b.Values[i]))
+		} else {
+			stat.Distinct = EstimateDistinct(vals, b.Seen[i])
+		}
+		if column.Type != TypTxt && len(vals) > 0 {
+			size := (len(vals) + HistogramBuckets - 1) / HistogramBuckets
+			scale := float64(b.Seen[i]) / float64(len(vals)) // 样本的行数放大到全表
+			for j := 0; j < len(vals); j += size {
+				end := min(j+size, len(vals))
+				count := int64(float64(end-j)*scale + 0.5)
+				stat.Buckets = append(stat.Buckets, &Bucket{Upper: FormatValue(vals[end-1]), Count: count})
+			}
+		}
+		res.Columns = append(res.Columns, stat)
+	}
+	return res
+}
+
+// 由有序的样本估计不同值的个数 total 为总的非 NULL 值个数
+// Haas-Stokes 估计 n*d / (n - f1 + f1*n/N) d 为样本中不同值的个数 f1 为样本中只出现一次的值的个数
+func EstimateDistinct(vals []*Value, total int64) int64 {
+	n, d, f1 := float64(len(vals)), 0.0, 0.0
+	for j := 0; j < len(vals); {
+		k := j + 1
+		for k < len(vals) && CompareValue(vals[j], vals[k]) == 0 {
+			k++
+		}
+		d++
+		if k-j == 1 {
+			f1++
+		}
+		j = k
+	}
+	if n == 0 {
+		return 0
+	}
+	res := n * d / (n - f1 + f1*n/float64(total))
+	return min(max(int64(res+0.5), int64(d)), total)
+}
+
+// name 为 表名.列名 没有返回 nil
+func (s *TableStat) GetColumn(name string) *ColumnStat {
+	for _, column := range s.Columns {
+		if column.Name == name {
+			return column
+		}
+	}
+	return nil
+}
+
+// 非 NULL 值的占比
+func (s *TableStat) NotNullRatio(column *ColumnStat) float64 {
+	if s.Rows == 0 {
+		return 0
+	}
+	return float64(s.Rows-column.Nulls) / float64(s.Rows)
+}
+
+// 等值条件的选择率 假设每个值出现的次数相同
+func (s *TableStat) EqualSelectivity(column *ColumnStat) float64 {
+	if column.Distinct == 0 {
+		return 0
+	}
+	return s.NotNullRatio(column) / float64(column.Distinct)
+}
+
+func (s *TableStat) NullSelectivity(column *ColumnStat) float64 {
+	return 1 - s.NotNullRatio(column)
+}
+
+// 范围条件的选择率 low high 为 nil 表示没有边界，值的类型必须与列一致  至少按一个值估计
+func (s *TableStat) RangeSelectivity(column *ColumnStat, low *Value, lowInclude bool, high *Value, highInclude bool) float64 {
+	if len(column.Buckets) == 0 {
+		return DefaultSelectivity * s.NotNullRatio(column)
+	}
+	lowFrac, highFrac := 0.0, 1.0
+	if low != nil {
+		lowFrac = column.Fraction(low, !lowInclude)
+	}
+	if high != nil {
+		highFrac = column.Fraction(high, highInclude)
+	}
+	return max((highFrac-lowFrac)*s.NotNullRatio(column), s.EqualSelectivity(column))
+}
+
+// 非 NULL 值中小于 val (include 为 true 时小于等于) 的占比 val 所在的桶按一半估计
+func (c *ColumnStat) Fraction(val *Value, include bool) float64 {
+	total, count := int64(0), 0.0
+	for _, bucket := range c.Buckets {
+		total += bucket.Count
+	}
+	if total == 0 {
+		return 0
+	}
+	for _, bucket := range c.Buckets {
+		res := CompareValue(&Value{Value: bucket.Upper}, val)
+		if res < 0 || (res == 0 && include) {
+			count += float64(bucket.Count)
+			continue
+		}
+		count += float64(bucket.Count) / 2
+		break
+	}
+	return count / float64(total)
+}
@@ -7,6 +7,7 @@ package main
 import (
 	"bytes"
 	"fmt"
+	"math"
 	"os"
 	"path"
 	"sort"
@@ -27,7 +28,25 @@ const (
 )
 
 type IndexHolder struct {
-	Columns []*Column // 索引对应的列
+	Columns    []*Column // 索引对应的列 拼接记录偏移时最后还有一个记录偏移列
+	Unique     bool      // 唯一索引不允许重复的 key
+	WithOffset bool      // key 可能重复时把记录偏移拼接到 key 后面保证 key 唯一 非唯一索引与包含可为 NULL 列的唯一索引
+}
+
+// 索引实际存储的 key
+func (h *IndexHolder) FullKey(key []any, val int64) []any {
+	if !h.WithOffset {
+		return key
+	}
+	return append(CloneSlice(key), val)
+}
+
+// 用户看到的 key 去除拼接的记录偏移
+func (h *IndexHolder) UserKey(key []any) []any {
+	if !h.WithOffset {
+		return CloneSlice(key)
+	}
+	return CloneSlice(key[:len(key)-1])
 }
 
 func (h *IndexHolder) GetKeySize() int {
@@ -50,64 +69,77 @@ func NewIndexHolder(index string) *IndexHolder {
 	temp := GetIndex(index)
 	table := GetTable(temp.TableName)
 	columns := PickColumn(temp.Columns, table.Columns)
-	return &IndexHolder{Columns: columns}
+	withOffset := temp.NonUnique
+	for _, column := range columns { // 唯一索引中 NULL 可以重复
+		withOffset = withOffset || column.Nullable
+	}
+	if withOffset {
+		columns = append(columns, &Column{Name: "offset", Type: TypInt, Len: 8})
+	}
+	return &IndexHolder{Columns: columns, Unique: !temp.NonUnique, WithOffset: withOffset}
 }
 
 type BTree struct { // 不定长文本需要再次检索不定长存储，索引不支持包含不定长文本
-	File   *os.File
-	Offset int64 // 再分配 offset 从哪里分配
-	Root   *BTreeNode
-	Index  *IndexHolder
+	File  *PagedFile // 节点都通过缓存池读写，不再常驻内存，根节点固定在 0 号页
+	Index *IndexHolder
 }
 
-func NewBTree(index string) *BTree {
+func NewBTree(index string, pool *BufferPool) *BTree {
 	path0 := path.Join(BasePath, fmt.Sprintf("%s.%s", index, ExtIdx))
-	file, err := os.OpenFile(path0, os.O_RDWR, 0666)
 	holder := NewIndexHolder(index)
-	root := &BTreeNode{Offset: 0, NodeType: NodeData, Index: holder}
-	offset := int64(PageSize) // 若是文件不存在从 一页开始，第一页是根节点的
-	if os.IsNotExist(err) {
-		file, err = os.Create(path0)
-		HandleErr(err)
-	} else {
-		HandleErr(err)
-		root.Load(file)
-		offset, err = file.Seek(0, 2)
-		HandleErr(err)
+	res := &BTree{File: OpenPagedFile(path0, pool), Index: holder}
+	if res.File.Size == 0 { // 新文件 第一页是根节点的
+		root := &BTreeNode{Offset: 0, NodeType: NodeData, Index: holder}
+		root.Save(res.File)
 	}
-	return &BTree{File: file, Root: root, Index: holder, Offset: offset}
+	return res
 }
 
 func (t *BTree) Close() {
-	t.Sync() // 先同步节点状态 再关闭
-	HandleErr(t.File.Close())
+	t.File.Close() // 会先同步脏页再关闭
 }
 
-func (t *BTree) Sync() { // 所有节点都要写入 这里暂时不区分脏节点
-	t.Root.Save(t.File)
+func (t *BTree) Sync() { // 只需要写入脏页
+	t.File.Sync()
+}
+
+func (t *BTree) Remove() {
+	t.File.Remove()
+}
+
+func (t *BTree) LoadNode(offset int64, parent *BTreeNode) *BTreeNode {
+	node := &BTreeNode{Offset: offset, Index: t.Index, Parent: parent}
+	node.Load(t.File)
+	return node
+}
+
+func (t *BTree) GetRoot() *BTreeNode {
+	return t.LoadNode(0, nil)
 }
 
 func (t *BTree) AddData(key []any, val int64) {
+	key = t.Index.FullKey(key, val)
 	if len(key) != len(t.Index.Columns) {
 		panic(fmt.Errorf("key len not match %d != %d", len(key), len(t.Index.Columns)))
 	}
-	// 添加前需要先查询，索引不允许添加重复值
-	entry := t.GetEntry(key)
+	// 添加前需要先查询，索引不允许添加重复值 非唯一索引拼接了偏移不会重复
+	node, entry := t.GetEntry(key)
 	if entry != nil { // 即使删除也不能重复，再加入有跟删除重复的就复用删除的
 		if entry.Delete == RecordIsDelete {
 			entry.Delete = RecordNotDelete
 			entry.Data = val
+			node.Save(t.File)
 			return // 可以直接复用，他也是排序的，直接结束
 		} else {
-			panic(fmt.Sprintf("key %v not unique", key))
+			panic(&ConstraintError{Kind: "unique", Msg: fmt.Sprintf("duplicate key %v", key)})
 		}
 	}
 	// 插入数据
-	node := t.GetDataNode(t.Root, key)
 	node.Entries = append(node.Entries, &BTreeEntry{Key: key, Delete: RecordNotDelete, Data: val})
 	sort.Slice(node.Entries, func(i, j int) bool {
 		return t.Index.BatchCompare(node.Entries[i].Key, node.Entries[j].Key) < 0
 	})
+	node.Save(t.File)
 	if t.Index.BatchCompare(node.Entries[0].Key, key) == 0 { // 特殊情况插入到第一个需要递归更新 key值
 		t.UpdateKey(node, key)
 	}
@@ -118,9 +150,8 @@ func (t *BTree) AddData(key []any, val int64) {
 }
 
 func (t *BTree) NextOffset() int64 {
-	res := t.Offset
-	t.Offset += PageSize
-	return res
+	// 索引文件都是整页写入的，文件末尾就是下一个可用页
+	return t.File.Size
 }
 
 func (t *BTree) SplitNode(node *BTreeNode) {
@@ -133,14 +164,14 @@ func (t *BTree) SplitNode(node *BTreeNode) {
 			NodeType: NodeIndex, // 一旦分裂新的根节点就必定是索引节点了
 			Index:    t.Index,
 		}
-		t.Root = parent              // 新的根节点
 		left.Offset = t.NextOffset() // 根节点分裂需要创建两个数据页
+		left.Save(t.File)            // 先占位，保证下一个页偏移正确
 		right.Offset = t.NextOffset()
 	} else {
 		// 非根节点先移除 node 节点，方便后面无脑添加  left right 节点
 		entries := make([]*BTreeEntry, 0)
 		for _, entry := range parent.Entries {
-			if entry.Node != node {
+			if entry.Offset != node.Offset {
 				entries = append(entries, entry)
 			}
 		}
@@ -148,52 +179,40 @@ func (t *BTree) SplitNode(node *BTreeNode) {
 		left.Offset = node.Offset     // 复用原来的数据页
 		right.Offset = t.NextOffset() // 非根节点分裂只需要申请一个数据页
 	}
-	left.Parent = parent
-	right.Parent = parent
 	l := len(node.Entries) / 2
 	// 这里是使用同一个 slice 需要进行复制，防止 append 后复用
 	left.Entries = CloneSlice(node.Entries[:l])
 	right.Entries = CloneSlice(node.Entries[l:])
-	if node.NodeType == NodeIndex { // 索引节点的话需要更新子节点到父节点的反向引用
-		for _, entry := range left.Entries {
-			entry.LoadNode(t.File, t.Index, left) // 加载时需要更新上 父关联，但是不一定触发加载
-			entry.Node.Parent = left
-		}
-		for _, entry := range right.Entries {
-			entry.LoadNode(t.File, t.Index, right)
-			entry.Node.Parent = right
-		}
-	} else if node.NodeType == NodeData { // 数据节点没有子节点，但是需要更新前后索引方便进行遍历
-		node.LoadPreAndNext(t.File, parent)
-		left.Pre = node.Pre
+	if node.NodeType == NodeData { // 数据节点没有子节点，但是需要更新前后索引方便进行遍历
 		left.PreOffset = node.PreOffset
-		if node.Pre != nil {
-			node.Pre.Next = left
-			node.Pre.NextOffset = left.Offset
+		if node.PreOffset != 0 {
+			pre := t.LoadNode(node.PreOffset, nil)
+			pre.NextOffset = left.Offset
+			pre.Save(t.File)
 		}
-		left.Next = right
 		left.NextOffset = right.Offset
-		right.Pre = left
 		right.PreOffset = left.Offset
-		right.Next = node.Next
 		right.NextOffset = node.NextOffset
-		if node.Next != nil {
-			node.Next.Pre = right
-			node.Next.PreOffset = right.Offset
+		if node.NextOffset != 0 {
+			next := t.LoadNode(node.NextOffset, nil)
+			next.PreOffset = right.Offset
+			next.Save(t.File)
 		}
-	} // 重新加入子节点并排序
+	} // 索引节点的子节点不记录父节点，不需要处理
+	left.Save(t.File)
+	right.Save(t.File)
+	// 重新加入子节点并排序
 	parent.Entries = append(parent.Entries, &BTreeEntry{
 		Key:    left.Entries[0].Key, // 这里parent肯定是索引节点
 		Offset: left.Offset,
-		Node:   left,
 	}, &BTreeEntry{
 		Key:    right.Entries[0].Key, // key取整个元素中最小的
 		Offset: right.Offset,
-		Node:   right,
 	})
 	sort.Slice(parent.Entries, func(i, j int) bool {
 		return t.Index.BatchCompare(parent.Entries[i].Key, parent.Entries[j].Key) < 0
 	})
+	parent.Save(t.File)
 	if t.NeedSplit(parent) { // 可能会触发递归分裂
 		t.SplitNode(parent)
 	}
@@ -212,6 +231,7 @@ func (t *BTree) NeedSplit(node *BTreeNode) bool {
 	}
 }
 
+// 从根节点向下查找，返回的节点通过 Parent 记录了查找路径
 func (t *BTree) GetDataNode(node *BTreeNode, key []any) *BTreeNode {
 	if node.NodeType == NodeData {
 		return node
@@ -225,12 +245,12 @@ func (t *BTree) GetDataNode(node *BTreeNode, key []any) *BTreeNode {
 			l = mid
 		}
 	}
-	node.Entries[l].LoadNode(t.File, t.Index, node)
-	return t.GetDataNode(node.Entries[l].Node, key)
+	return t.GetDataNode(t.LoadNode(node.Entries[l].Offset, node), key)
 }
 
-func (t *BTree) GetEntry(key []any) *BTreeEntry {
-	node := t.GetDataNode(t.Root, key)
+// 返回 key 所在的数据节点，以及对应的数据 不存在数据返回 nil  修改数据后需要保存节点
+func (t *BTree) GetEntry(key []any) (*BTreeNode, *BTreeEntry) {
+	node := t.GetDataNode(t.GetRoot(), key)
 	l, r := 0, len(node.Entries)-1
 	for l <= r {
 		mid := (l + r) / 2
@@ -240,10 +260,10 @@ func (t *BTree) GetEntry(key []any) *BTreeEntry {
 		} else if res < 0 {
 			r = mid - 1
 		} else {
-			return node.Entries[mid]
+			return node, node.Entries[mid]
 		}
 	}
-	return nil
+	return node, nil
 }
 
 func (t *BTree) UpdateKey(node *BTreeNode, key []any) {
@@ -253,8 +273,9 @@ func (t *BTree) UpdateKey(node *BTreeNode, key []any) {
 		return
 	}
 	for i, entry := range parent.Entries {
-		if entry.Node == node {
+		if entry.Offset == node.Offset {
 			entry.Key = key
+			parent.Save(t.File)
 			if i == 0 { // 若更新的是父节点的第一个节点需要递归更新
 				t.UpdateKey(parent, key)
 			}
@@ -263,79 +284,146 @@ func (t *BTree) UpdateKey(node *BTreeNode, key []any) {
 	}
 }
 
-func (t *BTree) DelData(key []any) {
-	if entry := t.GetEntry(key); entry != nil {
+func (t *BTree) DelData(key []any, val int64) {
+	key = t.Index.FullKey(key, val)
+	if node, entry := t.GetEntry(key); entry != nil {
 		entry.Delete = RecordIsDelete
+		node.Save(t.File)
 	} else {
 		panic(fmt.Sprintf("key not exist: %v", key))
 	}
 }
 
+// 删除指向 val 的数据，不存在或指向其他数据直接忽略，用于恢复
+func (t *BTree) RemoveData(key []any, val int64) {
+	key = t.Index.FullKey(key, val)
+	if node, entry := t.GetEntry(key); entry != nil && entry.Data == val {
+		entry.Delete = RecordIsDelete
+		node.Save(t.File)
+	}
+}
+
+// 保证存在指向 val 的数据，已经存在的直接复用，用于恢复
+func (t *BTree) RestoreData(key []any, val int64) {
+	node, entry := t.GetEntry(t.Index.FullKey(key, val))
+	if entry == nil {
+		t.AddData(key, val)
+	} else if entry.Delete == RecordIsDelete || entry.Data == val {
+		entry.Delete = RecordNotDelete
+		entry.Data = val
+		node.Save(t.File)
+	} else {
+		panic(fmt.Sprintf("restore key %v not unique", key))
+	}
+}
+
+// 唯一索引中已经存在有效的 key 直接报错，写入数据前检查，防止只写入一部分
+// 包含 NULL 的 key 不参与唯一性检查，可以有任意多个
+func (t *BTree) CheckUnique(key []any) {
+	if !t.Index.Unique || HasNull(key) {
+		return
+	}
+	if _, ok := t.FindData(key); ok {
+		panic(&ConstraintError{Kind: "unique", Msg: fmt.Sprintf("duplicate key %v", key)})
+	}
+}
+
+// 拼接了偏移的索引返回第一个匹配的数据
 func (t *BTree) GetData(key []any) int64 {
-	entry := t.GetEntry(key)
-	if entry == nil || entry.Delete == RecordIsDelete {
-		panic(fmt.Sprintf("record not exists key = %v", key))
+	if res, ok := t.FindData(key); ok {
+		return res
 	}
-	return entry.Data
+	panic(fmt.Sprintf("record not exists key = %v", key))
+}
+
+// 查找 key 对应的有效数据 不存在返回 false
+func (t *BTree) FindData(key []any) (int64, bool) {
+	if !t.Index.WithOffset {
+		_, entry := t.GetEntry(key)
+		if entry == nil || entry.Delete == RecordIsDelete {
+			return 0, false
+		}
+		return entry.Data, true
+	}
+	// 从 key 的最小位置开始向后找 记录偏移不会为负数
+	node := t.GetDataNode(t.GetRoot(), t.Index.FullKey(key, math.MinInt64))
+	columns := t.Index.Columns[:len(key)]
+	for node != nil {
+		for _, entry := range node.Entries {
+			res := ColumnBatchCompare(entry.Key, key, columns)
+			if res > 0 {
+				return 0, false
+			}
+			if res == 0 && entry.Delete == RecordNotDelete {
+				return entry.Data, true
+			}
+		}
+		node = t.GetNextNode(node)
+	}
+	return 0, false
+}
+
+// 只比较 prefix 对应的前几列
+func (t *BTree) ComparePrefix(key []any, prefix []any) int {
+	return ColumnBatchCompare(key, prefix, t.Index.Columns[:len(prefix)])
+}
+
+// 找到第一个可能 大于等于(include)/大于 prefix 的数据节点，前缀相同的数据可能跨越多个节点，需要找最靠前的
+func (t *BTree) SeekNode(prefix []any, include bool) *BTreeNode {
+	node := t.GetRoot()
+	for node.NodeType != NodeData {
+		l := 0 // 找最后一个 小于(include)/小于等于 prefix 的子节点 都不满足就是第一个
+		for i, entry := range node.Entries {
+			res := t.ComparePrefix(entry.Key, prefix)
+			if res < 0 || (!include && res == 0) {
+				l = i
+			} else {
+				break
+			}
+		}
+		node = t.LoadNode(node.Entries[l].Offset, node)
+	}
+	return node
 }
 
 func (t *BTree) GetFirstNode() *BTreeNode {
-	node := t.Root
+	node := t.GetRoot()
 	for node.NodeType != NodeData {
-		node.Entries[0].LoadNode(t.File, t.Index, node)
-		node = node.Entries[0].Node
+		node = t.LoadNode(node.Entries[0].Offset, node)
 	}
 	return node
 }
 
 func (t *BTree) GetNextNode(node *BTreeNode) *BTreeNode {
-	if node.Next != nil { // 已经加载的话直接使用
-		return node.Next
-	}
 	if node.NextOffset == 0 {
 		return nil
 	}
-	// 这里缺失 parent 字段不能直接加入 BTree 仅临时使用
-	res := &BTreeNode{Offset: node.NextOffset, Index: t.Index, NodeType: NodeData}
-	res.Load(t.File)
-	return res
+	// 这里缺失 parent 字段，仅用于遍历
+	return t.LoadNode(node.NextOffset, nil)
 }
 
 type BTreeEntry struct {
 	Key []any // 排序字段 组合排序
 	// 索引
 	Offset int64
-	Node   *BTreeNode // 不一定立即加载
 	// 数据
 	Delete uint8
 	Data   int64
 }
 
-func (e *BTreeEntry) LoadNode(file *os.File, index *IndexHolder, parent *BTreeNode) {
-	if e.Node != nil { // 以内存为准
-		return
-	}
-	e.Node = &BTreeNode{Offset: e.Offset, Index: index, Parent: parent}
-	e.Node.Load(file)
-}
-
-type BTreeNode struct {
+type BTreeNode struct { // 从页中解析出的节点副本，修改后需要 Save 写回页中
 	Index  *IndexHolder
-	Parent *BTreeNode
+	Parent *BTreeNode // 仅在从根节点向下查找时记录，不写入文件
 	Offset int64
-	//Dirty  bool  先不使用脏标记，采用全部写入的方式
 	// 需要写入文件的
 	NodeType uint8
 	Entries  []*BTreeEntry
 	// 只有数据节点需要，链接前后进行遍历的
-	Pre        *BTreeNode
 	PreOffset  int64
-	Next       *BTreeNode
 	NextOffset int64
 }
 
-func (n *BTreeNode) Save(file *os.File) {
-	// 先保存自己
+func (n *BTreeNode) Save(file *PagedFile) {
 	buff := &bytes.Buffer{}
 	buff.WriteByte(n.NodeType)
 	if n.NodeType == NodeData {
@@ -354,28 +442,14 @@ func (n *BTreeNode) Save(file *os.File) {
 			buff.Write(Int64ToByte(entry.Offset))
 		}
 	}
-	_, err := file.Seek(n.Offset, 0)
-	HandleErr(err)
 	bs := make([]byte, PageSize) // 必须补齐一页
 	copy(bs, buff.Bytes())
-	_, err = file.Write(bs)
-	HandleErr(err)
-	// 索引节点需要进行递归
-	if n.NodeType == NodeIndex {
-		for _, entry := range n.Entries {
-			if entry.Node != nil { // 只有加载了才需要保存
-				entry.Node.Save(file)
-			}
-		}
-	}
+	file.WriteAt(bs, n.Offset) // 只写入缓存池，标记为脏页
 }
 
-func (n *BTreeNode) Load(file *os.File) {
-	_, err := file.Seek(n.Offset, 0)
-	HandleErr(err)
+func (n *BTreeNode) Load(file *PagedFile) {
 	bs := make([]byte, PageSize)
-	_, err = file.Read(bs)
-	HandleErr(err)
+	file.ReadAt(bs, n.Offset)
 	n.NodeType = bs[0]
 	if n.NodeType == NodeData {
 		n.PreOffset = ByteToInt64(bs[1:9])
@@ -409,31 +483,31 @@ func (n *BTreeNode) Load(file *os.File) {
 	}
 }
 
-func (n *BTreeNode) LoadPreAndNext(file *os.File, parent *BTreeNode) {
-	if n.Pre == nil && n.PreOffset != 0 {
-		n.Pre = &BTreeNode{Offset: n.PreOffset, Index: n.Index, Parent: parent}
-		n.Pre.Load(file)
-	}
-}
-
 type Storage struct {
-	TableFiles         map[string]*os.File // 表名 -> 文件
-	StringFiles        map[string]*os.File // 表名 -> 文件
-	IndexTrees         map[string]*BTree   // 索引名称 -> BTree
+	TableFiles         map[string]*PagedFile // 表名 -> 文件
+	StringFiles        map[string]*PagedFile // 表名 -> 文件
+	IndexTrees         map[string]*BTree     // 索引名称 -> BTree
+	Pool               *BufferPool           // 上面所有文件共用一个缓存池
 	TransactionManager *TransactionManager
+	SkipIndex          bool    // 崩溃恢复时不维护索引，恢复完成后统一重建
+	Config             *Config // 内存预算
 }
 
 func NewStorage() *Storage {
-	return &Storage{TableFiles: make(map[string]*os.File), StringFiles: make(map[string]*os.File),
-		IndexTrees: make(map[string]*BTree)}
+	config := LoadConfig()
+	return &Storage{TableFiles: make(map[string]*PagedFile), StringFiles: make(map[string]*PagedFile),
+		IndexTrees: make(map[string]*BTree), Pool: NewBufferPool(int(config.BufferPoolSize / PageSize)), Config: config}
 }
 
 func (s *Storage) Close() {
+	if s.TransactionManager != nil { // 关闭前做检查点
+		s.TransactionManager.Close()
+	}
 	for _, file := range s.TableFiles {
-		HandleErr(file.Close())
+		file.Close()
 	}
 	for _, file := range s.StringFiles {
-		HandleErr(file.Close())
+		file.Close()
 	}
 	for _, tree := range s.IndexTrees {
 		tree.Close()
@@ -443,10 +517,10 @@ func (s *Storage) Close() {
 func (s *Storage) Sync(table string) {
 	// 同步一个表
 	if file, ok := s.TableFiles[table]; ok {
-		HandleErr(file.Sync())
+		file.Sync()
 	}
 	if file, ok := s.StringFiles[table]; ok {
-		HandleErr(file.Sync())
+		file.Sync()
 	}
 	idxes := ListIndexes(table)
 	for _, idx := range idxes {
@@ -456,52 +530,178 @@ func (s *Storage) Sync(table string) {
 	}
 }
 
-func (s *Storage) OpenTable(table string) *os.File {
+// 所有打开的文件全部落盘，检查点使用
+func (s *Storage) SyncAll() {
+	for _, file := range s.TableFiles {
+		file.Sync()
+	}
+	for _, file := range s.StringFiles {
+		file.Sync()
+	}
+	for _, tree := range s.IndexTrees {
+		tree.Sync()
+	}
+}
+
+func (s *Storage) OpenTable(table string) *PagedFile {
 	if _, ok := s.TableFiles[table]; !ok {
-		s.TableFiles[table] = OpenOrCreate(path.Join(BasePath, fmt.Sprintf("%s.%s", table, ExtDat)))
+		s.TableFiles[table] = OpenPagedFile(path.Join(BasePath, fmt.Sprintf("%s.%s", table, ExtDat)), s.Pool)
 	}
 	return s.TableFiles[table]
 }
 
-func (s *Storage) OpenString(table string) *os.File {
+func (s *Storage) OpenString(table string) *PagedFile {
 	if _, ok := s.StringFiles[table]; !ok {
-		s.StringFiles[table] = OpenOrCreate(path.Join(BasePath, fmt.Sprintf("%s.%s", table, ExtStr)))
+		s.StringFiles[table] = OpenPagedFile(path.Join(BasePath, fmt.Sprintf("%s.%s", table, ExtStr)), s.Pool)
 	}
 	return s.StringFiles[table]
 }
 
 func (s *Storage) OpenIndex(index string) *BTree {
 	if _, ok := s.IndexTrees[index]; !ok {
-		s.IndexTrees[index] = NewBTree(index)
+		s.IndexTrees[index] = NewBTree(index, s.Pool)
 	}
 	return s.IndexTrees[index]
 }
 
+// 删除表的数据文件与所有索引文件，元数据需要调用方处理
+func (s *Storage) DropTable(table string) {
+	for _, index := range ListIndexes(table) {
+		s.DropIndex(index.Name)
+	}
+	s.OpenTable(table).Remove() // 没有打开过的也先打开再删除，统一处理
+	delete(s.TableFiles, table)
+	s.OpenString(table).Remove()
+	delete(s.StringFiles, table)
+}
+
+func (s *Storage) DropIndex(index string) {
+	s.OpenIndex(index).Remove()
+	delete(s.IndexTrees, index)
+}
+
+// 按新的列定义重写表数据到临时文件，替换原文件见 SwitchTable
+// convert 把旧的一行数据转换为新的一行数据 转换失败时删除临时文件，原文件不受影响
+// indexes 为修改后的索引 唯一索引在这里先校验，提交后重建索引时不能再出错
+func (s *Storage) RewriteTable(table string, columns []*Column, convert func([]any) []any, indexes []*Index) {
+	datPath := path.Join(BasePath, fmt.Sprintf("%s.%s", table, ExtDat))
+	strPath := path.Join(BasePath, fmt.Sprintf("%s.%s", table, ExtStr))
+	datFile := OpenPagedFile(datPath+".tmp", s.Pool)
+	strFile := OpenPagedFile(strPath+".tmp", s.Pool)
+	done := false
+	defer func() {
+		if !done { // 缓存池中的脏页直接丢弃
+			datFile.Remove()
+			strFile.Remove()
+		}
+	}()
+	datFile.Truncate(0) // 可能有上次失败留下的
+	strFile.Truncate(0)
+	uniques := make(map[*Index]map[string]struct{}) // 唯一索引已经出现过的 key
+	for _, index := range indexes {
+		if !index.NonUnique {
+			uniques[index] = make(map[string]struct{})
+		}
+	}
+	size := s.TableSize(table)
+	offset := int64(0)
+	for {
+		var data []any
+		data, _, offset = s.NextData(table, offset, size)
+		if data == nil {
+			break
+		}
+		data = convert(data)
+		for index, keys := range uniques {
+			key := PickData(index.Columns, columns, data)
+			if HasNull(key) { // NULL 可以重复
+				continue
+			}
+			if _, has := keys[string(EncodeRow(key))]; has {
+				panic(&ConstraintError{Kind: "unique", Msg: fmt.Sprintf("duplicate key %v", key)})
+			}
+			keys[string(EncodeRow(key))] = struct{}{}
+		}
+		bs := BatchData2Byte(data, columns, func(value string) int64 {
+			return strFile.Append(append(Int64ToByte(int64(len(value))), value...))
+		})
+		datFile.Append(append([]byte{RecordNotDelete}, bs...)) // 已经删除的数据不再保留
+	}
+	datFile.Close() // 关闭时会落盘
+	strFile.Close()
+	done = true
+}
+
+// 删除 RewriteTable 写好但没有使用的临时文件
+func (s *Storage) RemoveRewriteFiles(table string) {
+	for _, ext := range []string{ExtDat, ExtStr} {
+		if err := os.Remove(path.Join(BasePath, fmt.Sprintf("%s.%s.tmp", table, ext))); !os.IsNotExist(err) {
+			HandleErr(err)
+		}
+	}
+}
+
+// 关闭缓存的索引，索引元数据变化后需要重新打开
+func (s *Storage) CloseIndex(index string) {
+	if tree, ok := s.IndexTrees[index]; ok {
+		tree.Close()
+		delete(s.IndexTrees, index)
+	}
+}
+
+// 删除原有的索引文件，根据表数据重新构建索引 返回索引的数据条数
+func (s *Storage) BuildIndex(index *Index) int64 {
+	s.DropIndex(index.Name)
+	btree := s.OpenIndex(index.Name)
+	meta := GetTable(index.TableName)
+	size := s.TableSize(index.TableName)
+	offset := int64(0)
+	count := int64(0)
+	for {
+		var data []any
+		var curr int64
+		data, curr, offset = s.NextData(index.TableName, offset, size)
+		if data == nil {
+			break
+		}
+		key := PickData(index.Columns, meta.Columns, data)
+		btree.CheckUnique(key) // 拼接了偏移的唯一索引 AddData 不会发现重复
+		btree.AddData(key, curr)
+		count++
+	}
+	btree.Sync() // DDL 不记录 REDO LOG 索引直接落盘
+	return count
+}
+
+// 清空表数据 索引直接删除重建为空索引
+func (s *Storage) TruncateTable(table string) {
+	s.OpenTable(table).Truncate(0)
+	s.OpenString(table).Truncate(0)
+	for _, index := range ListIndexes(table) {
+		s.DropIndex(index.Name)
+		s.OpenIndex(index.Name).Sync()
+	}
+}
+
 func (s *Storage) WriteTxt(table string, txt string) int64 {
 	file := s.OpenString(table)
-	offset, err := file.Seek(0, 2)
-	HandleErr(err)
+	offset := file.Size
 	// 先写入长度再写入内容
-	_, err = file.Write(Int64ToByte(int64(len(txt))))
-	HandleErr(err)
-	_, err = file.WriteString(txt)
-	HandleErr(err)
+	bs := append(Int64ToByte(int64(len(txt))), txt...)
+	s.TransactionManager.AddRedoRecord(&RedoRecord{Type: RedoTxt, Table: table, Offset: offset, Data: bs})
+	file.WriteAt(bs, offset)
 	return offset
 }
 
 func (s *Storage) ReadTxt(table string, offset int64) string {
 	file := s.OpenString(table)
-	_, err := file.Seek(offset, 0)
-	HandleErr(err)
 	// 先读取长度
 	bs := make([]byte, 8)
-	_, err = file.Read(bs)
-	HandleErr(err)
+	file.ReadAt(bs, offset)
 	l := ByteToInt64(bs)
 
 	bs = make([]byte, l)
-	_, err = file.Read(bs)
-	HandleErr(err)
+	file.ReadAt(bs, offset+8)
 	return string(bs)
 }
 
@@ -509,51 +709,146 @@ func (s *Storage) ReadTxt(table string, offset int64) string {
 func (s *Storage) InsertData(table string, data []any) {
 	// 写入基础数据
 	meta := GetTable(table)
+	indexes0 := ListIndexes(table)
+	for _, index := range indexes0 {
+		s.OpenIndex(index.Name).CheckUnique(PickData(index.Columns, meta.Columns, data))
+	}
 	file := s.OpenTable(table)
-	offset, err := file.Seek(0, 2)
-	HandleErr(err)
+	offset := file.Size
+	s.TransactionManager.AddUndoRecord(&UndoRecord{ // 修改数据前先写 undo log
+		Type:   UndoInsert,
+		Table:  table,
+		Offset: offset,
+	})
 	bs := BatchData2Byte(data, meta.Columns, func(value string) int64 {
 		return s.WriteTxt(table, value)
 	})
 	bs = append([]byte{RecordNotDelete}, bs...) // 默认肯定是没有删除的
-	_, err = file.Write(bs)
-	HandleErr(err)
+	s.TransactionManager.AddRedoRecord(&RedoRecord{Type: RedoInsert, Table: table, Offset: offset, Data: bs})
+	file.WriteAt(bs, offset)
 	// 写入索引
-	indexes0 := ListIndexes(table)
 	for _, index := range indexes0 {
 		data0 := PickData(index.Columns, meta.Columns, data)
 		btree := s.OpenIndex(index.Name)
 		btree.AddData(data0, offset)
 	}
-	s.TransactionManager.AddUndoRecord(&UndoRecord{
-		Type:   UndoInsert,
-		Table:  table,
-		Offset: offset,
-	})
 }
 
 // 删除一行数据 offset 偏移
 func (s *Storage) DeleteData(table string, offset int64) {
 	// 删除索引，删除前需要先查询到对应的 key
 	data := s.SelectData(table, offset)
+	s.TransactionManager.AddUndoRecord(&UndoRecord{ // 修改数据前先写 undo log
+		Type:   UndoDelete,
+		Table:  table,
+		Offset: offset,
+	})
+	s.TransactionManager.AddRedoRecord(&RedoRecord{Type: RedoDelete, Table: table, Offset: offset})
 	meta := GetTable(table)
 	indexes0 := ListIndexes(table)
 	for _, index := range indexes0 {
 		data0 := PickData(index.Columns, meta.Columns, data)
 		btree := s.OpenIndex(index.Name)
-		btree.DelData(data0)
+		btree.DelData(data0, offset)
 	}
 	// 标记删除
 	file := s.OpenTable(table)
-	_, err := file.Seek(offset, 0)
-	HandleErr(err)
-	_, err = file.Write([]byte{RecordIsDelete})
-	HandleErr(err)
-	s.TransactionManager.AddUndoRecord(&UndoRecord{
-		Type:  UndoDelete,
-		Table: table,
-		Data:  data,
+	file.WriteAt([]byte{RecordIsDelete}, offset)
+}
+
+// 回滚插入 崩溃恢复时记录与索引都可能没有写完整，需要容错
+func (s *Storage) RevertInsert(table string, offset int64) {
+	meta := GetTable(table)
+	file := s.OpenTable(table)
+	size := int64(GetColumnSize(meta.Columns) + 1)
+	if offset+size > file.Size { // 记录没有写完整，索引肯定还没写，直接截断
+		file.Truncate(offset)
+		return
+	}
+	s.TransactionManager.AddRedoRecord(&RedoRecord{Type: RedoDelete, Table: table, Offset: offset})
+	s.ReplayDelete(table, offset)
+}
+
+// 回滚删除 删除只是标记删除，原地恢复标记并补齐索引即可
+func (s *Storage) RevertDelete(table string, offset int64) {
+	s.TransactionManager.AddRedoRecord(&RedoRecord{Type: RedoRestore, Table: table, Offset: offset})
+	s.ReplayRestore(table, offset)
+}
+
+// ReplayXxx 都是幂等的，不记录日志，用于崩溃恢复与回滚
+
+func (s *Storage) ReplayTxt(table string, offset int64, bs []byte) {
+	s.OpenString(table).WriteAt(bs, offset)
+}
+
+func (s *Storage) ReplayInsert(table string, offset int64, bs []byte) {
+	s.OpenTable(table).WriteAt(bs, offset)
+	s.addIndexes(table, offset, bs)
+}
+
+// 标记删除一条记录，只删除指向该记录的索引  记录已经标记删除了索引也可能没有落盘，依旧需要处理
+func (s *Storage) ReplayDelete(table string, offset int64) {
+	bs := s.readWrittenRecord(table, offset)
+	if bs == nil {
+		return
+	}
+	if !s.SkipIndex {
+		meta := GetTable(table)
+		data := BatchByte2Data(bs[1:], meta.Columns, func(offset int64) string {
+			return s.ReadTxt(table, offset)
+		})
+		for _, index := range ListIndexes(table) {
+			data0 := PickData(index.Columns, meta.Columns, data)
+			s.OpenIndex(index.Name).RemoveData(data0, offset)
+		}
+	}
+	s.OpenTable(table).WriteAt([]byte{RecordIsDelete}, offset)
+}
+
+// 恢复一条被标记删除的记录并补齐索引
+func (s *Storage) ReplayRestore(table string, offset int64) {
+	bs := s.readWrittenRecord(table, offset)
+	if bs == nil {
+		return
+	}
+	s.addIndexes(table, offset, bs)
+	s.OpenTable(table).WriteAt([]byte{RecordNotDelete}, offset)
+}
+
+func (s *Storage) readRecord(table string, offset int64) []byte {
+	meta := GetTable(table)
+	bs := make([]byte, GetColumnSize(meta.Columns)+1)
+	s.OpenTable(table).ReadAt(bs, offset)
+	return bs
+}
+
+// 回滚的插入没有 REDO 记录，崩溃前也可能没有落盘，但回滚本身的 REDO 记录已经写入了
+// 重做时记录不存在或不完整(超出文件或删除标记无效)返回 nil 跳过即可
+func (s *Storage) readWrittenRecord(table string, offset int64) []byte {
+	meta := GetTable(table)
+	if offset+int64(GetColumnSize(meta.Columns)+1) > s.OpenTable(table).Size {
+		return nil
+	}
+	bs := s.readRecord(table, offset)
+	if bs[0] != RecordIsDelete && bs[0] != RecordNotDelete {
+		return nil
+	}
+	return bs
+}
+
+// 补齐一条记录的索引，已经存在的直接复用
+func (s *Storage) addIndexes(table string, offset int64, bs []byte) {
+	if s.SkipIndex {
+		return
+	}
+	meta := GetTable(table)
+	data := BatchByte2Data(bs[1:], meta.Columns, func(offset int64) string {
+		return s.ReadTxt(table, offset)
 	})
+	for _, index := range ListIndexes(table) {
+		data0 := PickData(index.Columns, meta.Columns, data)
+		s.OpenIndex(index.Name).RestoreData(data0, offset)
+	}
 }
 
 // 修改一行数据 offset 偏移 data 全字段，覆盖更新，主要方便索引更新
@@ -564,14 +859,8 @@ func (s *Storage) UpdateData(table string, offset int64, data []any) {
 
 // 更具偏移获取数据
 func (s *Storage) SelectData(table string, offset int64) []any {
-	file := s.OpenTable(table)
 	meta := GetTable(table)
-	_, err := file.Seek(offset, 0)
-	HandleErr(err)
-	size := GetColumnSize(meta.Columns) + 1
-	bs := make([]byte, size)
-	_, err = file.Read(bs)
-	HandleErr(err)
+	bs := s.readRecord(table, offset)
 	if bs[0] != RecordNotDelete {
 		panic(fmt.Sprintf("record %v is not exist", offset))
 	} // 移除删除标记
@@ -580,20 +869,26 @@ func (s *Storage) SelectData(table string, offset int64) []any {
 	})
 }
 
-// offset 第一次传 0 就行了 后面使用返回值
-func (s *Storage) NextData(table string, offset int64) ([]any, int64, int64) {
+// 表数据的大小，扫描时记录下来，防止扫描到扫描过程中新插入的数据(更新是删除后再插入的)
+func (s *Storage) TableSize(table string) int64 {
+	return s.OpenTable(table).Size
+}
+
+// 表的大概行数 包含已经删除的
+func (s *Storage) TableRows(table string) int64 {
+	meta := GetTable(table)
+	return s.TableSize(table) / int64(GetColumnSize(meta.Columns)+1)
+}
+
+// offset 第一次传 0 就行了 后面使用返回值  maxOffset 为扫描的结束位置
+func (s *Storage) NextData(table string, offset int64, maxOffset int64) ([]any, int64, int64) {
 	meta := GetTable(table)
 	size := GetColumnSize(meta.Columns) + 1
-	// 寻找记录
+	// 寻找记录 都在缓存池中读取，不再每行一次系统调用
 	file := s.OpenTable(table)
-	maxOffset, err := file.Seek(0, 2)
-	HandleErr(err)
 	bs := make([]byte, size)
-	for offset < maxOffset {
-		_, err = file.Seek(offset, 0)
-		HandleErr(err)
-		_, err = file.Read(bs)
-		HandleErr(err)
+	for offset+int64(size) <= maxOffset {
+		file.ReadAt(bs, offset)
 		if bs[0] == RecordNotDelete {
 			return BatchByte2Data(bs[1:], meta.Columns, func(offset int64) string {
 				return s.ReadTxt(table, offset)
@@ -609,16 +904,59 @@ func (s *Storage) SelectIndex(index string, keys []any) int64 {
 	return index0.GetData(keys)
 }
 
-// 第一次 node 传 nil idx 传 0
-func (s *Storage) NextIndex(index string, node *BTreeNode, idx int) ([]any, *BTreeNode, int) {
+// 索引扫描的范围 边界都是索引列的前缀，为空表示没有边界
+type IndexRange struct {
+	Low         []any
+	LowInclude  bool
+	High        []any
+	HighInclude bool
+}
+
+func (r *IndexRange) String() string {
+	low, high := "(-inf", "+inf)"
+	if len(r.Low) > 0 {
+		low = fmt.Sprintf("(%v", r.Low)
+		if r.LowInclude {
+			low = fmt.Sprintf("[%v", r.Low)
+		}
+	}
+	if len(r.High) > 0 {
+		high = fmt.Sprintf("%v)", r.High)
+		if r.HighInclude {
+			high = fmt.Sprintf("%v]", r.High)
+		}
+	}
+	return low + "," + high
+}
+
+// 第一次 node 传 nil idx 传 0  rng 为空扫描全部索引
+func (s *Storage) NextIndex(index string, rng *IndexRange, node *BTreeNode, idx int) ([]any, *BTreeNode, int) {
 	index0 := s.OpenIndex(index)
 	if node == nil {
-		node = index0.GetFirstNode()
+		if rng != nil && len(rng.Low) > 0 {
+			node = index0.SeekNode(rng.Low, rng.LowInclude)
+		} else {
+			node = index0.GetFirstNode()
+		}
 	}
 	for {
 		if idx < len(node.Entries) {
-			if node.Entries[idx].Delete == RecordNotDelete {
-				return append(node.Entries[idx].Key, node.Entries[idx].Data), node, idx + 1
+			entry := node.Entries[idx]
+			if rng != nil && len(rng.Low) > 0 { // 还没到下边界
+				res := index0.ComparePrefix(entry.Key, rng.Low)
+				if res < 0 || (!rng.LowInclude && res == 0) {
+					idx++
+					continue
+				}
+			}
+			if rng != nil && len(rng.High) > 0 { // 超过上边界后面的都不需要了
+				res := index0.ComparePrefix(entry.Key, rng.High)
+				if res > 0 || (!rng.HighInclude && res == 0) {
+					return nil, nil, 0
+				}
+			}
+			if entry.Delete == RecordNotDelete {
+				return append(index0.Index.UserKey(entry.Key), entry.Data), node, idx + 1
 			}
 			idx++
 		} else {
@@ -6,30 +6,52 @@ package main
 
 const (
 	// DDL
-	CREATE = "CREATE"
-	//DROP   = "DROP"
-	TABLE = "TABLE"
-	INDEX = "INDEX"
+	CREATE   = "CREATE"
+	DROP     = "DROP"
+	TRUNCATE = "TRUNCATE"
+	TABLE    = "TABLE"
+	INDEX    = "INDEX"
+	UNIQUE   = "UNIQUE"
+	IF       = "IF"
+	EXISTS   = "EXISTS" // 也用于 EXISTS 子查询
+	ALTER    = "ALTER"
+	ADD      = "ADD"
+	COLUMN   = "COLUMN"
+	RENAME   = "RENAME"
+	MODIFY   = "MODIFY"
+	TO       = "TO"
+	DEFAULT  = "DEFAULT"
 	// other
-	//EXPLAIN = "EXPLAIN"
+	EXPLAIN = "EXPLAIN"
+	ANALYZE = "ANALYZE"
 	// select
-	SELECT   = "SELECT"
-	STAR     = "STAR" // *
-	FROM     = "FROM"
-	WHERE    = "WHERE"
-	GROUP    = "GROUP"
-	ORDER    = "ORDER"
-	BY       = "BY"
-	ASC      = "ASC"
-	DESC     = "DESC"
-	JOIN     = "JOIN"
-	DISTINCT = "DISTINCT"
-	LIMIT    = "LIMIT"
-	OFFSET   = "OFFSET"
-	//LEFT   = "LEFT"
-	//RIGHT  = "RIGHT"
-	//INNER  = "INNER"
-	ON = "ON"
+	SELECT    = "SELECT"
+	STAR      = "STAR" // *
+	FROM      = "FROM"
+	WHERE     = "WHERE"
+	GROUP     = "GROUP"
+	HAVING    = "HAVING"
+	ORDER     = "ORDER"
+	BY        = "BY"
+	ASC       = "ASC"
+	DESC      = "DESC"
+	JOIN      = "JOIN"
+	DISTINCT  = "DISTINCT"
+	LIMIT     = "LIMIT"
+	OFFSET    = "OFFSET"
+	LEFT      = "LEFT"
+	RIGHT     = "RIGHT"
+	INNER     = "INNER"
+	FULL      = "FULL"
+	OUTER     = "OUTER"
+	SEMI      = "SEMI" // 半连接 子查询改写为连接时使用，不是关键字
+	ANTI      = "ANTI" // 反连接 同上
+	ON        = "ON"
+	AS        = "AS"
+	UNION     = "UNION"
+	INTERSECT = "INTERSECT"
+	EXCEPT    = "EXCEPT"
+	ALL       = "ALL"
 	// DML
 	INSERT = "INSERT"
 	INTO   = "INTO"
@@ -43,15 +65,28 @@ const (
 	LPAREN = "LPAREN" // (
 	RPAREN = "RPAREN" // )
 	// operator
-	EQ  = "EQ" // =
-	NE  = "NE" // !=
-	GT  = "GT" // >
-	GE  = "GE" // >=
-	LT  = "LT" // <
-	LE  = "LE" // <=
-	AND = "AND"
-	OR  = "OR"
-	//NOT = "NOT"  暂时先不支持一元操作符
+	EQ      = "EQ" // =
+	NE      = "NE" // !=
+	GT      = "GT" // >
+	GE      = "GE" // >=
+	LT      = "LT" // <
+	LE      = "LE" // <=
+	AND     = "AND"
+	OR      = "OR"
+	NOT     = "NOT"
+	IS      = "IS"
+	ISNOT   = "ISNOT" // IS NOT 合并后的操作符，不是关键字
+	IN      = "IN"
+	NOTIN   = "NOTIN" // NOT IN 合并后的操作符，不是关键字
+	BETWEEN = "BETWEEN"
+	LIKE    = "LIKE"
+	NOTLIKE = "NOTLIKE" // NOT LIKE 合并后的操作符，不是关键字
+	ESCAPE  = "ESCAPE"
+	PLUS    = "PLUS"    // +
+	MINUS   = "MINUS"   // -  也用于负数
+	SLASH   = "SLASH"   // /  乘法使用 STAR
+	PERCENT = "PERCENT" // %
+	CONCAT  = "CONCAT"  // ||
 	// data type
 	ID = "ID" // wsws2233 变量名称
 	// 支持的数据类型 其中 INT FLOAT 不仅是数据类型还是关键字 VARCHAR TEXT 指定的数据类型都是 STR
@@ -60,52 +95,80 @@ const (
 	STR     = "STR" // '你好'
 	VARCHAR = "VARCHAR"
 	TEXT    = "TEXT"
-	//NULL = "NULL"
-	EOF = "EOF" // 结束标记
+	NULL    = "NULL"
+	BOOL    = "BOOL" // 常量折叠产生的 TRUE FALSE，不是关键字
+	EOF     = "EOF"  // 结束标记
 )
 
 var (
 	Keywords = map[string]string{
-		"CREATE": CREATE,
-		//"DROP":    DROP,
-		"TABLE": TABLE,
-		"INDEX": INDEX,
-		//"EXPLAIN": EXPLAIN,
-		"SELECT":   SELECT,
-		"FROM":     FROM,
-		"WHERE":    WHERE,
-		"GROUP":    GROUP,
-		"ORDER":    ORDER,
-		"BY":       BY,
-		"ASC":      ASC,
-		"DESC":     DESC,
-		"JOIN":     JOIN,
-		"DISTINCT": DISTINCT,
-		"LIMIT":    LIMIT,
-		"OFFSET":   OFFSET,
-		//"LEFT":   LEFT,
-		//"RIGHT":  RIGHT,
-		//"INNER":  INNER,
-		"ON":     ON,
-		"INSERT": INSERT,
-		"INTO":   INTO,
-		"VALUES": VALUES,
-		"DELETE": DELETE,
-		"UPDATE": UPDATE,
-		"SET":    SET,
-		"AND":    AND,
-		"OR":     OR,
-		//"NULL": NULL,
-		"INT":     INT,
-		"FLOAT":   FLOAT,
-		"VARCHAR": VARCHAR,
-		"TEXT":    TEXT,
+		"CREATE":    CREATE,
+		"DROP":      DROP,
+		"TRUNCATE":  TRUNCATE,
+		"TABLE":     TABLE,
+		"INDEX":     INDEX,
+		"UNIQUE":    UNIQUE,
+		"IF":        IF,
+		"EXISTS":    EXISTS,
+		"ALTER":     ALTER,
+		"ADD":       ADD,
+		"COLUMN":    COLUMN,
+		"RENAME":    RENAME,
+		"MODIFY":    MODIFY,
+		"TO":        TO,
+		"DEFAULT":   DEFAULT,
+		"EXPLAIN":   EXPLAIN,
+		"ANALYZE":   ANALYZE,
+		"SELECT":    SELECT,
+		"FROM":      FROM,
+		"WHERE":     WHERE,
+		"GROUP":     GROUP,
+		"HAVING":    HAVING,
+		"ORDER":     ORDER,
+		"BY":        BY,
+		"ASC":       ASC,
+		"DESC":      DESC,
+		"JOIN":      JOIN,
+		"DISTINCT":  DISTINCT,
+		"LIMIT":     LIMIT,
+		"OFFSET":    OFFSET,
+		"LEFT":      LEFT,
+		"RIGHT":     RIGHT,
+		"INNER":     INNER,
+		"FULL":      FULL,
+		"OUTER":     OUTER,
+		"ON":        ON,
+		"AS":        AS,
+		"UNION":     UNION,
+		"INTERSECT": INTERSECT,
+		"EXCEPT":    EXCEPT,
+		"ALL":       ALL,
+		"INSERT":    INSERT,
+		"INTO":      INTO,
+		"VALUES":    VALUES,
+		"DELETE":    DELETE,
+		"UPDATE":    UPDATE,
+		"SET":       SET,
+		"AND":       AND,
+		"OR":        OR,
+		"NOT":       NOT,
+		"IS":        IS,
+		"IN":        IN,
+		"BETWEEN":   BETWEEN,
+		"LIKE":      LIKE,
+		"ESCAPE":    ESCAPE,
+		"NULL":      NULL,
+		"INT":       INT,
+		"FLOAT":     FLOAT,
+		"VARCHAR":   VARCHAR,
+		"TEXT":      TEXT,
 	}
 )
 
 type Token struct {
 	Type  string
 	Value string
+	Pos   int // 在 sql 中的起始下标 用于报错
 }
 
 func NewToken(type0 string, value string) *Token {
@@ -4,7 +4,13 @@
 */
 package main
 
-import "fmt"
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path"
+)
 
 // 这里并没有实现锁机制，并发时会有问题  可以考虑对 表/数据页  加共享/排他锁
 // 也可以不加锁采用乐观的方式，在事务提交写入时再根据读取时间戳检查是否被修改，修改的话事务失败进行回滚并重试
@@ -14,7 +20,7 @@ import "fmt"
 // REDO LOG 也可以使用缓存但是需要在提交事件时必须写入磁盘，保证事务的提交
 // REDO LOG 记录是增量数据，可以用于数据库间数据的同步(MySql是使用其抽象BinLog实现的主要是因为底层存储引擎的复杂性)
 // UNDO LOG 在提交事务前所有操作都记录 事务未提交可能相关数据页已经写入磁盘了 UNDO LOG 在数据库崩溃重启时使用 UNDO LOG 对执行了一半没有提交的事务进行回滚
-// 事务开始时产生 UNDO LOG 事务提交时删除 UNDO LOG 并双写 REDO LOG
+// 事务中的脏页落盘前写入 UNDO LOG 事务提交时删除 UNDO LOG 并双写 REDO LOG
 // UNDO LOG 还可以用于实现 MVCC
 
 // StartTx CommitTx RollbackTx CheckPoint
@@ -22,7 +28,8 @@ import "fmt"
 
 // UNDO LOG 倒着恢复直到恢复到事务开启
 // 实现相关指令 不使用事务的话默认修改操作立即写磁盘
-// BEGIN COMMIT ROLLBACK 暂时只实现 UNDO LOG 的功能
+// UNDO 记录先放在内存中，事务修改过的脏页写入文件前才批量落盘(见 SyncUndo)，数据页没有落盘时不需要 UNDO LOG
+// BEGIN COMMIT ROLLBACK  UNDO LOG 落盘，启动时回滚未提交的事务  REDO LOG 见 redo.go
 
 const (
 	// 数据的更新是通过删除再插入实现的，只需要关注这两个就行了
@@ -30,60 +37,85 @@ const (
 	UndoInsert = 2
 )
 
+// undo.log 中每条记录 记录长度(uint32) 类型(uint8) 表名长度(uint8) 表名 偏移(int64)
+// 记录长度用于识别崩溃时写了一半的记录，写了一半的记录对应的数据修改肯定还没有发生，直接丢弃即可
+
 type UndoRecord struct {
 	Type   int8
 	Table  string // 先存储长度(uint8)，再存储内容
-	Offset int64  // 偏移，Delete记录专用
-	Data   []any  // 要添加的数据，Insert记录专用，数据数量(uint8) list[数据类型(uint8) 数据内容(str需要先有长度)]
+	Offset int64  // 插入记录的偏移或被删除记录的偏移 删除只是标记删除，回滚时原地恢复即可
 }
 
-type TransactionManager struct { // 简单实现只实现 UNDO LOG 没有支持多线程，也不需要事务id
-	//UndoLog *os.File // 事务中有值，否则为 nil
+type TransactionManager struct { // 简单实现 没有支持多线程，也不需要事务id
+	UndoLog       *os.File // 有 UNDO 记录落盘时才创建，否则为 nil
+	RedoLogger    *RedoLogger
 	Storage       *Storage
 	InTransaction bool
 	UndoRecords   []*UndoRecord
+	UndoSynced    int // 已经写入 undo.log 的记录数
 }
 
 func NewTransactionManager(storage *Storage) *TransactionManager {
-	return &TransactionManager{Storage: storage, InTransaction: false}
+	res := &TransactionManager{Storage: storage, InTransaction: false, RedoLogger: NewRedoLogger()}
+	storage.Pool.BeforeFlush = res.SyncUndo
+	return res
 }
 
 func (t *TransactionManager) Begin() {
 	if t.InTransaction {
-		panic("transaction already started")
+		panic(&ExecError{Msg: "transaction already started"})
 	}
 	t.InTransaction = true
 	t.UndoRecords = make([]*UndoRecord, 0)
-	// 创建 undo.log 文件
-	//var err error
-	//t.UndoLog, err = os.Create(path.Join(BasePath, UndoLog))
-	//HandleErr(err)
+	t.UndoSynced = 0
 }
 
 func (t *TransactionManager) Commit() {
-	// 必须在事务中才能提交即 UndoLog 文件必须存在  提交事务后不再需要回滚  删除 UndoLog 文件
+	// 必须在事务中才能提交  提交事务后不再需要回滚  删除 UndoLog 文件
 	if !t.InTransaction {
-		panic("transaction not started")
+		panic(&ExecError{Msg: "transaction not started"})
 	}
-	//HandleErr(t.UndoLog.Close())
-	//t.UndoLog = nil
-	//HandleErr(os.Remove(path.Join(BasePath, UndoLog)))
 	t.InTransaction = false
+	t.FlushRedo() // REDO LOG 落盘就算提交成功了，数据文件等检查点再落盘
+	t.RemoveUndoLog()
 }
 
 func (t *TransactionManager) Rollback() {
-	// 必须在事务中才能回滚即 UndoLog 文件必须存在  按 UndoLog 文件内容倒序回滚
+	// 必须在事务中才能回滚  按 UNDO 记录倒序回滚
 	if !t.InTransaction {
-		panic("transaction not started")
+		panic(&ExecError{Msg: "transaction not started"})
 	}
 	t.InTransaction = false // 回滚时关闭了事务，保证回滚操作不会再计入事务中
-	for i := len(t.UndoRecords) - 1; i >= 0; i++ {
+	t.RedoLogger.Discard()  // 事务中的修改不再需要重做，回滚操作本身会作为普通修改写入 REDO LOG
+	t.revert(0)
+	t.RemoveUndoLog()
+}
+
+// 语句开始前记录 UNDO 的位置，语句出错时只回滚这条语句的修改
+func (t *TransactionManager) Savepoint() int {
+	return len(t.UndoRecords)
+}
+
+// 回滚到 savepoint 事务继续 回滚操作作为事务中的修改写入 REDO LOG
+// undo.log 中的记录保留，崩溃恢复时再回滚一遍也是幂等的
+func (t *TransactionManager) RollbackTo(savepoint int) {
+	if !t.InTransaction {
+		panic(&ExecError{Msg: "transaction not started"})
+	}
+	t.revert(savepoint)
+	t.UndoRecords = t.UndoRecords[:savepoint]
+	t.UndoSynced = min(t.UndoSynced, savepoint)
+}
+
+// 倒序回滚 savepoint 之后的 UNDO 记录
+func (t *TransactionManager) revert(savepoint int) {
+	for i := len(t.UndoRecords) - 1; i >= savepoint; i-- {
 		record := t.UndoRecords[i]
 		switch record.Type {
 		case UndoInsert: // insert 的反向操作 Delete
-			t.Storage.DeleteData(record.Table, record.Offset)
-		case UndoDelete: // delete 的反向操作 Insert
-			t.Storage.InsertData(record.Table, record.Data)
+			t.Storage.RevertInsert(record.Table, record.Offset)
+		case UndoDelete: // delete 的反向操作 恢复删除标记
+			t.Storage.RevertDelete(record.Table, record.Offset)
 		default:
 			panic(fmt.Sprintf("invalid undo record type %d", record.Type))
 		}
@@ -94,14 +126,148 @@ func (t *TransactionManager) AddUndoRecord(record *UndoRecord) {
 	if !t.InTransaction { // 不在事务中直接抛弃  外界不感知是否在事务中
 		return
 	}
-	// 在事务中写入 UndoLog
-	//bs := t.MarshalRecord(record)
-	//json.Unmarshal()
 	t.UndoRecords = append(t.UndoRecords, record)
 }
 
-//func (t *TransactionManager) MarshalRecord(record *UndoRecord) []byte {
-//
-//}
+// 修改过的数据页写入文件前 对应的 UNDO 记录必须先落盘，崩溃后才能回滚
+// 回滚过程中也可能写入数据页，不能只在事务中才落盘
+func (t *TransactionManager) SyncUndo() {
+	if t.UndoSynced >= len(t.UndoRecords) {
+		return
+	}
+	if t.UndoLog == nil {
+		var err error
+		t.UndoLog, err = os.Create(path.Join(BasePath, UndoLog))
+		HandleErr(err)
+	}
+	buff := &bytes.Buffer{}
+	for _, record := range t.UndoRecords[t.UndoSynced:] {
+		buff.Write(MarshalRecord(record))
+	}
+	_, err := t.UndoLog.Write(buff.Bytes())
+	HandleErr(err)
+	HandleErr(t.UndoLog.Sync())
+	t.UndoSynced = len(t.UndoRecords)
+}
+
+func (t *TransactionManager) AddRedoRecord(record *RedoRecord) {
+	t.RedoLogger.AddRecord(record)
+	if !t.InTransaction { // 不在事务中的修改立即写入，保证修改数据前日志已落盘
+		t.FlushRedo()
+	}
+}
+
+func (t *TransactionManager) FlushRedo() {
+	if t.RedoLogger.Commit() {
+		t.Checkpoint()
+	}
+}
+
+func (t *TransactionManager) Checkpoint() {
+	t.Storage.SyncAll() // 先把所有数据落盘
+	t.RedoLogger.Checkpoint()
+}
+
+// 删除表，清空表等 DDL 会直接删除数据文件，不能回滚也不记录 REDO LOG
+// 执行前先做检查点，保证之后不会再重做到被删除的数据
+func (t *TransactionManager) BeforeDDL() {
+	if t.InTransaction {
+		panic(&ExecError{Msg: "ddl not support in transaction"})
+	}
+	t.Checkpoint()
+}
+
+func (t *TransactionManager) Close() {
+	// 正常关闭也做一次检查点  若还在事务中保留 undo.log 下次启动时回滚
+	t.Checkpoint()
+	t.RedoLogger.Close()
+	if t.UndoLog != nil {
+		HandleErr(t.UndoLog.Close())
+		t.UndoLog = nil
+	}
+}
+
+func (t *TransactionManager) RemoveUndoLog() {
+	if t.UndoLog != nil {
+		HandleErr(t.UndoLog.Close())
+		t.UndoLog = nil
+	}
+	if err := os.Remove(path.Join(BasePath, UndoLog)); !os.IsNotExist(err) { // 没有落盘过就没有 undo.log
+		HandleErr(err)
+	}
+	t.UndoRecords = nil
+	t.UndoSynced = 0
+}
+
+func MarshalRecord(record *UndoRecord) []byte {
+	buff := &bytes.Buffer{}
+	buff.WriteByte(byte(record.Type))
+	buff.WriteByte(byte(len(record.Table)))
+	buff.WriteString(record.Table)
+	buff.Write(Int64ToByte(record.Offset))
+	bs := make([]byte, 4)
+	binary.LittleEndian.PutUint32(bs, uint32(buff.Len()))
+	return append(bs, buff.Bytes()...)
+}
+
+// 返回解析出的记录与消耗的字节数 数据不完整返回 nil
+func UnmarshalRecord(bs []byte) (*UndoRecord, int) {
+	if len(bs) < 4 {
+		return nil, 0
+	}
+	l := int(binary.LittleEndian.Uint32(bs))
+	if len(bs) < 4+l {
+		return nil, 0
+	}
+	bs = bs[4 : 4+l]
+	tableLen := int(bs[1])
+	return &UndoRecord{
+		Type:   int8(bs[0]),
+		Table:  string(bs[2 : 2+tableLen]),
+		Offset: ByteToInt64(bs[2+tableLen : 2+tableLen+8]),
+	}, 4 + l
+}
+
+// 启动时若存在 undo.log 说明上次事务没有提交就异常退出了，倒序回滚其中的记录 返回是否回滚了修改
+func RecoverUndoLog(txManager *TransactionManager) bool {
+	bs, err := os.ReadFile(path.Join(BasePath, UndoLog))
+	if os.IsNotExist(err) {
+		return false
+	}
+	HandleErr(err)
+	txManager.InTransaction = true
+	txManager.UndoRecords = make([]*UndoRecord, 0)
+	for len(bs) > 0 {
+		record, l := UnmarshalRecord(bs)
+		if record == nil { // 写了一半的记录
+			break
+		}
+		txManager.UndoRecords = append(txManager.UndoRecords, record)
+		bs = bs[l:]
+	}
+	txManager.UndoSynced = len(txManager.UndoRecords)
+	txManager.Rollback()
+	return true
+}
+
+// 崩溃恢复 先重做已提交的修改，再回滚未提交的事务
+// 两个检查点之间索引的脏页随时可能被淘汰写入，例如节点分裂只写入了一半，REDO UNDO 都是逻辑日志修复不了
+// 所以恢复时只处理数据文件，有修改时再根据数据重建所有索引  没有需要恢复的修改说明上次检查点后索引没有写入过
+func Recover() {
+	storage := NewStorage()
+	txManager := NewTransactionManager(storage)
+	storage.TransactionManager = txManager
+	storage.SkipIndex = true
+	redo := RecoverRedoLog(storage)
+	undo := RecoverUndoLog(txManager)
+	storage.SkipIndex = false
+	if redo || undo {
+		for _, index := range CloneSlice(indexes) {
+			storage.BuildIndex(index)
+		}
+	}
+	RecoverAlterLog(storage)
+	storage.Close()
+}
 
-// MVCC 实现  MySql 协议
+// MVCC 实现
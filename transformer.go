@@ -6,12 +6,21 @@ package main
 
 import (
 	"fmt"
+	"math"
+	"sort"
 	"strings"
 )
 
 type Transformer struct {
-	Storage *Storage
-	Node    INode
+	Storage     *Storage
+	Node        INode
+	Tables      map[string]string                // select 中使用的 别名 -> 表名  没有起别名的别名就是表名 派生表的表名为空
+	Derived     map[string]*DerivedTableOperator // 派生表 别名 -> 子查询
+	Outer       *Transformer                     // 子查询的外层查询 用于解析引用的外层列
+	Params      []*ParamNode                     // 引用外层列的参数 由外层当前行绑定
+	Refs        []*ParamNode                     // 用到的所有参数 包含更外层绑定的
+	Columns     []*Column                        // select 的输出列 转换时就确定 子查询使用
+	SubQueryIdx int                              // 子查询计数 用于生成列名
 }
 
 func NewTransformer(node INode, storage *Storage) *Transformer {
@@ -28,12 +37,27 @@ func (t *Transformer) Transform() IOperator {
 		return t.transformUpdate(target)
 	case *SelectNode:
 		return t.transformSelect(target)
+	case *SetOpNode:
+		return t.transformSetOp(target)
 	case *CreateTableNode:
 		return t.transformCreateTable(target)
 	case *CreateIndexNode:
 		return t.transformCreateIndex(target)
+	case *DropTableNode:
+		return NewDropTableOperator(t.Storage, target.Table, target.IfExists)
+	case *DropIndexNode:
+		return NewDropIndexOperator(t.Storage, target.Index, target.Table)
+	case *TruncateTableNode:
+		return NewTruncateTableOperator(t.Storage, target.Table)
+	case *AnalyzeTableNode:
+		return NewAnalyzeTableOperator(t.Storage, target.Table)
+	case *AlterTableNode:
+		return t.transformAlterTable(target)
+	case *ExplainNode:
+		t.Node = target.Stmt
+		return NewExplainOperator(t.Transform(), target.Analyze)
 	default:
-		panic(fmt.Sprintf("unknown node type: %T", t.Node))
+		panic(&ExecError{Msg: fmt.Sprintf("unknown node type: %T", t.Node)})
 	}
 }
 
@@ -42,56 +66,82 @@ func (t *Transformer) transformCreateIndex(node *CreateIndexNode) IOperator {
 	for _, column := range node.Columns { // 这里不能忽略表名称
 		columns = append(columns, fmt.Sprintf("%s.%s", node.Table, column.Value))
 	}
-	return NewCreateIndexOperator(t.Storage, node.Index, node.Table, columns)
+	return NewCreateIndexOperator(t.Storage, node.Index, node.Table, columns, node.Unique)
 }
 
 func (t *Transformer) transformCreateTable(node *CreateTableNode) IOperator {
 	columns := make([]*Column, 0)
 	for _, column := range node.Columns {
-		var typ int8
-		var l int64
-		switch column.Type {
-		case INT:
-			typ = TypInt
-			l = 8
-		case FLOAT:
-			typ = TypFloat
-			l = 8
-		case VARCHAR:
-			typ = TypStr
-			l = column.Len // 只有这里信任用户的输入
-		case TEXT:
-			typ = TypTxt
-			l = 8
-		default:
-			panic(fmt.Sprintf("unknown column type: %s", column.Type))
-		}
-		if l <= 0 {
-			panic(fmt.Sprintf("invalid column %v len %d", column, l))
-		}
-		columns = append(columns, &Column{
-			Name: fmt.Sprintf("%s.%s", node.Table, column.Name.Value),
-			Type: typ,
-			Len:  l,
-		})
+		columns = append(columns, t.transformColumn(node.Table, column))
 	}
 	return NewCreateTableOperator(node.Table, columns)
 }
 
+func (t *Transformer) transformColumn(table string, column *ColumnNode) *Column {
+	var typ int8
+	var l int64
+	switch column.Type {
+	case INT:
+		typ = TypInt
+		l = 8
+	case FLOAT:
+		typ = TypFloat
+		l = 8
+	case VARCHAR:
+		typ = TypStr
+		l = column.Len // 只有这里信任用户的输入
+	case TEXT:
+		typ = TypTxt
+		l = 8
+	default:
+		panic(&TypeError{Msg: fmt.Sprintf("unknown column type %s", column.Type)})
+	}
+	if l <= 0 {
+		panic(&TypeError{Msg: fmt.Sprintf("invalid len %d for column %s", l, column.Name.Value)})
+	}
+	return &Column{
+		Name:     fmt.Sprintf("%s.%s", table, column.Name.Value),
+		Type:     typ,
+		Len:      l,
+		Nullable: !column.NotNull,
+	}
+}
+
+func (t *Transformer) transformAlterTable(node *AlterTableNode) IOperator {
+	res := &AlterTableOperator{Storage: t.Storage, Table: node.Table, Action: node.Action}
+	if node.Column != nil {
+		res.Column = t.transformColumn(node.Table, node.Column)
+		res.Name = res.Column.Name
+	}
+	if node.Name != nil {
+		res.Name = fmt.Sprintf("%s.%s", node.Table, node.Name.Value)
+	}
+	if node.NewName != nil {
+		res.NewName = fmt.Sprintf("%s.%s", node.Table, node.NewName.Value)
+	}
+	if node.Default != nil {
+		res.Default = ValueToAny(node.Default, res.Column.Type)
+	}
+	res.OnceOperator = NewOnceOperator(res.AlterTable)
+	return res
+}
+
 func (t *Transformer) transformSelect(node *SelectNode) IOperator {
 	// 先进行 sql 重写
-	// 1. Fields.FuncNode 若是存在聚合函数且其没有 group 需要添加 group 修改语句为聚合函数
-	hasAggregate := false
+	// 0. ORDER BY HAVING 中使用的输出列别名替换为对应的字段 需要在补全表名前处理
+	t.resolveAliases(node)
+	// 1. Fields.FuncNode 若是存在聚合函数(包含表达式中的)且其没有 group 需要添加 group 修改语句为聚合函数
+	aggregates := make([]*FuncNode, 0)
 	for _, field := range node.Fields {
-		if func0, ok := field.(*FuncNode); ok {
-			item := GetFunc(func0.FuncName)
-			if item.IsAggregate {
-				hasAggregate = true
-				break
-			}
-		}
+		aggregates = append(aggregates, t.getAggregates(field)...)
+	}
+	for _, order := range node.Orders {
+		aggregates = append(aggregates, t.getAggregates(order.Field)...)
+	}
+	if node.Having != nil { // 只在 having 中使用的聚合函数也需要计算
+		aggregates = append(aggregates, t.getAggregates(node.Having)...)
 	}
-	if hasAggregate && node.Groups == nil {
+	if len(aggregates) > 0 && node.Groups == nil {
 		node.Groups = make([]*IDNode, 0) // 这里注意 nil 与 make([]*IDNode, 0) 是不一样的
 	}
 	// 2. Fields.ImmNode 若是存在全部收集构建扩展表  最后再添加扩展列
@@ -102,8 +152,12 @@ func (t *Transformer) transformSelect(node *SelectNode) IOperator {
 	for _, field := range node.Fields {
 		if immNode, ok := field.(*ImmNode); ok {
 			typ := TokenTypeToType(immNode.Type)
+			name := fmt.Sprintf("Column%d", columnIdx)
+			if alias, has := node.Aliases[immNode]; has {
+				name = alias
+			}
 			immColumns = append(immColumns, &Column{
-				Name: fmt.Sprintf("Column%d", columnIdx),
+				Name: name,
 				Type: typ,
 				Len:  8, // 这里都先认为是 8 位 这个数据仅展示不落表
 			})
@@ -125,28 +179,51 @@ func (t *Transformer) transformSelect(node *SelectNode) IOperator {
 		}
 	}
 	node.Fields = fields
-	if hasStar { // 添加所有 相关字段 节点
-		table := GetTable(node.From)
-		for _, column := range table.Columns {
-			node.Fields = append(node.Fields, &IDNode{Value: column.Name})
+	// 收集所有表的别名 没有起别名的使用表名
+	if node.Alias == "" {
+		node.Alias = node.From
+	}
+	tables := []string{node.Alias}
+	t.Tables = map[string]string{node.Alias: node.From}
+	t.Derived = make(map[string]*DerivedTableOperator)
+	if node.SubQuery != nil {
+		t.Derived[node.Alias] = t.transformDerived(node.SubQuery, node.Alias)
+	}
+	for _, join := range node.Joins {
+		if join.Alias == "" {
+			join.Alias = join.Table
+		}
+		if _, has := t.Tables[join.Alias]; has {
+			panic(&AmbiguousError{Kind: "table", Name: join.Alias})
 		}
-		if node.Join != nil {
-			table = GetTable(node.Join.Table)
-			for _, column := range table.Columns {
+		tables = append(tables, join.Alias)
+		t.Tables[join.Alias] = join.Table
+		if join.SubQuery != nil {
+			t.Derived[join.Alias] = t.transformDerived(join.SubQuery, join.Alias)
+		}
+	}
+	if hasStar { // 添加所有 相关字段 节点
+		for _, alias := range tables {
+			for _, column := range t.getTableColumns(alias) {
 				node.Fields = append(node.Fields, &IDNode{Value: column.Name})
 			}
 		}
 	}
-	// 整理节点并移除重复 IDNode 节点
-	if node.Join == nil { // 只有非 join 情况下可以省略表名称
-		t.tidyNodeField(node, node.From)
+	// 整理节点并移除重复 IDNode 节点  多表时没有歧义的字段也可以省略表名称
+	t.tidyNodeField(node, tables...)
+	if t.Outer != nil { // 相关子查询 引用的外层列替换为参数
+		t.bindParams(node)
 	}
+	// 能改写为半连接(反连接)的子查询条件从 where 中移除，其余的子查询生成执行计划
+	semiJoins := t.decorrelate(node)
+	t.transformSubQueries(node)
 	idNodeSet := make(map[string]struct{})
 	fields = make([]INode, 0)
 	for _, field := range node.Fields {
 		if idNode, ok := field.(*IDNode); ok {
-			if _, has := idNodeSet[idNode.Value]; !has {
-				idNodeSet[idNode.Value] = struct{}{}
+			key := idNode.Value + "#" + node.Aliases[idNode] // 别名不同的不算重复
+			if _, has := idNodeSet[key]; !has {
+				idNodeSet[key] = struct{}{}
 				fields = append(fields, field)
 			}
 		} else { // 这里不是 IDNode 就是 FuncNode
@@ -154,28 +231,16 @@ func (t *Transformer) transformSelect(node *SelectNode) IOperator {
 		}
 	}
 	node.Fields = fields
-	// 先处理表与 join 再处理 where 条件   只有索引覆盖才走索引
+	// 查询用到的所有列 扫描表时只保留这些列
 	fieldNames := t.extraNodeField(node)
-	fieldNames = DistinctSlice(fieldNames) // 先处理 from
-	fromTableFields := t.getTableFields(node.From, fieldNames)
-	fromIndex := t.getMostMatchIndex(node.From, fromTableFields)
-	var input IOperator
-	if fromIndex != nil {
-		input = NewIndexScanOperator(t.Storage, fromIndex.Name)
-	} else {
-		input = NewTableScanOperator(t.Storage, node.From)
-	} // 处理 join
-	if node.Join != nil {
-		joinTableFields := t.getTableFields(node.Join.Table, fieldNames)
-		joinIndex := t.getMostMatchIndex(node.Join.Table, joinTableFields)
-		if joinIndex != nil {
-			input = NewJoinOperator(input, NewIndexScanOperator(t.Storage, joinIndex.Name), node.Join.Condition)
-		} else {
-			input = NewJoinOperator(input, NewTableScanOperator(t.Storage, node.Join.Table), node.Join.Condition)
-		}
+	for _, semiJoin := range semiJoins {
+		fieldNames = append(fieldNames, semiJoin.LeftKeys...)
 	}
-	if node.Where != nil {
-		input = NewFilterOperator(input, node.Where)
+	fieldNames = DistinctSlice(fieldNames) // 先处理 from
+	// from join where 先生成逻辑执行计划，经过改写后再生成物理算子
+	input := t.lowerPlan(t.rewritePlan(t.buildPlan(node), fieldNames))
+	for _, semiJoin := range semiJoins { // 半连接只输出左侧 不影响后面的处理
+		input = NewHashJoinOperator(input, semiJoin.Input, semiJoin.Type, semiJoin.LeftKeys, semiJoin.RightKeys, nil, false)
 	}
 	// 再处理 group distinct
 	if node.Groups != nil {
@@ -183,13 +248,13 @@ func (t *Transformer) transformSelect(node *SelectNode) IOperator {
 		for _, column := range node.Groups {
 			groupColumns = append(groupColumns, column.Value)
 		}
-		funcs0 := make([]*FuncNode, 0)
-		for _, field := range node.Fields {
-			if func0, ok := field.(*FuncNode); ok {
-				funcs0 = append(funcs0, func0)
-			}
-		}
-		input = NewGroupOperator(input, groupColumns, funcs0)
+		group := NewGroupOperator(input, groupColumns, aggregates).(*GroupOperator)
+		group.Streaming = t.isGroupSorted(input, groupColumns)
+		group.MemLimit = t.Storage.Config.GroupBufferSize
+		input = group
+	}
+	if node.Having != nil { // 聚合函数已经计算为 GroupOperator 的输出列了
+		input = NewFilterOperator(input, node.Having)
 	}
 	if node.Distinct != nil {
 		distinctFields := make([]string, 0)
@@ -198,69 +263,178 @@ func (t *Transformer) transformSelect(node *SelectNode) IOperator {
 		}
 		input = NewDistinctOperator(input, distinctFields)
 	}
-	// 最后再做 order by   limit
+	// 最后再做 order by   limit  按表达式排序的需要先计算出来
 	if node.Orders != nil {
-		input = NewSortOperator(input, node.Orders)
+		orderNodes := make([]INode, 0)
+		for _, order := range node.Orders {
+			if _, ok := order.Field.(*IDNode); !ok {
+				orderNodes = append(orderNodes, order.Field)
+			}
+		}
+		if len(orderNodes) > 0 {
+			input = NewFuncExecOperator(input, orderNodes)
+		}
+		input = t.newSort(input, node.Orders)
 	}
 	if node.Limit != nil {
-		input = NewLimitOperator(input, node.Limit.Limit, node.Limit.Offset)
+		input = t.transformLimit(input, node.Limit)
 	}
-	// 处理非聚合函数
-	funcs0 := make([]*FuncNode, 0)
+	// 处理非聚合函数与表达式
+	nodes := make([]INode, 0)
 	for _, field := range node.Fields {
-		if func0, ok := field.(*FuncNode); ok {
-			funcs0 = append(funcs0, func0)
+		if _, ok := field.(*IDNode); !ok {
+			nodes = append(nodes, field)
 		}
 	}
-	if len(funcs0) > 0 { // 内部会再次过滤掉聚合函数
-		input = NewFuncExecOperator(input, funcs0)
+	if len(nodes) > 0 { // 内部会再次过滤掉聚合函数与已经计算过的
+		input = NewFuncExecOperator(input, nodes)
 	}
 	// 选择字段裁剪 添加扩展列(扩展列没有按原始顺序，会直接排到后面)
 	fieldNames = make([]string, 0)
+	aliases := make([]string, 0)
 	for _, field := range node.Fields {
-		if idNode, ok1 := field.(*IDNode); ok1 {
-			fieldNames = append(fieldNames, idNode.Value)
-		} else if funcNode, ok2 := field.(*FuncNode); ok2 {
-			fieldNames = append(fieldNames, GetFuncColumnName(funcNode))
-		} else {
-			panic(fmt.Sprintf("not support node %v", node))
-		}
+		aliases = append(aliases, node.Aliases[field])
+		fieldNames = append(fieldNames, GetNodeColumnName(field))
 	}
-	input = NewProjectionOperator(input, fieldNames)
+	input = NewProjectionOperator(input, fieldNames, aliases)
 	if len(immColumns) > 0 && len(immData) > 0 {
 		input = NewExpandImmOperator(input, immColumns, immData)
 	}
+	t.Columns = t.getOutputColumns(node, tables, aggregates, immColumns)
 	return input
 }
 
+// 排序的内存上限使用配置的
+func (t *Transformer) newSort(input IOperator, orders []*OrderNode) IOperator {
+	sort := NewSortOperator(input, orders).(*SortOperator)
+	sort.MemLimit = t.Storage.Config.SortBufferSize
+	return sort
+}
+
+// 直接在排序上面的 LIMIT 排序只需要保留前 limit+offset 行
+func (t *Transformer) transformLimit(input IOperator, limit *LimitNode) IOperator {
+	if sort, ok := input.(*SortOperator); ok {
+		sort.TopN = limit.Limit + limit.Offset
+	}
+	return NewLimitOperator(input, limit.Limit, limit.Offset)
+}
+
+// 单个 select 或 复合查询
+func (t *Transformer) transformQuery(node INode) IOperator {
+	if setOp, ok := node.(*SetOpNode); ok {
+		return t.transformSetOp(setOp)
+	}
+	return t.transformSelect(node.(*SelectNode))
+}
+
+// 复合查询 两侧依次转换(子查询中共用外层查询与参数) 结果列由两侧的输出列合并
+func (t *Transformer) transformSetOp(node *SetOpNode) IOperator {
+	left := t.transformQuery(node.Left)
+	leftColumns := t.Columns
+	right := t.transformQuery(node.Right)
+	columns := MergeSetColumns(leftColumns, t.Columns)
+	var input IOperator
+	if node.Operator == UNION {
+		input = NewUnionOperator(left, right, node.All, columns)
+	} else {
+		input = NewIntersectOperator(left, right, node.Operator, node.All, columns)
+	}
+	// order by limit 作用于整个结果 只能使用结果列
+	if node.Orders != nil {
+		for _, order := range node.Orders {
+			order.Field = &IDNode{Value: t.findSetColumn(order.Field, columns)}
+		}
+		input = t.newSort(input, node.Orders)
+	}
+	if node.Limit != nil {
+		input = t.transformLimit(input, node.Limit)
+	}
+	t.Columns = columns
+	return input
+}
+
+// 结果列可以使用完整列名也可以省略表名
+func (t *Transformer) findSetColumn(field INode, columns []*Column) string {
+	idNode, ok := field.(*IDNode)
+	if !ok {
+		panic(&ExecError{Msg: "order by of set operation only support result column"})
+	}
+	res := ""
+	for _, column := range columns {
+		if column.Name == idNode.Value {
+			return column.Name
+		}
+		if GetShortName(column.Name) == idNode.Value {
+			if res != "" {
+				panic(&AmbiguousError{Kind: "column", Name: idNode.Value})
+			}
+			res = column.Name
+		}
+	}
+	if res == "" {
+		panic(&NotFoundError{Kind: "column", Name: idNode.Value})
+	}
+	return res
+}
+
+// 推断 select 的输出列 与 ProjectionOperator ExpandImmOperator 的输出一致
+func (t *Transformer) getOutputColumns(node *SelectNode, tables []string, aggregates []*FuncNode, immColumns []*Column) []*Column {
+	columns := make([]*Column, 0)
+	for _, alias := range tables {
+		columns = append(columns, t.getTableColumns(alias)...)
+	}
+	for _, aggregate := range aggregates {
+		var column *Column
+		if param, ok := GetAggregateParam(aggregate).(*IDNode); ok {
+			column = t.getColumn(param.Value)
+		}
+		typ, l := GetFunc(aggregate.FuncName).AggregateRetType(column)
+		columns = append(columns, &Column{Name: GetFuncColumnName(aggregate), Type: typ, Len: l})
+	}
+	res := make([]*Column, 0)
+	for _, field := range node.Fields {
+		typ, l := GetNodeType(field, columns)
+		name := node.Aliases[field]
+		if name == "" {
+			name = GetNodeColumnName(field)
+		}
+		res = append(res, &Column{Name: name, Type: typ, Len: l, Nullable: true})
+	}
+	return append(res, immColumns...)
+}
+
 func (t *Transformer) transformUpdate(node *UpdateNode) IOperator {
+	t.Tables = map[string]string{node.Table: node.Table}
 	t.tidyNodeField(node, node.Table)
+	t.transformSubQueries(node)
 	// 更新还有原值覆盖写入，必须使用全表扫描
 	input := NewTableScanOperator(t.Storage, node.Table)
-	input = NewFilterOperator(input, node.Where)
+	if node.Where != nil { // 没有条件更新整个表
+		input = NewFilterOperator(input, node.Where)
+	}
 	return NewUpdateOperator(input, t.Storage, node.Table, node.Sets)
 }
 
 func (t *Transformer) transformDelete(node *DeleteNode) IOperator {
+	t.Tables = map[string]string{node.Table: node.Table}
 	t.tidyNodeField(node, node.Table)
+	t.transformSubQueries(node)
 	// 可以看下索引是否满足需求，满足可以走索引
-	fields := t.extraNodeField(node.Where)
-	fields = DistinctSlice(fields)
-	index := t.getMostMatchIndex(node.Table, fields)
-	var input IOperator
-	if index == nil { // 走全表扫描
-		input = NewTableScanOperator(t.Storage, node.Table)
-	} else { // 走索引
-		input = NewIndexScanOperator(t.Storage, index.Name)
+	fields := DistinctSlice(t.extraNodeField(node))
+	input := t.scanTable(node.Table, node.Table, fields, node.Where)
+	if node.Where != nil { // 没有条件删除整个表
+		input = NewFilterOperator(input, node.Where)
 	}
-	input = NewFilterOperator(input, node.Where)
 	return NewDeleteOperator(input, t.Storage, node.Table)
 }
 
 func (t *Transformer) transformInsert(node *InsertNode) IOperator {
 	meta := GetTable(node.Table)
 	data := make([][]any, 0)
-	for _, value := range node.Values {
+	for i, value := range node.Values {
+		if len(value) != len(meta.Columns) {
+			panic(&ConstraintError{Kind: "value_count", Msg: fmt.Sprintf("column count doesn't match value count at row %d", i+1)})
+		}
 		row := make([]any, 0)
 		for i, column := range meta.Columns {
 			row = append(row, ValueToAny(value[i], column.Type))
@@ -270,63 +444,147 @@ func (t *Transformer) transformInsert(node *InsertNode) IOperator {
 	return NewInsertOperator(t.Storage, node.Table, data)
 }
 
+// ORDER BY HAVING 中没有表名的字段优先匹配输出列的别名 匹配上的直接使用别名对应的字段节点
+// 常量列最后才添加，不支持通过别名引用
+func (t *Transformer) resolveAliases(node *SelectNode) {
+	aliases := make(map[string]INode)
+	for _, field := range node.Fields {
+		if alias, has := node.Aliases[field]; has {
+			if _, ok := field.(*ImmNode); !ok {
+				aliases[alias] = field
+			}
+		}
+	}
+	if len(aliases) == 0 {
+		return
+	}
+	for _, order := range node.Orders {
+		order.Field = replaceAlias(order.Field, aliases)
+	}
+	if node.Having != nil {
+		replaceAlias(node.Having, aliases)
+	}
+}
+
+// 返回替换后的节点 子节点原地替换 子查询中的字段不处理
+func replaceAlias(node INode, aliases map[string]INode) INode {
+	switch target := node.(type) {
+	case *IDNode:
+		if field, has := aliases[target.Value]; has {
+			return field
+		}
+	case *ExprNode:
+		target.Left = replaceAlias(target.Left, aliases)
+		target.Right = replaceAlias(target.Right, aliases)
+	case *FuncNode:
+		for i, param := range target.Params {
+			target.Params[i] = replaceAlias(param, aliases)
+		}
+	case *ListNode:
+		for i, item := range target.Items {
+			target.Items[i] = replaceAlias(item, aliases)
+		}
+	}
+	return node
+}
+
 // tidyXxx 主要用于处理各种 Node 内部 IDNode 的名称问题
-func (t *Transformer) tidyNodeField(node INode, table string) {
+func (t *Transformer) tidyNodeField(node INode, tables ...string) {
 	if node == nil {
 		return
 	}
 	switch target := node.(type) {
 	case *CreateIndexNode:
 		for _, column := range target.Columns {
-			t.tidyNodeField(column, table)
+			t.tidyNodeField(column, tables...)
 		}
 	case *CreateTableNode:
 		for _, column := range target.Columns {
-			t.tidyNodeField(column.Name, table)
+			t.tidyNodeField(column.Name, tables...)
 		}
 	case *DeleteNode:
-		t.tidyNodeField(target.Where, table)
+		if target.Where != nil { // 没有条件时是 *ExprNode 类型的 nil 不能直接传下去
+			t.tidyNodeField(target.Where, tables...)
+		}
 	case *UpdateNode:
 		for _, set := range target.Sets {
-			t.tidyNodeField(set, table)
+			t.tidyNodeField(set, tables...)
+		}
+		if target.Where != nil {
+			t.tidyNodeField(target.Where, tables...)
 		}
-		t.tidyNodeField(target.Where, table)
 	case *SetNode:
-		t.tidyNodeField(target.Field, table)
-		t.tidyNodeField(target.Value, table)
+		t.tidyNodeField(target.Field, tables...)
+		t.tidyNodeField(target.Value, tables...)
 	case *SelectNode:
 		// 正常处理字段
 		for _, field := range target.Fields {
-			t.tidyNodeField(field, table)
+			t.tidyNodeField(field, tables...)
 		}
 		for _, item := range target.Distinct {
-			t.tidyNodeField(item, table)
-		} // join 表时相关字段必须携带 表名
-		//t.tidyNodeField(target.Join.Condition, table)
+			t.tidyNodeField(item, tables...)
+		}
+		for _, join := range target.Joins {
+			t.tidyNodeField(join.Condition, tables...)
+		}
 		if target.Where != nil {
-			t.tidyNodeField(target.Where, table)
+			t.tidyNodeField(target.Where, tables...)
 		}
 		for _, group := range target.Groups {
-			t.tidyNodeField(group, table)
+			t.tidyNodeField(group, tables...)
+		}
+		if target.Having != nil {
+			t.tidyNodeField(target.Having, tables...)
 		}
 		for _, order := range target.Orders {
-			t.tidyNodeField(order.Field, table)
+			t.tidyNodeField(order.Field, tables...)
 		}
 	case *ExprNode:
-		t.tidyNodeField(target.Left, table)
-		t.tidyNodeField(target.Right, table)
+		t.tidyNodeField(target.Left, tables...)
+		t.tidyNodeField(target.Right, tables...)
 	case *FuncNode:
 		for _, param := range target.Params {
-			t.tidyNodeField(param, table)
+			t.tidyNodeField(param, tables...)
+		}
+	case *ListNode:
+		for _, item := range target.Items {
+			t.tidyNodeField(item, tables...)
 		}
 	case *IDNode: // 真正干活的
 		idx := strings.IndexRune(target.Value, '.')
 		if idx < 0 { // 没有表名添加表名称
-			target.Value = fmt.Sprintf("%s.%s", table, target.Value)
+			target.Value = fmt.Sprintf("%s.%s", t.findFieldTable(target.Value, tables), target.Value)
 		}
 	}
 }
 
+// 多表时找到包含该字段的表 字段名不能有歧义
+// 子查询中找不到的再到外层查询中找
+func (t *Transformer) findFieldTable(field string, tables []string) string {
+	if len(tables) == 1 && t.Outer == nil {
+		return tables[0]
+	}
+	res := ""
+	for _, alias := range tables {
+		for _, column := range t.getTableColumns(alias) {
+			if column.Name != fmt.Sprintf("%s.%s", alias, field) {
+				continue
+			}
+			if res != "" {
+				panic(&AmbiguousError{Kind: "column", Name: field})
+			}
+			res = alias
+		}
+	}
+	if res == "" && t.Outer != nil {
+		return t.Outer.findFieldTable(field, t.Outer.getAliases())
+	}
+	if res == "" {
+		panic(&NotFoundError{Kind: "column", Name: field})
+	}
+	return res
+}
+
 // 可能会重复，需要自行去重
 func (t *Transformer) extraNodeField(node INode) []string {
 	res := make([]string, 0)
@@ -336,12 +594,16 @@ func (t *Transformer) extraNodeField(node INode) []string {
 
 	switch target := node.(type) {
 	case *DeleteNode:
-		res = append(res, t.extraNodeField(target.Where)...)
+		if target.Where != nil {
+			res = append(res, t.extraNodeField(target.Where)...)
+		}
 	case *UpdateNode:
 		for _, set := range target.Sets {
 			res = append(res, t.extraNodeField(set)...)
 		}
-		res = append(res, t.extraNodeField(target.Where)...)
+		if target.Where != nil {
+			res = append(res, t.extraNodeField(target.Where)...)
+		}
 	case *SetNode:
 		res = append(res, t.extraNodeField(target.Value)...)
 		res = append(res, target.Field.Value)
@@ -353,8 +615,8 @@ func (t *Transformer) extraNodeField(node INode) []string {
 		for _, item := range target.Distinct {
 			res = append(res, item.Value)
 		}
-		if target.Join != nil {
-			res = append(res, t.extraNodeField(target.Join.Condition)...)
+		for _, join := range target.Joins {
+			res = append(res, t.extraNodeField(join.Condition)...)
 		}
 		if target.Where != nil {
 			res = append(res, t.extraNodeField(target.Where)...)
@@ -362,8 +624,11 @@ func (t *Transformer) extraNodeField(node INode) []string {
 		for _, group := range target.Groups {
 			res = append(res, group.Value)
 		}
+		if target.Having != nil {
+			res = append(res, t.extraNodeField(target.Having)...)
+		}
 		for _, order := range target.Orders {
-			res = append(res, order.Field.Value)
+			res = append(res, t.extraNodeField(order.Field)...)
 		}
 	case *ExprNode:
 		res = append(res, t.extraNodeField(target.Left)...)
@@ -372,12 +637,474 @@ func (t *Transformer) extraNodeField(node INode) []string {
 		for _, param := range target.Params {
 			res = append(res, t.extraNodeField(param)...)
 		}
+	case *ListNode:
+		for _, item := range target.Items {
+			res = append(res, t.extraNodeField(item)...)
+		}
+	case *SubQueryNode: // 子查询需要使用当前行绑定的参数
+		for _, param := range target.Operator.Params {
+			res = append(res, param.Column.Name)
+		}
 	case *IDNode: // 真正干活的
 		res = append(res, target.Value)
 	}
 	return res
 }
 
+// 获取所有的聚合函数 包含表达式中的
+func (t *Transformer) getAggregates(node INode) []*FuncNode {
+	res := make([]*FuncNode, 0)
+	switch target := node.(type) {
+	case *FuncNode:
+		if GetFunc(target.FuncName).IsAggregate {
+			return append(res, target)
+		}
+		for _, param := range target.Params {
+			res = append(res, t.getAggregates(param)...)
+		}
+	case *ExprNode:
+		res = append(res, t.getAggregates(target.Left)...)
+		res = append(res, t.getAggregates(target.Right)...)
+	case *ListNode:
+		for _, item := range target.Items {
+			res = append(res, t.getAggregates(item)...)
+		}
+	}
+	return res
+}
+
+// 有等值条件时 两侧都按连接列有序使用 MergeJoin(只支持内连接) 否则按估计的代价选择 HashJoin 或嵌套循环 都没有就只能使用嵌套循环
+func (t *Transformer) transformJoin(left IOperator, right IOperator, join *JoinNode) IOperator {
+	leftKeys, rightKeys := t.getJoinKeys(join.Condition, join.Alias)
+	if len(leftKeys) == 0 {
+		return NewJoinOperator(left, right, join.Type, join.Condition)
+	}
+	leftSorted, rightSorted := t.getSortedColumn(left), t.getSortedColumn(right)
+	for i := 0; i < len(leftKeys) && join.Type == INNER; i++ {
+		if leftKeys[i] == leftSorted && rightKeys[i] == rightSorted &&
+			t.getColumn(leftSorted).Type == t.getColumn(rightSorted).Type { // 类型不同排序规则不同
+			return NewMergeJoinOperator(left, right, leftSorted, rightSorted, join.Condition)
+		}
+	}
+	leftRows, rightRows := t.estimateRows(left), t.estimateRows(right)
+	// 左侧很少时嵌套循环更划算 省去了构建哈希表，右侧每行都需要重新扫描
+	if leftRows*rightRows*(CostSeqRow+CostCpuRow) < rightRows*CostSeqRow+(leftRows+rightRows+min(leftRows, rightRows))*CostCpuRow {
+		return NewJoinOperator(left, right, join.Type, join.Condition)
+	}
+	return NewHashJoinOperator(left, right, join.Type, leftKeys, rightKeys, join.Condition, leftRows < rightRows)
+}
+
+// 从连接条件中提取 AND 连接的 左表列 = 右表列 的条件
+func (t *Transformer) getJoinKeys(cond *ExprNode, rightTable string) ([]string, []string) {
+	leftKeys, rightKeys := make([]string, 0), make([]string, 0)
+	prefix := rightTable + "."
+	for _, item := range t.splitAnd(cond) {
+		if item.Operator != EQ {
+			continue
+		}
+		id1, ok1 := item.Left.(*IDNode)
+		id2, ok2 := item.Right.(*IDNode)
+		if !ok1 || !ok2 {
+			continue
+		}
+		right1, right2 := strings.HasPrefix(id1.Value, prefix), strings.HasPrefix(id2.Value, prefix)
+		if right1 && !right2 {
+			id1, id2 = id2, id1
+		} else if right1 || !right2 { // 必须一边是左表一边是右表
+			continue
+		}
+		leftKeys = append(leftKeys, id1.Value)
+		rightKeys = append(rightKeys, id2.Value)
+	}
+	return leftKeys, rightKeys
+}
+
+// 输出数据按哪一列有序 只识别索引扫描，按索引第一列有序
+func (t *Transformer) getSortedColumn(input IOperator) string {
+	if columns := t.getSortedColumns(input); len(columns) > 0 {
+		return columns[0]
+	}
+	return ""
+}
+
+// 输出数据依次按哪些列有序 索引扫描按索引的所有列有序
+func (t *Transformer) getSortedColumns(input IOperator) []string {
+	switch target := input.(type) {
+	case *IndexScanOperator:
+		return GetIndex(target.Index).Columns
+	case *IndexLookupOperator:
+		return t.getSortedColumns(target.Input)
+	case *FilterOperator:
+		return t.getSortedColumns(target.Input)
+	case *ProjectionOperator:
+		return t.getSortedColumns(target.Input)
+	case *AliasOperator:
+		res := make([]string, 0)
+		for _, column := range t.getSortedColumns(target.Input) {
+			res = append(res, RenameColumn(column, target.Table, target.Alias))
+		}
+		return res
+	case *MergeJoinOperator:
+		return []string{target.LeftKey}
+	default:
+		return nil
+	}
+}
+
+// 分组列正好是有序列的前几列(顺序无关)时 相同的分组连续出现 可以流式聚合
+func (t *Transformer) isGroupSorted(input IOperator, groupColumns []string) bool {
+	sorted := t.getSortedColumns(input)
+	if len(groupColumns) == 0 || len(sorted) < len(groupColumns) {
+		return false
+	}
+	columns := make(map[string]struct{})
+	for _, column := range groupColumns {
+		columns[column] = struct{}{}
+	}
+	for _, column := range sorted[:len(groupColumns)] {
+		if _, ok := columns[column]; !ok {
+			return false
+		}
+	}
+	return len(columns) == len(groupColumns)
+}
+
+// name 为 别名.列名
+func (t *Transformer) getColumn(name string) *Column {
+	alias := name[:strings.IndexRune(name, '.')]
+	for _, column := range t.getTableColumns(alias) {
+		if column.Name == name {
+			return column
+		}
+	}
+	panic(&NotFoundError{Kind: "column", Name: name})
+}
+
+// 表的所有列 列名为 别名.列名
+func (t *Transformer) getTableColumns(alias string) []*Column {
+	if derived, ok := t.Derived[alias]; ok {
+		return derived.Columns
+	}
+	table := t.getTableName(alias)
+	res := make([]*Column, 0)
+	for _, column := range GetTable(table).Columns {
+		temp := *column
+		temp.Name = RenameColumn(column.Name, table, alias)
+		res = append(res, &temp)
+	}
+	return res
+}
+
+func (t *Transformer) getAliases() []string {
+	res := make([]string, 0)
+	for alias := range t.Tables {
+		res = append(res, alias)
+	}
+	sort.Strings(res)
+	return res
+}
+
+func (t *Transformer) getTableName(alias string) string {
+	if table, ok := t.Tables[alias]; ok {
+		return table
+	}
+	return alias
+}
+
+// 起了别名的表需要把输出列替换为别名
+func (t *Transformer) aliasTable(input IOperator, table string, alias string) IOperator {
+	if alias == table {
+		return input
+	}
+	return NewAliasOperator(input, table, alias)
+}
+
+// 选择扫描表的方式 有统计信息时按代价选择，否则优先使用 where 条件做索引范围查找，索引不能覆盖需要的列就回表
+// 其次使用能覆盖所有列的索引全部扫描，最后全表扫描  范围查找只是缩小范围，where 条件还是需要再过滤的
+func (t *Transformer) scanTable(table string, alias string, fields []string, where *ExprNode) IOperator {
+	fields = CloneSlice(fields) // 字段与条件都是使用的别名
+	for i, field := range fields {
+		fields[i] = RenameColumn(field, alias, table)
+	}
+	if stat := GetTableStat(table); stat != nil {
+		return t.aliasTable(t.chooseScan(stat, table, alias, fields, where), table, alias)
+	}
+	if index, rngs := t.getIndexRange(table, alias, where); index != nil {
+		input := NewIndexScanOperator(t.Storage, index.Name, rngs)
+		if len(SubSlice(fields, index.Columns)) == 0 {
+			return t.aliasTable(input, table, alias)
+		}
+		return t.aliasTable(NewIndexLookupOperator(input, t.Storage, table), table, alias)
+	}
+	if index := t.getMostMatchIndex(table, fields); index != nil {
+		return t.aliasTable(NewIndexScanOperator(t.Storage, index.Name, nil), table, alias)
+	}
+	return t.aliasTable(NewTableScanOperator(t.Storage, table), table, alias)
+}
+
+type IndexCandidate struct { // 可以用于范围查找的索引
+	Index  *Index
+	Ranges []*IndexRange
+	Score  int // 使用的条件数 等值条件算两个
+}
+
+// 没有统计信息时 选择能使用条件最多的索引，一样多的选择列少的
+func (t *Transformer) getIndexRange(table string, alias string, where *ExprNode) (*Index, []*IndexRange) {
+	var res *IndexCandidate
+	for _, candidate := range t.getIndexCandidates(table, alias, where) {
+		if res == nil || candidate.Score > res.Score ||
+			(candidate.Score == res.Score && len(candidate.Index.Columns) < len(res.Index.Columns)) {
+			res = candidate
+		}
+	}
+	if res == nil {
+		return nil, nil
+	}
+	return res.Index, res.Ranges
+}
+
+// 从 where 条件中提取可以用于索引查找的条件 只支持 AND 连接的 列 op 常量，列 IN (常量...)，列 LIKE '前缀%'
+// 索引前面的列使用等值条件(IN 展开为多个等值范围)，之后的一列可以使用范围条件
+func (t *Transformer) getIndexCandidates(table string, alias string, where *ExprNode) []*IndexCandidate {
+	meta := GetTable(table)
+	columnMap := make(map[string]*Column) // 条件中使用的是别名
+	for _, column := range meta.Columns {
+		columnMap[RenameColumn(column.Name, table, alias)] = column
+	}
+	conds := make(map[string][]*ExprNode) // 列名 -> 列在左边的条件
+	for _, cond := range t.splitAnd(where) {
+		for _, item := range t.expandLike(cond) {
+			if item = t.normalizeCond(item, columnMap); item != nil {
+				name := item.Left.(*IDNode).Value
+				conds[name] = append(conds[name], item)
+			}
+		}
+	}
+	res := make([]*IndexCandidate, 0)
+	for _, index := range ListIndexes(table) {
+		rngs := []*IndexRange{{LowInclude: true, HighInclude: true}}
+		score := 0
+		for _, name := range index.Columns {
+			name = RenameColumn(name, table, alias)
+			var eq, in, low, high *ExprNode
+			for _, cond := range conds[name] {
+				switch cond.Operator {
+				case EQ:
+					eq = cond
+				case IN:
+					in = cond
+				case GT, GE:
+					low = cond
+				case LT, LE:
+					high = cond
+				}
+			}
+			column := columnMap[name]
+			if eq != nil { // 等值条件可以继续匹配下一列
+				val := ValueToAny(&Value{Value: eq.Right.(*ImmNode).Value}, column.Type)
+				for _, rng := range rngs {
+					rng.Low = append(rng.Low, val)
+					rng.High = append(rng.High, val)
+				}
+				score += 2
+				continue
+			}
+			if in != nil { // IN 每个值一个等值范围，值有序去重保证范围有序不重叠，范围太多就不展开了
+				vals := t.getInValues(in, column)
+				if len(rngs)*len(vals) <= MaxIndexRanges {
+					temps := make([]*IndexRange, 0)
+					for _, rng := range rngs {
+						for _, val := range vals {
+							temps = append(temps, &IndexRange{Low: append(CloneSlice(rng.Low), val),
+								High: append(CloneSlice(rng.High), val), LowInclude: true, HighInclude: true})
+						}
+					}
+					rngs = temps
+					score += 2
+					continue
+				}
+			} // 范围条件之后的列都用不了了
+			if low != nil {
+				val := ValueToAny(&Value{Value: low.Right.(*ImmNode).Value}, column.Type)
+				for _, rng := range rngs {
+					rng.Low = append(CloneSlice(rng.Low), val)
+					rng.LowInclude = low.Operator == GE
+				}
+				score++
+			}
+			if high != nil {
+				val := ValueToAny(&Value{Value: high.Right.(*ImmNode).Value}, column.Type)
+				for _, rng := range rngs {
+					rng.High = append(CloneSlice(rng.High), val)
+					rng.HighInclude = high.Operator == LE
+				}
+				score++
+			}
+			break
+		}
+		if score > 0 {
+			res = append(res, &IndexCandidate{Index: index, Ranges: rngs, Score: score})
+		}
+	}
+	return res
+}
+
+// IN 中的常量转换为列类型后排序去重
+func (t *Transformer) getInValues(in *ExprNode, column *Column) []any {
+	vals := make([]*Value, 0)
+	for _, item := range in.Right.(*ListNode).Items {
+		val := ValueToAny(&Value{Value: item.(*ImmNode).Value}, column.Type)
+		vals = append(vals, &Value{Type: column.Type, Data: val})
+	}
+	sort.Slice(vals, func(i, j int) bool {
+		return CompareValue(vals[i], vals[j]) < 0
+	})
+	res := make([]any, 0)
+	for i, val := range vals {
+		if i == 0 || CompareValue(vals[i-1], val) != 0 {
+			res = append(res, val.Data)
+		}
+	}
+	return res
+}
+
+// 有固定前缀的 LIKE 转换为范围条件 列 >= 前缀 AND 列 < 前缀最后一个字节加一，没有通配符的直接转换为等值条件
+// 只是用来缩小索引范围，原条件还是会再过滤的
+func (t *Transformer) expandLike(cond *ExprNode) []*ExprNode {
+	if cond.Operator != LIKE {
+		return []*ExprNode{cond}
+	}
+	escape := '\\'
+	pattern := cond.Right
+	if list, ok := pattern.(*ListNode); ok {
+		pattern = list.Items[0]
+		temp := []rune(list.Items[1].(*ImmNode).Value)
+		if len(temp) != 1 {
+			return nil
+		}
+		escape = temp[0]
+	}
+	imm, ok := pattern.(*ImmNode)
+	if !ok || imm.Type != STR {
+		return nil
+	}
+	prefix, exact := LikePrefix([]rune(imm.Value), escape)
+	if exact {
+		return []*ExprNode{{Left: cond.Left, Right: &ImmNode{Value: prefix, Type: STR}, Operator: EQ}}
+	}
+	if len(prefix) == 0 {
+		return nil
+	}
+	res := []*ExprNode{{Left: cond.Left, Right: &ImmNode{Value: prefix, Type: STR}, Operator: GE}}
+	bs := []byte(prefix)
+	for len(bs) > 0 && bs[len(bs)-1] == 0xFF { // 已经是最大的字节了 没有上界
+		bs = bs[:len(bs)-1]
+	}
+	if len(bs) > 0 {
+		bs[len(bs)-1]++
+		res = append(res, &ExprNode{Left: cond.Left, Right: &ImmNode{Value: string(bs), Type: STR}, Operator: LT})
+	}
+	return res
+}
+
+func (t *Transformer) splitAnd(node INode) []*ExprNode {
+	expr, ok := node.(*ExprNode)
+	if !ok || expr == nil {
+		return nil
+	}
+	if expr.Operator == AND {
+		return append(t.splitAnd(expr.Left), t.splitAnd(expr.Right)...)
+	}
+	return []*ExprNode{expr}
+}
+
+// splitAnd 的逆操作 没有条件返回 nil
+func (t *Transformer) joinAnd(conds []*ExprNode) *ExprNode {
+	var res *ExprNode
+	for _, cond := range conds {
+		if res == nil {
+			res = cond
+		} else {
+			res = &ExprNode{Left: res, Right: cond, Operator: AND}
+		}
+	}
+	return res
+}
+
+func (t *Transformer) hasSubQuery(node INode) bool {
+	switch target := node.(type) {
+	case *SubQueryNode:
+		return true
+	case *ExprNode:
+		return t.hasSubQuery(target.Left) || t.hasSubQuery(target.Right)
+	case *FuncNode:
+		for _, param := range target.Params {
+			if t.hasSubQuery(param) {
+				return true
+			}
+		}
+	case *ListNode:
+		for _, item := range target.Items {
+			if t.hasSubQuery(item) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// 整理为 列 op 常量 的形式，不能用于索引的返回 nil
+func (t *Transformer) normalizeCond(cond *ExprNode, columnMap map[string]*Column) *ExprNode {
+	if cond.Operator == IN { // 列 IN (常量...) 所有常量都需要与列类型兼容
+		id, ok := cond.Left.(*IDNode)
+		if !ok || columnMap[id.Value] == nil {
+			return nil
+		}
+		list, ok := cond.Right.(*ListNode)
+		if !ok { // IN 子查询
+			return nil
+		}
+		for _, item := range list.Items {
+			imm, ok := item.(*ImmNode)
+			if !ok || !t.isCompatible(columnMap[id.Value], imm) {
+				return nil
+			}
+		}
+		return cond
+	}
+	flips := map[string]string{EQ: EQ, GT: LT, GE: LE, LT: GT, LE: GE}
+	if _, ok := flips[cond.Operator]; !ok {
+		return nil
+	}
+	if _, ok := cond.Left.(*ImmNode); ok { // 常量在左边的交换一下
+		cond = &ExprNode{Left: cond.Right, Right: cond.Left, Operator: flips[cond.Operator]}
+	}
+	id, ok1 := cond.Left.(*IDNode)
+	imm, ok2 := cond.Right.(*ImmNode)
+	if !ok1 || !ok2 {
+		return nil
+	}
+	column, ok := columnMap[id.Value]
+	if !ok || !t.isCompatible(column, imm) {
+		return nil
+	}
+	return cond
+}
+
+// 常量类型需要与列类型兼容 整数列与小数常量比较时不走索引，只用于过滤
+func (t *Transformer) isCompatible(column *Column, imm *ImmNode) bool {
+	switch column.Type {
+	case TypInt:
+		return imm.Type == INT
+	case TypFloat:
+		return imm.Type == INT || imm.Type == FLOAT
+	case TypStr:
+		return imm.Type == STR
+	default:
+		return false
+	}
+}
+
 func (t *Transformer) getMostMatchIndex(table string, fields []string) *Index {
 	idxes := ListIndexes(table)
 	var res *Index
@@ -402,3 +1129,575 @@ func (t *Transformer) getTableFields(table string, fields []string) []string {
 	}
 	return res
 }
+
+//=========================代价估计=========================
+
+// 只在有统计信息时使用 代价为各种操作处理的行数乘以对应的单价
+// 全表扫描，覆盖所需列的索引全部扫描，索引范围查找(不能覆盖所需列需要回表) 中选择代价最小的
+func (t *Transformer) chooseScan(stat *TableStat, table string, alias string, fields []string, where *ExprNode) IOperator {
+	rows := float64(stat.Rows)
+	var res IOperator = NewTableScanOperator(t.Storage, table)
+	resCost := rows * CostSeqRow
+	if index := t.getMostMatchIndex(table, fields); index != nil && rows*CostIndexRow < resCost {
+		res, resCost = NewIndexScanOperator(t.Storage, index.Name, nil), rows*CostIndexRow
+	}
+	for _, candidate := range t.getIndexCandidates(table, alias, where) {
+		matched := rows * t.rangeSelectivity(stat, candidate.Index, candidate.Ranges)
+		covering := len(SubSlice(fields, candidate.Index.Columns)) == 0
+		cost := matched * CostIndexRow
+		if !covering {
+			cost += matched * CostLookupRow
+		}
+		if cost >= resCost {
+			continue
+		}
+		res, resCost = NewIndexScanOperator(t.Storage, candidate.Index.Name, candidate.Ranges), cost
+		if !covering {
+			res = NewIndexLookupOperator(res, t.Storage, table)
+		}
+	}
+	return res
+}
+
+// 索引范围的选择率 多个范围(IN)的相加 范围内前面的列是等值条件，最后一列可能是范围条件
+func (t *Transformer) rangeSelectivity(stat *TableStat, index *Index, rngs []*IndexRange) float64 {
+	types := make(map[string]int8)
+	for _, column := range GetTable(index.TableName).Columns {
+		types[column.Name] = column.Type
+	}
+	res := 0.0
+	for _, rng := range rngs {
+		sel := 1.0
+		for i, name := range index.Columns {
+			column := stat.GetColumn(name)
+			if column == nil || (i >= len(rng.Low) && i >= len(rng.High)) {
+				break
+			}
+			var low, high *Value
+			lowInclude, highInclude := true, true
+			if i < len(rng.Low) {
+				low = &Value{Type: types[name], Data: rng.Low[i]}
+				lowInclude = i < len(rng.Low)-1 || rng.LowInclude
+			}
+			if i < len(rng.High) {
+				high = &Value{Type: types[name], Data: rng.High[i]}
+				highInclude = i < len(rng.High)-1 || rng.HighInclude
+			}
+			if low != nil && high != nil && lowInclude && highInclude && CompareValue(low, high) == 0 {
+				sel *= stat.EqualSelectivity(column)
+			} else {
+				sel *= stat.RangeSelectivity(column, low, lowInclude, high, highInclude)
+			}
+		}
+		res += sel
+	}
+	return min(res, 1)
+}
+
+// 估计输出的行数 没有统计信息时不考虑条件直接使用表的行数，连接取两侧较大的
+func (t *Transformer) estimateRows(input IOperator) float64 {
+	switch target := input.(type) {
+	case *TableScanOperator:
+		return t.estimateTableRows(target.Table)
+	case *IndexScanOperator:
+		index := GetIndex(target.Index)
+		rows := t.estimateTableRows(index.TableName)
+		if stat := GetTableStat(index.TableName); stat != nil && len(target.Ranges) > 0 {
+			rows *= t.rangeSelectivity(stat, index, target.Ranges)
+		}
+		return rows
+	case *IndexLookupOperator:
+		return t.estimateRows(target.Input)
+	case *FilterOperator: // 扫描的索引范围就来自过滤条件 不能重复计算
+		sel, _ := t.estimateSelectivity(target.Expr)
+		if table := t.getScanTable(target.Input); table != "" {
+			return t.estimateTableRows(table) * sel
+		}
+		return t.estimateRows(target.Input) * sel
+	case *ProjectionOperator:
+		return t.estimateRows(target.Input)
+	case *AliasOperator:
+		return t.estimateRows(target.Input)
+	case *JoinOperator:
+		return t.estimateJoinRows(target.Left, target.Right, target.Type, nil, nil)
+	case *HashJoinOperator:
+		return t.estimateJoinRows(target.Left, target.Right, target.Type, target.LeftKeys, target.RightKeys)
+	case *MergeJoinOperator:
+		return t.estimateJoinRows(target.Left, target.Right, INNER, []string{target.LeftKey}, []string{target.RightKey})
+	default:
+		return math.Inf(1)
+	}
+}
+
+// 直接扫描表的返回表名 否则返回空
+func (t *Transformer) getScanTable(input IOperator) string {
+	switch target := input.(type) {
+	case *AliasOperator:
+		return t.getScanTable(target.Input)
+	case *IndexLookupOperator:
+		return target.Table
+	case *IndexScanOperator:
+		return GetIndex(target.Index).TableName
+	case *TableScanOperator:
+		return target.Table
+	default:
+		return ""
+	}
+}
+
+func (t *Transformer) estimateTableRows(table string) float64 {
+	if stat := GetTableStat(table); stat != nil {
+		return float64(stat.Rows)
+	}
+	return float64(t.Storage.TableRows(table))
+}
+
+// 等值连接按 左侧行数*右侧行数/两侧连接列不同值个数的较大值 估计，多个连接列认为相互独立
+// 外连接至少保留外侧的行，半连接(反连接)最多输出左侧的行
+func (t *Transformer) estimateJoinRows(left IOperator, right IOperator, joinType string, leftKeys []string, rightKeys []string) float64 {
+	leftRows, rightRows := t.estimateRows(left), t.estimateRows(right)
+	if joinType == SEMI || joinType == ANTI {
+		return leftRows
+	}
+	res := max(leftRows, rightRows)
+	if sel, ok := t.joinSelectivity(leftKeys, rightKeys, leftRows, rightRows); ok {
+		res = leftRows * rightRows * sel
+	}
+	switch joinType {
+	case LEFT:
+		res = max(res, leftRows)
+	case RIGHT:
+		res = max(res, rightRows)
+	case FULL:
+		res = max(res, leftRows, rightRows)
+	}
+	return res
+}
+
+// 连接列都有统计信息才能估计 不同值个数不会超过该侧的行数
+func (t *Transformer) joinSelectivity(leftKeys []string, rightKeys []string, leftRows float64, rightRows float64) (float64, bool) {
+	if len(leftKeys) == 0 {
+		return 1, false
+	}
+	res := 1.0
+	for i := range leftKeys {
+		_, leftColumn := t.getColumnStat(leftKeys[i])
+		_, rightColumn := t.getColumnStat(rightKeys[i])
+		if leftColumn == nil || rightColumn == nil {
+			return 1, false
+		}
+		distinct := max(min(float64(leftColumn.Distinct), leftRows), min(float64(rightColumn.Distinct), rightRows))
+		if distinct > 0 {
+			res /= distinct
+		}
+	}
+	return res, true
+}
+
+// name 为 别名.列名 派生表与没有统计信息的表返回 nil
+func (t *Transformer) getColumnStat(name string) (*TableStat, *ColumnStat) {
+	idx := strings.IndexRune(name, '.')
+	if idx < 0 {
+		return nil, nil
+	}
+	alias := name[:idx]
+	table, ok := t.Tables[alias]
+	if _, derived := t.Derived[alias]; !ok || derived {
+		return nil, nil
+	}
+	stat := GetTableStat(table)
+	if stat == nil {
+		return nil, nil
+	}
+	column := stat.GetColumn(RenameColumn(name, alias, table))
+	if column == nil {
+		return nil, nil
+	}
+	return stat, column
+}
+
+// 条件的选择率 只能估计 列 op 常量，列 IN (常量...)，列 LIKE '前缀%'，列 IS [NOT] NULL 以及它们的 AND OR NOT 组合
+// 无法估计的条件返回 1 与 false，有统计信息但是形式无法估计的使用默认选择率
+func (t *Transformer) estimateSelectivity(node INode) (float64, bool) {
+	cond, ok := node.(*ExprNode)
+	if !ok || cond == nil {
+		return 1, false
+	}
+	switch cond.Operator {
+	case AND: // 无法估计的一侧按 1 计算
+		sel1, ok1 := t.estimateSelectivity(cond.Left)
+		sel2, ok2 := t.estimateSelectivity(cond.Right)
+		return sel1 * sel2, ok1 || ok2
+	case OR:
+		sel1, ok1 := t.estimateSelectivity(cond.Left)
+		sel2, ok2 := t.estimateSelectivity(cond.Right)
+		if ok1 && ok2 {
+			return sel1 + sel2 - sel1*sel2, true
+		}
+		return 1, false
+	case NOT:
+		if sel, ok := t.estimateSelectivity(cond.Left); ok {
+			return 1 - sel, true
+		}
+		return 1, false
+	case NE:
+		if sel, ok := t.estimateSelectivity(&ExprNode{Left: cond.Left, Right: cond.Right, Operator: EQ}); ok {
+			return 1 - sel, true
+		}
+		return 1, false
+	case IS, ISNOT:
+		id, ok := cond.Left.(*IDNode)
+		if !ok {
+			return 1, false
+		}
+		stat, column := t.getColumnStat(id.Value)
+		if column == nil {
+			return 1, false
+		}
+		sel := stat.NullSelectivity(column)
+		if cond.Operator == ISNOT {
+			sel = 1 - sel
+		}
+		return sel, true
+	}
+	id, ok := cond.Left.(*IDNode)
+	if !ok {
+		if id, ok = cond.Right.(*IDNode); !ok {
+			return 1, false
+		}
+	}
+	stat, column := t.getColumnStat(id.Value)
+	if column == nil {
+		return 1, false
+	}
+	meta := t.getColumn(id.Value)
+	columnMap := map[string]*Column{id.Value: meta}
+	conds := t.expandLike(cond)
+	if len(conds) == 0 {
+		return DefaultSelectivity, true
+	}
+	var low, high *Value
+	lowInclude, highInclude := true, true
+	for _, item := range conds {
+		if item = t.normalizeCond(item, columnMap); item == nil {
+			return DefaultSelectivity, true
+		}
+		switch item.Operator {
+		case EQ:
+			return stat.EqualSelectivity(column), true
+		case IN:
+			return min(float64(len(t.getInValues(item, meta)))*stat.EqualSelectivity(column), 1), true
+		case GT, GE:
+			low = &Value{Type: meta.Type, Data: ValueToAny(&Value{Value: item.Right.(*ImmNode).Value}, meta.Type)}
+			lowInclude = item.Operator == GE
+		case LT, LE:
+			high = &Value{Type: meta.Type, Data: ValueToAny(&Value{Value: item.Right.(*ImmNode).Value}, meta.Type)}
+			highInclude = item.Operator == LE
+		}
+	}
+	return stat.RangeSelectivity(column, low, lowInclude, high, highInclude), true
+}
+
+// 都是内连接且所有表都有统计信息时按估计的行数贪心决定连接顺序，否则返回 nil 按书写顺序连接
+// 从过滤后行数最少的表开始，每次加入与已连接的表有等值连接条件且连接结果最少的表，没有连接条件的最后加入
+func (t *Transformer) getJoinOrder(node *SelectNode) []string {
+	if len(node.Joins) == 0 || node.SubQuery != nil {
+		return nil
+	}
+	aliases := []string{node.Alias}
+	conds := make([]*ExprNode, 0)
+	for _, join := range node.Joins {
+		if join.Type != INNER || join.SubQuery != nil {
+			return nil
+		}
+		aliases = append(aliases, join.Alias)
+		conds = append(conds, t.splitAnd(join.Condition)...)
+	}
+	rows := make(map[string]float64)
+	for _, alias := range aliases {
+		stat := GetTableStat(t.Tables[alias])
+		if stat == nil {
+			return nil
+		}
+		rows[alias] = float64(stat.Rows) * t.estimateAliasSelectivity(alias, node.Where)
+	}
+	res := make([]string, 0)
+	joined := make(map[string]struct{})
+	curr := 0.0
+	for len(res) < len(aliases) {
+		next, nextRows, nextConnected := "", 0.0, false
+		for _, alias := range aliases {
+			if _, ok := joined[alias]; ok {
+				continue
+			}
+			temp, connected := rows[alias], false
+			if len(res) > 0 {
+				temp = curr * rows[alias]
+				leftKeys, rightKeys := make([]string, 0), make([]string, 0)
+				keys1, keys2 := t.getJoinKeys(t.joinAnd(conds), alias)
+				for i, key := range keys1 {
+					if _, ok := joined[key[:strings.IndexRune(key, '.')]]; ok {
+						leftKeys = append(leftKeys, key)
+						rightKeys = append(rightKeys, keys2[i])
+					}
+				}
+				if sel, ok := t.joinSelectivity(leftKeys, rightKeys, curr, rows[alias]); ok {
+					temp, connected = temp*sel, true
+				}
+			}
+			if next == "" || (connected && !nextConnected) || (connected == nextConnected && temp < nextRows) {
+				next, nextRows, nextConnected = alias, temp, connected
+			}
+		}
+		res = append(res, next)
+		joined[next] = struct{}{}
+		curr = nextRows
+	}
+	return res
+}
+
+// where 中只引用该表的条件的选择率
+func (t *Transformer) estimateAliasSelectivity(alias string, where *ExprNode) float64 {
+	res := 1.0
+	for _, cond := range t.splitAnd(where) {
+		fields := t.extraNodeField(cond)
+		if len(fields) == 0 || len(t.getTableFields(alias, fields)) < len(fields) {
+			continue
+		}
+		sel, _ := t.estimateSelectivity(cond)
+		res *= sel
+	}
+	return res
+}
+
+//=========================子查询=========================
+
+type SemiJoin struct { // 改写为半连接(反连接)的子查询条件
+	Type                string    // SEMI ANTI
+	Input               IOperator // 去掉相关条件后的子查询
+	LeftKeys, RightKeys []string
+}
+
+// from join 中的子查询 不能引用外层的列
+func (t *Transformer) transformDerived(query INode, alias string) *DerivedTableOperator {
+	child := &Transformer{Storage: t.Storage, Node: query}
+	input := child.transformQuery(query)
+	return NewDerivedTableOperator(input, alias, child.Columns)
+}
+
+// 生成表达式中所有子查询的执行计划
+func (t *Transformer) transformSubQueries(node INode) {
+	switch target := node.(type) {
+	case *SelectNode:
+		for _, field := range target.Fields {
+			t.transformSubQueries(field)
+		}
+		for _, join := range target.Joins {
+			t.transformSubQueries(join.Condition)
+		}
+		t.transformSubQueries(target.Where)
+		t.transformSubQueries(target.Having)
+		for _, order := range target.Orders {
+			t.transformSubQueries(order.Field)
+		}
+	case *UpdateNode:
+		for _, set := range target.Sets {
+			t.transformSubQueries(set.Value)
+		}
+		t.transformSubQueries(target.Where)
+	case *DeleteNode:
+		t.transformSubQueries(target.Where)
+	case *ExprNode:
+		if target == nil {
+			return
+		}
+		if target.Operator == EXISTS { // EXISTS 不限制列数
+			t.transformSubQuery(target.Left.(*SubQueryNode), false)
+			return
+		}
+		t.transformSubQueries(target.Left)
+		t.transformSubQueries(target.Right)
+	case *FuncNode:
+		for _, param := range target.Params {
+			t.transformSubQueries(param)
+		}
+	case *ListNode:
+		for _, item := range target.Items {
+			t.transformSubQueries(item)
+		}
+	case *SubQueryNode: // 标量子查询与 IN 子查询只能有一列
+		t.transformSubQuery(target, true)
+	}
+}
+
+func (t *Transformer) transformSubQuery(node *SubQueryNode, single bool) {
+	child := &Transformer{Storage: t.Storage, Node: node.Select, Outer: t}
+	input := child.transformQuery(node.Select)
+	if single && len(child.Columns) != 1 {
+		panic(&ExecError{Msg: "subquery must return 1 column"})
+	}
+	t.SubQueryIdx++
+	node.Name = fmt.Sprintf("(subquery%d)", t.SubQueryIdx)
+	node.Operator = NewSubQueryOperator(input, child.Params, child.Refs, child.Columns)
+}
+
+// 把引用外层列的 IDNode 替换为参数
+func (t *Transformer) bindParams(node INode) INode {
+	switch target := node.(type) {
+	case *SelectNode:
+		for i, field := range target.Fields {
+			target.Fields[i] = t.bindParams(field)
+			if alias, has := target.Aliases[field]; has { // 别名跟着新节点
+				delete(target.Aliases, field)
+				target.Aliases[target.Fields[i]] = alias
+			}
+		}
+		for _, join := range target.Joins {
+			t.bindParams(join.Condition)
+		}
+		t.bindParams(target.Where)
+		t.bindParams(target.Having)
+		for _, order := range target.Orders {
+			order.Field = t.bindParams(order.Field)
+		}
+	case *ExprNode:
+		if target != nil {
+			target.Left = t.bindParams(target.Left)
+			target.Right = t.bindParams(target.Right)
+		}
+	case *FuncNode:
+		for i, param := range target.Params {
+			target.Params[i] = t.bindParams(param)
+		}
+	case *ListNode:
+		for i, item := range target.Items {
+			target.Items[i] = t.bindParams(item)
+		}
+	case *IDNode:
+		alias := target.Value[:strings.IndexRune(target.Value, '.')]
+		if _, ok := t.Tables[alias]; !ok {
+			return t.getParam(target.Value)
+		}
+	}
+	return node
+}
+
+// 外层列由外层绑定 更外层的列由对应的外层绑定，这里只是引用
+func (t *Transformer) getParam(name string) *ParamNode {
+	for _, ref := range t.Refs {
+		if ref.Column.Name == name {
+			return ref
+		}
+	}
+	if t.Outer == nil {
+		panic(&NotFoundError{Kind: "column", Name: name})
+	}
+	var res *ParamNode
+	if _, ok := t.Outer.Tables[name[:strings.IndexRune(name, '.')]]; ok {
+		res = &ParamNode{Column: t.Outer.getColumn(name)}
+		t.Params = append(t.Params, res)
+	} else {
+		res = t.Outer.getParam(name)
+	}
+	t.Refs = append(t.Refs, res)
+	return res
+}
+
+// where 中 AND 连接的 EXISTS  NOT EXISTS  列 IN 子查询，子查询是简单的单表查询且只通过等值条件引用外层列的
+// 改写为 半连接(反连接)  NOT IN 因为 NULL 的语义不同不改写
+func (t *Transformer) decorrelate(node *SelectNode) []*SemiJoin {
+	res := make([]*SemiJoin, 0)
+	conds := make([]*ExprNode, 0)
+	for _, cond := range t.splitAnd(node.Where) {
+		if semiJoin := t.toSemiJoin(cond); semiJoin != nil {
+			res = append(res, semiJoin)
+		} else {
+			conds = append(conds, cond)
+		}
+	}
+	if len(res) > 0 {
+		node.Where = t.joinAnd(conds)
+	}
+	return res
+}
+
+func (t *Transformer) toSemiJoin(cond *ExprNode) *SemiJoin {
+	var query *SubQueryNode
+	res := &SemiJoin{Type: SEMI}
+	switch cond.Operator {
+	case EXISTS:
+		query = cond.Left.(*SubQueryNode)
+	case NOT:
+		if expr, ok := cond.Left.(*ExprNode); ok && expr.Operator == EXISTS {
+			query = expr.Left.(*SubQueryNode)
+			res.Type = ANTI
+		}
+	case IN:
+		id, ok := cond.Left.(*IDNode)
+		if query, _ = cond.Right.(*SubQueryNode); !ok || query == nil {
+			return nil
+		}
+		res.LeftKeys = append(res.LeftKeys, id.Value)
+	}
+	if query == nil {
+		return nil
+	}
+	sub, ok := query.Select.(*SelectNode)
+	if !ok || sub.SubQuery != nil || len(sub.Joins) > 0 || sub.Groups != nil || sub.Having != nil || sub.Distinct != nil ||
+		sub.Limit != nil || sub.Orders != nil {
+		return nil
+	}
+	for _, field := range sub.Fields {
+		if len(t.getAggregates(field)) > 0 { // 聚合查询一定有一行
+			return nil
+		}
+	}
+	alias := sub.Alias
+	if alias == "" {
+		alias = sub.From
+	}
+	child := &Transformer{Storage: t.Storage, Node: sub, Outer: t, Tables: map[string]string{alias: sub.From}}
+	child.tidyNodeField(sub, alias)
+	if cond.Operator == IN {
+		id, ok := sub.Fields[0].(*IDNode)
+		if len(sub.Fields) != 1 || !ok {
+			return nil
+		}
+		res.RightKeys = append(res.RightKeys, id.Value)
+	}
+	inner := make([]*ExprNode, 0) // 只使用子查询自己列的条件
+	for _, item := range t.splitAnd(sub.Where) {
+		if t.hasSubQuery(item) {
+			return nil
+		}
+		names := child.extraNodeField(item)
+		if len(names) == len(t.getTableFields(alias, names)) {
+			inner = append(inner, item)
+			continue
+		}
+		id1, ok1 := item.Left.(*IDNode)
+		id2, ok2 := item.Right.(*IDNode)
+		if item.Operator != EQ || !ok1 || !ok2 {
+			return nil
+		}
+		if strings.HasPrefix(id1.Value, alias+".") {
+			id1, id2 = id2, id1
+		}
+		if _, ok := t.Tables[id1.Value[:strings.IndexRune(id1.Value, '.')]]; !ok || !strings.HasPrefix(id2.Value, alias+".") {
+			return nil // 必须一边是当前查询的列一边是子查询的列
+		}
+		res.LeftKeys = append(res.LeftKeys, id1.Value)
+		res.RightKeys = append(res.RightKeys, id2.Value)
+	}
+	if len(res.RightKeys) == 0 { // 不相关的 EXISTS 直接计算一次就好了
+		return nil
+	}
+	sub.Fields = make([]INode, 0)
+	for _, key := range res.RightKeys {
+		sub.Fields = append(sub.Fields, &IDNode{Value: key})
+	}
+	sub.Aliases = make(map[INode]string)
+	sub.Where = t.joinAnd(inner)
+	res.Input = child.transformSelect(sub)
+	return res
+}
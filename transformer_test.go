@@ -0,0 +1,182 @@
+/*
+@author: sk
+@date: 2024/10/21
+*/
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"testing"
+)
+
+// ORDER BY HAVING 可以使用输出列的别名
+func TestSelectAlias(t *testing.T) {
+	storage := newTestStorage(t)
+	mustExecTest(t, storage, "create table sa(id int, v int)")
+	mustExecTest(t, storage, "insert into sa values(1,10),(2,20),(2,5),(3,7)")
+	checkRows(t, storage, "select id as i from sa order by i desc", "[3]", "[2]", "[2]", "[1]")
+	checkRows(t, storage, "select id, count(*) c from sa group by id having c > 1", "[2 2]")
+	checkRows(t, storage, "select id, sum(v) s from sa group by id having s >= 10 order by s desc", "[2 25]", "[1 10]")
+	checkRows(t, storage, "select v + 1 as w from sa order by w limit 2", "[6]", "[8]")
+	storage.Close()
+}
+
+// 没有 WHERE 的 UPDATE DELETE 作用于整个表
+func TestUpdateDeleteWithoutWhere(t *testing.T) {
+	storage := newTestStorage(t)
+	mustExecTest(t, storage, "create table uw(id int, height int)")
+	mustExecTest(t, storage, "insert into uw values(1,10),(2,20)")
+	mustExecTest(t, storage, "update uw set height = height + 1")
+	checkRows(t, storage, "select id, height from uw", "[1 11]", "[2 21]")
+	mustExecTest(t, storage, "delete from uw")
+	checkRows(t, storage, "select id from uw")
+	storage.Close()
+}
+
+// 整数列与小数常量比较 提升为浮点数比较 有索引时也一样
+func TestCompareIntWithFloat(t *testing.T) {
+	storage := newTestStorage(t)
+	mustExecTest(t, storage, "create table cf(id int, v int)")
+	mustExecTest(t, storage, "insert into cf values(1,1),(2,2),(3,3),(4,4),(5,5)")
+	for i := 0; i < 2; i++ {
+		checkRows(t, storage, "select id from cf where id > 2.5", "[3]", "[4]", "[5]")
+		checkRows(t, storage, "select id from cf where id = 2.5")
+		checkRows(t, storage, "select id from cf where id between 2.5 and 4.5", "[3]", "[4]")
+		checkRows(t, storage, "select id from cf where id in (1.5, 2)", "[2]")
+		checkRows(t, storage, "select id from cf where 3.5 >= id and v < 2.1", "[1]", "[2]")
+		if i == 0 {
+			mustExecTest(t, storage, "create index cf_id on cf(id)")
+		}
+	}
+	storage.Close()
+}
+
+// 列 = 列 只在顶层条件中改写为 IS NOT NULL
+func TestSelfCompare(t *testing.T) {
+	storage := newTestStorage(t)
+	mustExecTest(t, storage, "create table sc(id int, name varchar(8))")
+	mustExecTest(t, storage, "insert into sc values(1,'a'),(null,'b')")
+	checkRows(t, storage, "select name from sc where id = id", "[a]")
+	checkRows(t, storage, "select name from sc where not (id = id)")
+	checkRows(t, storage, "select name from sc where id = id or name = 'b'", "[a]", "[b]")
+	storage.Close()
+}
+
+// 内存预算从配置文件读取 内存很小时排序与聚合落盘 结果不变
+func TestMemoryConfig(t *testing.T) {
+	newTestStorage(t)
+	HandleErr(os.WriteFile(path.Join(BasePath, ConfigFile), []byte(`{"BufferPoolSize":16384,"SortBufferSize":256,"GroupBufferSize":256}`), 0644))
+	storage := openTestStorage(t)
+	if storage.Config.SortBufferSize != 256 || storage.Config.GroupBufferSize != 256 || storage.Pool.MaxPages != 4 {
+		t.Fatalf("config not loaded: %+v", storage.Config)
+	}
+	mustExecTest(t, storage, "create table mc(id int, g int)")
+	for i := 0; i < 50; i++ {
+		mustExecTest(t, storage, fmt.Sprintf("insert into mc values(%d,%d)", i, i%10))
+	}
+	want := make([]string, 0)
+	for i := 49; i >= 0; i-- {
+		want = append(want, fmt.Sprintf("[%d]", i))
+	}
+	checkRows(t, storage, "select id from mc order by id desc", want...)
+	checkRows(t, storage, "select g, count(*) from mc group by g having g < 3 order by g", "[0 5]", "[1 5]", "[2 5]")
+	storage.Close()
+}
+
+// 外排序的有序段很多时分多趟归并 同时打开的临时文件数有上限
+func TestSortManyRuns(t *testing.T) {
+	storage := newTestStorage(t)
+	mustExecTest(t, storage, "create table sr(id int)")
+	for i := 0; i < 400; i++ {
+		mustExecTest(t, storage, fmt.Sprintf("insert into sr values(%d)", (i*7)%400))
+	}
+	input := NewTableScanOperator(storage, "sr")
+	sort := NewSortOperator(input, []*OrderNode{{Field: &IDNode{Value: "sr.id"}, Desc: true}}).(*SortOperator)
+	sort.MemLimit = 1 // 每行一个有序段
+	sort.Open()
+	if len(sort.Runs) > SortMergeWays {
+		t.Fatalf("%d runs open", len(sort.Runs))
+	}
+	for i := 399; i >= 0; i-- {
+		if row := sort.Next(); row == nil || row[0] != int64(i) {
+			t.Fatalf("got %v want %d", row, i)
+		}
+	}
+	if row := sort.Next(); row != nil {
+		t.Fatalf("got %v want end", row)
+	}
+	sort.Close()
+	storage.Close()
+}
+
+// ANALYZE TABLE 逐行累计 样本数有上限 超过上限后直方图与不同值个数都是估计值
+func TestStatBuilderSample(t *testing.T) {
+	table := &Table{Name: "st", Columns: []*Column{{Name: "st.id", Type: TypInt}, {Name: "st.k", Type: TypInt, Nullable: true}}}
+	builder := NewStatBuilder(table)
+	total := int64(StatDistinctLimit * 2)
+	for i := int64(0); i < total; i++ {
+		var k any
+		if i%10 != 0 {
+			k = i % 100
+		}
+		builder.Add([]any{i, k})
+	}
+	if len(builder.Samples[0]) != StatSampleSize {
+		t.Fatalf("sample size %d", len(builder.Samples[0]))
+	}
+	stat := builder.Build()
+	if stat.Rows != total {
+		t.Fatalf("rows %d", stat.Rows)
+	}
+	id, k := stat.Columns[0], stat.Columns[1]
+	if id.Distinct < total*9/10 || id.Distinct > total {
+		t.Fatalf("id distinct %d want about %d", id.Distinct, total)
+	}
+	if k.Distinct != 90 || k.Nulls != (total+9)/10 {
+		t.Fatalf("k distinct %d nulls %d", k.Distinct, k.Nulls)
+	}
+	if frac := id.Fraction(&Value{Type: TypInt, Data: total / 2}, true); frac < 0.45 || frac > 0.55 {
+		t.Fatalf("fraction %f want about 0.5", frac)
+	}
+}
+
+// 超长的 VARCHAR 不截断 与 ALTER MODIFY 一样报错
+func TestVarcharTooLong(t *testing.T) {
+	storage := newTestStorage(t)
+	mustExecTest(t, storage, "create table vl(id int, name varchar(4))")
+	mustExecTest(t, storage, "insert into vl values(1,'tool')")
+	for _, sql := range []string{"insert into vl values(2,'toolongname')", "update vl set name = 'toolongname' where id = 1"} {
+		err := execTest(t, storage, sql)
+		if constraintErr, ok := err.(*ConstraintError); !ok || constraintErr.Kind != "too_long" {
+			t.Fatalf("%s: got %v want too_long", sql, err)
+		}
+	}
+	checkRows(t, storage, "select id, name from vl", "[1 tool]")
+	storage.Close()
+}
+
+// 执行出错时返回带类型的错误 对应 MySQL 的错误码
+func TestTypedErrors(t *testing.T) {
+	storage := newTestStorage(t)
+	mustExecTest(t, storage, "create table te1(id int, name varchar(8))")
+	mustExecTest(t, storage, "create table te2(id int)")
+	mustExecTest(t, storage, "create index te2_id on te2(id)")
+	tests := []struct {
+		sql  string
+		code uint16
+	}{
+		{"select id from te1 join te2 on te1.id = te2.id", ErrCodeNonUniq},
+		{"select te1.id from te1 join te1 on te1.id = te1.id", ErrCodeNonUniqTbl},
+		{"select * from (select te1.id, te2.id from te1 join te2 on te1.id = te2.id) d", ErrCodeDupField},
+		{"drop index te2_id on te1", ErrCodeNoIndex},
+		{"alter table te2 add column a int not null", ErrCodeBadNull},
+	}
+	for _, test := range tests {
+		if err := execTest(t, storage, test.sql); ErrCode(err) != test.code {
+			t.Fatalf("%s: got %v code %d want %d", test.sql, err, ErrCode(err), test.code)
+		}
+	}
+	storage.Close()
+}
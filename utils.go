@@ -28,6 +28,22 @@ func IsAlpha(val byte) bool {
 	return val == '_'
 }
 
+func HasNull(data []any) bool {
+	for _, item := range data {
+		if item == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// 重命名 源文件不存在时忽略，用于可能重复执行的恢复
+func RenameIfExist(src string, dst string) {
+	if err := os.Rename(src, dst); !os.IsNotExist(err) {
+		HandleErr(err)
+	}
+}
+
 func OpenOrCreate(path string) *os.File {
 	file, err := os.OpenFile(path, os.O_RDWR, 0666)
 	if os.IsNotExist(err) {
@@ -39,9 +55,9 @@ func OpenOrCreate(path string) *os.File {
 	return file
 }
 
-func HandleErr(err error) {
+func HandleErr(err error) { // 读写文件 网络出错
 	if err != nil {
-		panic(err)
+		panic(&IOError{Err: err})
 	}
 }
 
@@ -107,13 +123,23 @@ func PickData(selectColumns []string, columns []*Column, data []any) []any {
 }
 
 func GetColumnSize(columns []*Column) int {
-	res := 0
+	res := NullBitmapSize(columns)
 	for _, column := range columns {
 		res += int(column.Len)
 	}
 	return res
 }
 
+// 只要有一列可以为 NULL 就需要 NULL 位图，没有的话不占空间，兼容旧数据
+func NullBitmapSize(columns []*Column) int {
+	for _, column := range columns {
+		if column.Nullable {
+			return (len(columns) + 7) / 8
+		}
+	}
+	return 0
+}
+
 func ColumnBatchCompare(vals1 []any, vals2 []any, columns []*Column) int {
 	for i := 0; i < len(columns); i++ {
 		res := ColumnCompare(vals1[i], vals2[i], columns[i])
@@ -135,6 +161,9 @@ func Compare[T int64 | float64 | string](val1, val2 T) int {
 }
 
 func ColumnCompare(val1 any, val2 any, column *Column) int {
+	if val1 == nil || val2 == nil { // NULL 排在最前面
+		return CompareNull(val1 == nil, val2 == nil)
+	}
 	switch column.Type {
 	case TypInt:
 		return Compare(val1.(int64), val2.(int64))
@@ -151,9 +180,14 @@ type TxtReader func(offset int64) string
 
 func BatchByte2Data(bs []byte, columns []*Column, reader TxtReader) []any {
 	data := make([]any, 0)
-	i := 0
-	for _, column := range columns {
-		data = append(data, Byte2Data(bs[i:i+int(column.Len)], column, reader))
+	bitmap := bs[:NullBitmapSize(columns)]
+	i := len(bitmap)
+	for j, column := range columns {
+		if len(bitmap) > 0 && bitmap[j/8]&(1<<(j%8)) != 0 {
+			data = append(data, nil)
+		} else {
+			data = append(data, Byte2Data(bs[i:i+int(column.Len)], column, reader))
+		}
 		i += int(column.Len)
 	}
 	return data
@@ -183,7 +217,8 @@ func Data2Byte(data any, column *Column, writer TxtWriter) []byte {
 		return Int64ToByte(data.(int64))
 	case TypFloat:
 		return Float64ToByte(data.(float64))
-	case TypStr:
+	case TypStr: // 不截断 超长直接报错
+		CheckStrLen(data.(string), column)
 		return StrToByte(data.(string), column.Len)
 	case TypTxt:
 		offset := writer(data.(string))
@@ -194,11 +229,23 @@ func Data2Byte(data any, column *Column, writer TxtWriter) []byte {
 }
 
 func BatchData2Byte(data []any, columns []*Column, writer TxtWriter) []byte {
+	bitmap := make([]byte, NullBitmapSize(columns))
 	res := &bytes.Buffer{}
+	res.Write(bitmap) // 先占位，后面再填充
 	for i, column := range columns {
-		res.Write(Data2Byte(data[i], column, writer))
+		if data[i] != nil {
+			res.Write(Data2Byte(data[i], column, writer))
+			continue
+		}
+		if !column.Nullable {
+			panic(&ConstraintError{Kind: "not_null", Msg: fmt.Sprintf("column %s can not be null", column.Name)})
+		}
+		bitmap[i/8] |= 1 << (i % 8)
+		res.Write(make([]byte, column.Len))
 	}
-	return res.Bytes()
+	bs := res.Bytes()
+	copy(bs, bitmap)
+	return bs
 }
 
 func CloneSlice[T any](arr []T) []T {
@@ -215,48 +262,111 @@ type Value struct {
 	Value string
 }
 
+// 有类型但是没有数据的就是 NULL
+func (v *Value) IsNull() bool {
+	return v.Type != 0 && v.Data == nil
+}
+
 func (v *Value) ToInt() int64 {
 	if v.Type == 0 {
 		res, err := strconv.ParseInt(v.Value, 10, 64)
-		HandleErr(err)
+		if err != nil {
+			panic(&TypeError{Msg: fmt.Sprintf("%s not int", v.Value)})
+		}
 		return res
 	}
 	if v.Type != TypInt {
-		panic(fmt.Sprintf("type %v not int", v.Type))
+		panic(&TypeError{Msg: fmt.Sprintf("type %v not int", v.Type)})
 	}
 	return v.Data.(int64)
 }
 
+// 没有类型信息的常量 是小数不是整数
+func (v *Value) isFloatLiteral() bool {
+	if v.Type != 0 {
+		return false
+	}
+	if _, err := strconv.ParseInt(v.Value, 10, 64); err == nil {
+		return false
+	}
+	_, err := strconv.ParseFloat(v.Value, 64)
+	return err == nil
+}
+
 func (v *Value) ToFloat() float64 {
 	if v.Type == 0 {
 		res, err := strconv.ParseFloat(v.Value, 64)
-		HandleErr(err)
+		if err != nil {
+			panic(&TypeError{Msg: fmt.Sprintf("%s not float", v.Value)})
+		}
 		return res
 	}
+	if v.Type == TypInt { // 整数可以直接提升为浮点数
+		return float64(v.Data.(int64))
+	}
 	if v.Type != TypFloat {
-		panic(fmt.Sprintf("type %v not float", v.Type))
+		panic(&TypeError{Msg: fmt.Sprintf("type %v not float", v.Type)})
 	}
 	return v.Data.(float64)
 }
 
+// 算术运算时 字面量需要先确定是整数还是浮点数
+func (v *Value) ToNumber() *Value {
+	if v.IsNull() || v.Type == TypInt || v.Type == TypFloat {
+		return v
+	}
+	if v.Type != 0 {
+		panic(&TypeError{Msg: fmt.Sprintf("type %v not number", v.Type)})
+	}
+	if res, err := strconv.ParseInt(v.Value, 10, 64); err == nil {
+		return &Value{Type: TypInt, Data: res}
+	}
+	res, err := strconv.ParseFloat(v.Value, 64)
+	if err != nil {
+		panic(&TypeError{Msg: fmt.Sprintf("%s not number", v.Value)})
+	}
+	return &Value{Type: TypFloat, Data: res}
+}
+
 func (v *Value) ToStr() string {
 	if v.Type == 0 {
 		return v.Value
 	}
-	if v.Type != TypStr {
-		panic(fmt.Sprintf("type %v not str", v.Type))
+	if v.Type != TypStr && v.Type != TypTxt {
+		panic(&TypeError{Msg: fmt.Sprintf("type %v not str", v.Type)})
 	}
 	return v.Data.(string)
 }
 
 func (v *Value) ToBool() bool { // bool值暂时不接受字面量
 	if v.Type != TypBool {
-		panic(fmt.Sprintf("type %v not bool", v.Type))
+		panic(&TypeError{Msg: fmt.Sprintf("type %v not bool", v.Type)})
 	}
 	return v.Data.(bool)
 }
 
+// 修改列类型时转换数据，通过字符串中转
+func ConvertData(data any, column *Column) any {
+	if data == nil {
+		return nil
+	}
+	res := ValueToAny(&Value{Value: fmt.Sprintf("%v", data)}, column.Type)
+	if str, ok := res.(string); ok && column.Type == TypStr {
+		CheckStrLen(str, column)
+	}
+	return res
+}
+
+func CheckStrLen(str string, column *Column) {
+	if int64(len(str)) > column.Len {
+		panic(&ConstraintError{Kind: "too_long", Msg: fmt.Sprintf("data %s too long for column %s", str, column.Name)})
+	}
+}
+
 func ValueToAny(value *Value, typ int8) any {
+	if value.IsNull() {
+		return nil
+	}
 	switch typ {
 	case TypInt:
 		return value.ToInt()
@@ -266,6 +376,8 @@ func ValueToAny(value *Value, typ int8) any {
 		return value.ToStr()
 	case TypBool:
 		return value.ToBool()
+	case TypNull:
+		return nil
 	default:
 		panic(fmt.Sprintf("unknown column type: %v", typ))
 	}
@@ -282,34 +394,69 @@ func ParseValue(node INode, columns []*Column, data []any) *Value {
 				}
 			}
 		}
-		panic(fmt.Sprintf("column %v not found", temp.Value))
+		panic(&NotFoundError{Kind: "column", Name: temp.Value})
 	case *ImmNode:
+		if temp.Type == NULL {
+			return &Value{Type: TypNull}
+		}
+		if temp.Type == BOOL {
+			return &Value{Type: TypBool, Data: temp.Value == TrueValue}
+		}
 		return &Value{
 			Value: temp.Value,
 		}
 	case *FuncNode:
 		func0 := GetFunc(temp.FuncName)
+		if func0.IsAggregate { // 聚合函数已经由 GroupOperator 计算好了，直接取对应的列
+			name := GetFuncColumnName(temp)
+			for i, column := range columns {
+				if column.Name == name {
+					return &Value{Type: column.Type, Data: data[i]}
+				}
+			}
+			panic(&NotFoundError{Kind: "column", Name: name})
+		}
+		if temp.Distinct {
+			panic(fmt.Sprintf("func %s not support DISTINCT", temp.FuncName))
+		}
 		params := make([]*Value, 0)
+		typ, _ := func0.RetType()
 		for _, param := range temp.Params {
-			params = append(params, ParseValue(param, columns, data))
+			val := ParseValue(param, columns, data)
+			if val.IsNull() { // 非聚合函数 任意参数为 NULL 结果就是 NULL
+				return &Value{Type: typ}
+			}
+			params = append(params, val)
 		}
-		typ, _ := func0.RetType()
 		val := func0.Call(params) // 这里 typ 若是文本必须使用 TypStr 不要使用 TypTxt
 		return &Value{
 			Type: typ,
 			Data: val,
 		}
 	case *ExprNode:
-		return &Value{
-			Type: TypBool,
-			Data: CalculateExpr(temp, columns, data),
+		return EvalExpr(temp, columns, data)
+	case *ParamNode:
+		return temp.Value
+	case *SubQueryNode: // 标量子查询 没有数据为 NULL 多于一行报错
+		rows := temp.Operator.Rows(columns, data)
+		if len(rows) > 1 {
+			panic(fmt.Sprintf("subquery %s returns more than 1 row", temp.Name))
+		}
+		res := &Value{Type: temp.Operator.GetColumns()[0].Type}
+		if len(rows) == 1 {
+			res.Data = rows[0][0]
 		}
+		return res
 	default:
 		panic(fmt.Sprintf("not support node %v", node))
 	}
 }
 
+// 用于排序 NULL 排在最前面，条件判断需要在外面先处理 NULL
 func CompareValue(val1 *Value, val2 *Value) int {
+	if val1.IsNull() || val2.IsNull() {
+		return CompareNull(val1.IsNull(), val2.IsNull())
+	}
 	typ := int8(0)
 	if val1.Type != 0 {
 		typ = val1.Type
@@ -317,10 +464,15 @@ func CompareValue(val1 *Value, val2 *Value) int {
 	if val2.Type != 0 {
 		if typ == 0 {
 			typ = val2.Type
+		} else if (typ == TypInt && val2.Type == TypFloat) || (typ == TypFloat && val2.Type == TypInt) {
+			typ = TypFloat // 整数与浮点数比较 提升为浮点数
 		} else if typ != val2.Type { // 两个都有类型信息但是类型不一致
-			panic(fmt.Sprintf("type mismatch: %v != %v", val1.Type, val2.Type))
+			panic(&TypeError{Msg: fmt.Sprintf("%v != %v", val1.Type, val2.Type)})
 		}
 	}
+	if typ == TypInt && (val1.isFloatLiteral() || val2.isFloatLiteral()) {
+		typ = TypFloat // 整数列与小数常量比较 例如 id > 2.5
+	}
 	switch typ {
 	case TypInt:
 		return Compare(val1.ToInt(), val2.ToInt())
@@ -329,32 +481,344 @@ func CompareValue(val1 *Value, val2 *Value) int {
 	case TypStr, TypTxt:
 		return Compare(val1.ToStr(), val2.ToStr())
 	default: // 没有类型信息或，类型不可比较
-		panic(fmt.Sprintf("uncomparable type: %v", typ))
+		panic(&TypeError{Msg: fmt.Sprintf("uncomparable type %v", typ)})
+	}
+}
+
+func CompareNull(null1 bool, null2 bool) int {
+	if null1 && null2 {
+		return 0
+	} else if null1 {
+		return -1
+	} else {
+		return 1
 	}
 }
 
+// 条件为 UNKNOWN(NULL) 的也当做不满足
 func CalculateExpr(expr *ExprNode, columns []*Column, data []any) bool {
+	res := EvalExpr(expr, columns, data)
+	return !res.IsNull() && res.ToBool()
+}
+
+// 三值逻辑 返回 TypBool 的值 Data 为 nil 表示 UNKNOWN
+func EvalExpr(expr *ExprNode, columns []*Column, data []any) *Value {
+	if expr.Operator == NOT { // 只有 Left  NOT NULL 还是 NULL
+		val := ParseValue(expr.Left, columns, data)
+		res := &Value{Type: TypBool}
+		if !val.IsNull() {
+			res.Data = !val.ToBool()
+		}
+		return res
+	}
+	switch expr.Operator { // 右边可能是 ListNode SubQueryNode 需要单独处理
+	case EXISTS: // 只有 Left
+		rows := expr.Left.(*SubQueryNode).Operator.Rows(columns, data)
+		return &Value{Type: TypBool, Data: len(rows) > 0}
+	case IN, NOTIN:
+		return EvalIn(expr, columns, data)
+	case LIKE, NOTLIKE:
+		return EvalLike(expr, columns, data)
+	}
 	left := ParseValue(expr.Left, columns, data)
 	right := ParseValue(expr.Right, columns, data)
+	res := &Value{Type: TypBool}
 	switch expr.Operator {
-	case EQ:
-		return CompareValue(left, right) == 0
-	case NE:
-		return CompareValue(left, right) != 0
-	case GT:
-		return CompareValue(left, right) > 0
-	case GE:
-		return CompareValue(left, right) >= 0
-	case LT:
-		return CompareValue(left, right) < 0
-	case LE:
-		return CompareValue(left, right) <= 0
-	case AND:
-		return left.ToBool() && right.ToBool()
-	case OR:
-		return left.ToBool() || right.ToBool()
+	case PLUS, MINUS, STAR, SLASH, PERCENT:
+		return EvalArith(expr.Operator, left, right)
+	case CONCAT: // 任意一边为 NULL 结果都是 NULL
+		res.Type = TypStr
+		if !left.IsNull() && !right.IsNull() {
+			res.Data = FormatValue(left) + FormatValue(right)
+		}
+		return res
+	case IS:
+		res.Data = left.IsNull()
+	case ISNOT:
+		res.Data = !left.IsNull()
+	case AND: // 有一个为 false 就是 false
+		if (!left.IsNull() && !left.ToBool()) || (!right.IsNull() && !right.ToBool()) {
+			res.Data = false
+		} else if !left.IsNull() && !right.IsNull() {
+			res.Data = true
+		}
+	case OR: // 有一个为 true 就是 true
+		if (!left.IsNull() && left.ToBool()) || (!right.IsNull() && right.ToBool()) {
+			res.Data = true
+		} else if !left.IsNull() && !right.IsNull() {
+			res.Data = false
+		}
+	default: // 比较运算 任意一边为 NULL 结果都是 UNKNOWN
+		if left.IsNull() || right.IsNull() {
+			return res
+		}
+		switch expr.Operator {
+		case EQ:
+			res.Data = CompareValue(left, right) == 0
+		case NE:
+			res.Data = CompareValue(left, right) != 0
+		case GT:
+			res.Data = CompareValue(left, right) > 0
+		case GE:
+			res.Data = CompareValue(left, right) >= 0
+		case LT:
+			res.Data = CompareValue(left, right) < 0
+		case LE:
+			res.Data = CompareValue(left, right) <= 0
+		default:
+			panic(fmt.Sprintf("unsupport operator: %v", expr.Operator))
+		}
+	}
+	return res
+}
+
+// 左边为 NULL 结果为 NULL  没有匹配到但是列表中有 NULL 结果也是 NULL
+func EvalIn(expr *ExprNode, columns []*Column, data []any) *Value {
+	res := &Value{Type: TypBool}
+	left := ParseValue(expr.Left, columns, data)
+	if left.IsNull() {
+		return res
+	}
+	vals := make([]*Value, 0)
+	switch right := expr.Right.(type) {
+	case *ListNode:
+		for _, item := range right.Items {
+			vals = append(vals, ParseValue(item, columns, data))
+		}
+	case *SubQueryNode: // 子查询只能有一列
+		column := right.Operator.GetColumns()[0]
+		for _, row := range right.Operator.Rows(columns, data) {
+			vals = append(vals, &Value{Type: column.Type, Data: row[0]})
+		}
+	}
+	hasNull := false
+	for _, val := range vals {
+		if val.IsNull() {
+			hasNull = true
+		} else if CompareValue(left, val) == 0 {
+			res.Data = expr.Operator == IN
+			return res
+		}
+	}
+	if !hasNull {
+		res.Data = expr.Operator == NOTIN
+	}
+	return res
+}
+
+// 默认转义字符为 \  可以使用 ESCAPE 指定
+func EvalLike(expr *ExprNode, columns []*Column, data []any) *Value {
+	res := &Value{Type: TypBool}
+	escape := '\\'
+	pattern := expr.Right
+	if list, ok := pattern.(*ListNode); ok {
+		pattern = list.Items[0]
+		temp := []rune(list.Items[1].(*ImmNode).Value)
+		if len(temp) != 1 {
+			panic(fmt.Sprintf("escape %s must be one character", string(temp)))
+		}
+		escape = temp[0]
+	}
+	left := ParseValue(expr.Left, columns, data)
+	right := ParseValue(pattern, columns, data)
+	if left.IsNull() || right.IsNull() {
+		return res
+	}
+	res.Data = MatchLike([]rune(FormatValue(left)), []rune(FormatValue(right)), escape) == (expr.Operator == LIKE)
+	return res
+}
+
+// % 匹配任意个字符 _ 匹配一个字符  遇到 % 记录回溯点，后面匹配失败从回溯点多匹配一个字符重新开始
+func MatchLike(str []rune, pattern []rune, escape rune) bool {
+	i, j := 0, 0
+	backI, backJ := -1, -1
+	for i < len(str) {
+		if j < len(pattern) && pattern[j] == '%' {
+			j++
+			backI, backJ = i, j
+			continue
+		}
+		if j < len(pattern) {
+			ch, wildcard := pattern[j], pattern[j] == '_'
+			next := j + 1
+			if ch == escape && j+1 < len(pattern) { // 转义后的字符按普通字符处理
+				ch, wildcard, next = pattern[j+1], false, j+2
+			}
+			if wildcard || ch == str[i] {
+				i, j = i+1, next
+				continue
+			}
+		}
+		if backJ < 0 {
+			return false
+		}
+		backI++
+		i, j = backI, backJ
+	}
+	for j < len(pattern) && pattern[j] == '%' {
+		j++
+	}
+	return j == len(pattern)
+}
+
+// 返回模式中第一个通配符之前的固定前缀 以及模式是否完全没有通配符
+func LikePrefix(pattern []rune, escape rune) (string, bool) {
+	res := make([]rune, 0)
+	for i := 0; i < len(pattern); i++ {
+		ch := pattern[i]
+		if ch == escape && i+1 < len(pattern) {
+			i++
+			res = append(res, pattern[i])
+			continue
+		}
+		if ch == '%' || ch == '_' {
+			return string(res), false
+		}
+		res = append(res, ch)
+	}
+	return string(res), true
+}
+
+// 整数之间运算结果还是整数 有浮点数参与或者是除法结果为浮点数 除数为 0 结果为 NULL
+func EvalArith(operator string, left *Value, right *Value) *Value {
+	left, right = left.ToNumber(), right.ToNumber()
+	res := &Value{Type: TypInt}
+	if left.Type == TypFloat || right.Type == TypFloat || operator == SLASH {
+		res.Type = TypFloat
+	}
+	if left.IsNull() || right.IsNull() {
+		return res
+	}
+	if res.Type == TypInt {
+		val1, val2 := left.ToInt(), right.ToInt()
+		switch operator {
+		case PLUS:
+			res.Data = val1 + val2
+		case MINUS:
+			res.Data = val1 - val2
+		case STAR:
+			res.Data = val1 * val2
+		case PERCENT:
+			if val2 != 0 {
+				res.Data = val1 % val2
+			}
+		}
+		return res
+	}
+	val1, val2 := left.ToFloat(), right.ToFloat()
+	switch operator {
+	case PLUS:
+		res.Data = val1 + val2
+	case MINUS:
+		res.Data = val1 - val2
+	case STAR:
+		res.Data = val1 * val2
+	case SLASH:
+		if val2 != 0 {
+			res.Data = val1 / val2
+		}
+	case PERCENT:
+		if val2 != 0 {
+			res.Data = math.Mod(val1, val2)
+		}
+	}
+	return res
+}
+
+// 转换为字符串 用于字符串拼接
+func FormatValue(val *Value) string {
+	if val.Type == 0 {
+		return val.Value
+	}
+	return fmt.Sprintf("%v", val.Data)
+}
+
+// 推断表达式结果的类型与长度 用于生成计算列
+func GetNodeType(node INode, columns []*Column) (int8, int64) {
+	switch temp := node.(type) {
+	case *IDNode:
+		for _, column := range columns {
+			if column.Name == temp.Value {
+				return column.Type, column.Len
+			}
+		}
+		panic(&NotFoundError{Kind: "column", Name: temp.Value})
+	case *ImmNode:
+		return TokenTypeToType(temp.Type), max(int64(len(temp.Value)), 8)
+	case *FuncNode:
+		name := GetFuncColumnName(temp)
+		for _, column := range columns { // 已经计算好的聚合函数
+			if column.Name == name {
+				return column.Type, column.Len
+			}
+		}
+		return GetFunc(temp.FuncName).RetType()
+	case *ExprNode:
+		switch temp.Operator {
+		case PLUS, MINUS, STAR, SLASH, PERCENT:
+			typ1, _ := GetNodeType(temp.Left, columns)
+			typ2, _ := GetNodeType(temp.Right, columns)
+			if typ1 == TypFloat || typ2 == TypFloat || temp.Operator == SLASH {
+				return TypFloat, 8
+			}
+			return TypInt, 8
+		case CONCAT:
+			_, len1 := GetNodeType(temp.Left, columns)
+			_, len2 := GetNodeType(temp.Right, columns)
+			return TypStr, len1 + len2
+		default:
+			return TypBool, 8
+		}
+	case *ParamNode:
+		return temp.Column.Type, temp.Column.Len
+	case *SubQueryNode:
+		column := temp.Operator.GetColumns()[0]
+		return column.Type, column.Len
+	default:
+		panic(fmt.Sprintf("not support node %v", node))
+	}
+}
+
+var (
+	OperatorSymbols = map[string]string{
+		EQ: "=", NE: "!=", GT: ">", GE: ">=", LT: "<", LE: "<=", AND: "AND", OR: "OR", NOT: "NOT",
+		IS: "IS", ISNOT: "IS NOT", EXISTS: "EXISTS", IN: "IN", NOTIN: "NOT IN", LIKE: "LIKE", NOTLIKE: "NOT LIKE", PLUS: "+", MINUS: "-", STAR: "*", SLASH: "/", PERCENT: "%", CONCAT: "||",
+	}
+)
+
+// 计算列的列名 函数保持原来的命名规则 表达式直接还原为 sql
+func GetNodeColumnName(node INode) string {
+	switch temp := node.(type) {
+	case *IDNode:
+		return temp.Value
+	case *ImmNode:
+		if temp.Type == STR {
+			return fmt.Sprintf("'%s'", temp.Value)
+		}
+		return temp.Value
+	case *FuncNode:
+		return GetFuncColumnName(temp)
+	case *ListNode:
+		items := make([]string, 0)
+		for _, item := range temp.Items {
+			items = append(items, GetNodeColumnName(item))
+		}
+		return "(" + strings.Join(items, ", ") + ")"
+	case *ParamNode:
+		return temp.Column.Name
+	case *SubQueryNode:
+		return temp.Name
+	case *ExprNode:
+		if temp.Operator == NOT || temp.Operator == EXISTS {
+			return fmt.Sprintf("%s %s", OperatorSymbols[temp.Operator], GetNodeColumnName(temp.Left))
+		}
+		if list, ok := temp.Right.(*ListNode); ok && (temp.Operator == LIKE || temp.Operator == NOTLIKE) {
+			return fmt.Sprintf("(%s %s %s ESCAPE %s)", GetNodeColumnName(temp.Left), OperatorSymbols[temp.Operator],
+				GetNodeColumnName(list.Items[0]), GetNodeColumnName(list.Items[1]))
+		}
+		return fmt.Sprintf("(%s %s %s)", GetNodeColumnName(temp.Left), OperatorSymbols[temp.Operator], GetNodeColumnName(temp.Right))
 	default:
-		panic(fmt.Sprintf("unsupport operator: %v", expr.Operator))
+		panic(fmt.Sprintf("not support node %v", node))
 	}
 }
 
@@ -387,11 +851,16 @@ func SubSlice[T comparable](val1 []T, val2 []T) []T {
 func GetFuncColumnName(node *FuncNode) string {
 	buff := &strings.Builder{}
 	buff.WriteString(node.FuncName)
+	if node.Distinct {
+		buff.WriteString("#DISTINCT")
+	}
 	// 各拿一个特征拼一下，保证其唯一就行了
 	for _, param := range node.Params {
 		if idNode, ok := param.(*IDNode); ok {
 			buff.WriteRune('#')
 			buff.WriteString(idNode.Value)
+		} else if _, ok = param.(*StarNode); ok {
+			buff.WriteString("#*")
 		}
 	}
 	return buff.String()
@@ -405,11 +874,35 @@ func TokenTypeToType(tokenType string) int8 {
 		return TypFloat
 	case STR:
 		return TypStr
+	case NULL:
+		return TypNull
+	case BOOL:
+		return TypBool
 	default:
 		panic(fmt.Sprintf("unknown token type: %s", tokenType))
 	}
 }
 
+// 常量折叠的结果转换为字面量
+func ValueToImmNode(val *Value) *ImmNode {
+	if val.IsNull() {
+		return &ImmNode{Value: "NULL", Type: NULL}
+	}
+	switch val.Type {
+	case TypInt:
+		return &ImmNode{Value: FormatValue(val), Type: INT}
+	case TypFloat:
+		return &ImmNode{Value: FormatValue(val), Type: FLOAT}
+	case TypBool:
+		if val.ToBool() {
+			return &ImmNode{Value: TrueValue, Type: BOOL}
+		}
+		return &ImmNode{Value: FalseValue, Type: BOOL}
+	default:
+		return &ImmNode{Value: FormatValue(val), Type: STR}
+	}
+}
+
 func PrintTable(operator IOperator) {
 	data := make([][]string, 0)
 	ls := make([]int, len(operator.GetColumns()))
@@ -426,7 +919,10 @@ func PrintTable(operator IOperator) {
 		}
 		row = make([]string, 0)
 		for i, item := range res {
-			itemStr := fmt.Sprintf("%v", item)
+			itemStr := "NULL"
+			if item != nil {
+				itemStr = fmt.Sprintf("%v", item)
+			}
 			row = append(row, itemStr)
 			ls[i] = max(ls[i], len(itemStr))
 		}